@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/zapr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "go.uber.org/automaxprocs"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"internal/constant"
 	"internal/global"
+	"internal/idempotency"
+	"internal/ratelimit"
 	"internal/rpc"
 	"internal/settings"
 	"internal/upload"
@@ -46,6 +49,17 @@ var (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "move-user":
+			moveUser(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		}
+	}
+
 	ctx, quit := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGHUP)
 	defer quit()
 
@@ -65,7 +79,8 @@ func main() {
 		"addr", settings.UrlListen, "pid_file", *pidFile)
 	logger.V(1).Info(logo)
 
-	producer := mb.NewProducer(settings.MessageBroker)
+	producer := mb.NewProducer(settings.MessageBroker, logger)
+	defer producer.Close()
 
 	hub := global.New(exPath, settings, logger, constant.AppName, producer)
 	defer hub.Dispose()
@@ -75,7 +90,11 @@ func main() {
 
 	startPprof()
 
-	srv := newServer(hub)
+	//NOTE: requests outliving the graceful shutdown are cancelled with their queries
+	requestsCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
+
+	srv := newServer(hub, requestsCtx)
 
 	<-ctx.Done()
 
@@ -88,7 +107,12 @@ func main() {
 	})
 
 	// Wait for connections to drain.
-	srv.Shutdown(context.Background())
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 25*time.Second)
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error(err, "Connections haven't drained, cancelling requests")
+		cancelRequests()
+	}
 
 	logger.Info("Exiting", "pid", os.Getpid())
 }
@@ -137,13 +161,17 @@ func startPprof() {
 		http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintf(w, "")
 		})
+		http.Handle("/metrics", promhttp.Handler())
 		log.Fatal(http.ListenAndServe(":7200", nil))
 	}()
 }
 
-func newServer(globs global.Hub) *http.Server {
+func newServer(globs global.Hub, requestsCtx context.Context) *http.Server {
 	mux := http.NewServeMux()
-	srv := &http.Server{Handler: mux}
+	srv := &http.Server{
+		Handler:     mux,
+		BaseContext: func(net.Listener) context.Context { return requestsCtx },
+	}
 
 	ln, err := net.Listen("tcp", globs.Settings.UrlListen)
 	if err != nil {
@@ -167,7 +195,21 @@ func newServer(globs global.Hub) *http.Server {
 }
 
 func initHandlers(mux *http.ServeMux, globs global.Hub) error {
-	mux.Handle("/gateway_create_advert", upload.NewServer(globs))
+	var createAdvert http.Handler = upload.NewServer(globs)
+	createAdvert = ratelimit.NewMiddleware(globs.Settings.RateLimit, globs.Logger, globs.Rd.MainPool(),
+		upload.RequestCosts, createAdvert)
+	//NOTE: retries are replayed before the rate limiter, so they don't consume the quotas
+	createAdvert = idempotency.NewMiddleware(globs.Settings.Idempotency, globs.Logger, globs.Rd.MainPool(),
+		upload.RequestFingerprint, createAdvert)
+	mux.Handle("/gateway_create_advert", gatewayHandler(globs, createAdvert))
+	mux.Handle("/gateway_publish_advert", gatewayHandler(globs, upload.NewPublishServer(globs)))
+	mux.Handle("/gateway_unpublish_advert", gatewayHandler(globs, upload.NewUnpublishServer(globs)))
+	mux.Handle("/health", newHealthHandler(globs))
 
 	return nil
 }
+
+// gatewayHandler checks the gateway token and then the bearer token before the handler
+func gatewayHandler(globs global.Hub, handler http.Handler) http.Handler {
+	return upload.GatewayTokenMiddleware(globs.Logger, globs.Auth.Middleware(globs.Logger, handler))
+}
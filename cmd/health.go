@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"internal/global"
+	"net/http"
+	"pkg/db"
+)
+
+type healthReport struct {
+	// Status is ok, degraded if some shard dbs are down or down if the main db is down
+	Status string      `json:"status"`
+	Dbs    []db.Health `json:"dbs"`
+}
+
+// newHealthHandler reports the health of the dbs, it responds 503 only if the main db is down,
+// as the requests of users on healthy shards are still served
+func newHealthHandler(globs global.Hub) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{Status: "ok", Dbs: globs.Db.Health()}
+		code := http.StatusOK
+
+		if !globs.Db.MainPool().Healthy() {
+			report.Status = "down"
+			code = http.StatusServiceUnavailable
+		} else if globs.Db.Degraded() {
+			report.Status = "degraded"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+	})
+}
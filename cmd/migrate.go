@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/go-logr/logr"
+	"internal/constant"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"pkg/db"
+	"pkg/expath"
+	"pkg/migrate"
+	"syscall"
+)
+
+const migrateUsage = "usage: advertd migrate up|down|status|baseline [flags]"
+
+type migrateTarget struct {
+	pool *db.Pool
+	dir  string
+}
+
+// runMigrate runs "advertd migrate", which applies db/migrations/main to the main db
+// and db/migrations/shards to every shard db
+func runMigrate(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+	action := args[0]
+
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := flags.String("dir", "../db/migrations", "migrations dir, relative to the executable if not absolute")
+	dbs := flags.String("db", "all", "databases to migrate: main, shards or all")
+	dryRun := flags.Bool("dry-run", false, "log the statements without running them")
+	steps := flags.Int("steps", 1, "amount of migrations to revert by down")
+	version := flags.Uint("version", 0, "last version marked as applied by baseline")
+	flags.Parse(args[1:])
+
+	exPath, err := expath.Get()
+	if err != nil {
+		panic("failed to get executable path: " + err.Error())
+	}
+
+	settings, err := initSettings(path.Join(exPath, "settings.json"))
+	if err != nil {
+		panic("failed to read settings: " + err.Error())
+	}
+
+	logger := newLogger(settings.LogLevel, constant.LogAppPrefix).WithName("[migrate]")
+
+	if !filepath.IsAbs(*dir) {
+		*dir = filepath.Join(exPath, *dir)
+	}
+
+	d := db.New(settings.DBs, logger)
+	defer d.Dispose()
+
+	var targets []migrateTarget
+	if *dbs == "main" || *dbs == "all" {
+		targets = append(targets, migrateTarget{pool: d.MainPool(), dir: filepath.Join(*dir, "main")})
+	}
+	if *dbs == "shards" || *dbs == "all" {
+		for _, pool := range d.Shards() {
+			targets = append(targets, migrateTarget{pool: pool, dir: filepath.Join(*dir, "shards")})
+		}
+	}
+	if len(targets) == 0 {
+		fmt.Fprintln(os.Stderr, "unknown -db value: "+*dbs)
+		os.Exit(2)
+	}
+
+	ctx, quit := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer quit()
+
+	for _, target := range targets {
+		err := migrateDb(ctx, logger.WithValues("db", target.pool.Alias()), target, action,
+			migrate.Options{DryRun: *dryRun}, *steps, uint32(*version))
+		if err != nil {
+			logger.Error(err, "Migration failed", "db", target.pool.Alias())
+			d.Dispose()
+			os.Exit(1)
+		}
+	}
+}
+
+func migrateDb(ctx context.Context, logger logr.Logger, target migrateTarget, action string,
+	opts migrate.Options, steps int, version uint32) error {
+
+	migrations, err := migrate.Load(target.dir)
+	if err != nil {
+		return err
+	}
+
+	m := migrate.New(db.NewDbConn(target.pool, logger), logger, opts)
+
+	var done []*migrate.Migration
+	switch action {
+	case "up":
+		done, err = m.Up(ctx, migrations)
+	case "down":
+		done, err = m.Down(ctx, migrations, steps)
+	case "baseline":
+		done, err = m.Baseline(ctx, migrations, version)
+	case "status":
+		statuses, err := m.Status(ctx, migrations)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			logger.Info("Migration", "migration", status.Migration.String(), "applied", status.Applied != nil)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate action \"%s\", %s", action, migrateUsage)
+	}
+
+	for _, migration := range done {
+		logger.Info("Migrated", "action", action, "migration", migration.String(), "dry_run", opts.DryRun)
+	}
+	if len(done) == 0 && err == nil {
+		logger.Info("Nothing to migrate", "action", action)
+	}
+
+	return err
+}
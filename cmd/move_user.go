@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"internal/constant"
+	"internal/global"
+	"internal/shardmove"
+	"os"
+	"os/signal"
+	"path"
+	"pkg/expath"
+	"syscall"
+)
+
+// moveUser runs "advertd move-user", which moves all rows of a user to another shard.
+// The move is checkpointed, so a failed run is continued by running the same command again.
+func moveUser(args []string) {
+	flags := flag.NewFlagSet("move-user", flag.ExitOnError)
+	userId := flags.Uint("user-id", 0, "id of the user to move")
+	targetShard := flags.Uint("target-shard", 0, "id of the shard to move the user to")
+	lockTtl := flags.Duration("lock-ttl", 0, "time other moves of the user are refused if the move dies during the cutover (default 60s)")
+	keepSource := flags.Bool("keep-source", false, "don't delete the user rows from the source shard")
+	flags.Parse(args)
+
+	if *userId == 0 || *targetShard == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	exPath, err := expath.Get()
+	if err != nil {
+		panic("failed to get executable path: " + err.Error())
+	}
+
+	settings, err := initSettings(path.Join(exPath, "settings.json"))
+	if err != nil {
+		panic("failed to read settings: " + err.Error())
+	}
+
+	logger := newLogger(settings.LogLevel, constant.LogAppPrefix).WithName("[moveUser]")
+
+	hub := global.New(exPath, settings, logger, constant.AppName, nil)
+	defer hub.Dispose()
+
+	ctx, quit := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer quit()
+
+	err = shardmove.Move(ctx, hub, logger, shardmove.Options{
+		UserId:      uint32(*userId),
+		TargetShard: uint32(*targetShard),
+		LockTtl:     *lockTtl,
+		KeepSource:  *keepSource,
+	})
+	if err != nil {
+		logger.Error(err, "Can't move user")
+		hub.Dispose()
+		os.Exit(1)
+	}
+}
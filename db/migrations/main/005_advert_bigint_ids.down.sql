@@ -0,0 +1,9 @@
+-- NOTE: snowflake advert ids don't fit int, delete such adverts first
+ALTER TABLE `advert`
+  MODIFY `id` int(11) unsigned NOT NULL AUTO_INCREMENT;
+
+ALTER TABLE `product_details`
+  MODIFY `advert_id` int(11) unsigned NOT NULL;
+
+ALTER TABLE `product_photo`
+  MODIFY `advert_id` int(11) unsigned NOT NULL;
@@ -0,0 +1,9 @@
+CREATE TABLE `user_move` (
+  `user_id`       int(11) unsigned NOT NULL,
+  `source_shard`  tinyint(3) unsigned NOT NULL,
+  `target_shard`  tinyint(3) unsigned NOT NULL,
+  `step`          tinyint(3) unsigned NOT NULL,
+  `mtime`         int(11) unsigned NOT NULL DEFAULT '0',
+
+  PRIMARY KEY `user_id` (`user_id`)
+) CHARACTER SET utf8 COLLATE utf8_general_ci ENGINE=InnoDB;
@@ -0,0 +1,2 @@
+ALTER TABLE `user_move`
+  DROP `fence`;
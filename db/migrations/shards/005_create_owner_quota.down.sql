@@ -0,0 +1 @@
+DROP TABLE `owner_quota`;
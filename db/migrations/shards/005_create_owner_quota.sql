@@ -0,0 +1,7 @@
+CREATE TABLE `owner_quota` (
+  `owner_id`   int(11) unsigned NOT NULL,
+  `category`   tinyint(3) unsigned NOT NULL,
+  `active`     int(11) unsigned NOT NULL DEFAULT '0',
+
+  PRIMARY KEY `owner_id,category` (`owner_id`, `category`)
+) CHARACTER SET utf8 COLLATE utf8_general_ci ENGINE=InnoDB;
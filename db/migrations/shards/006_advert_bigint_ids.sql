@@ -0,0 +1,8 @@
+ALTER TABLE `advert`
+  MODIFY `id` bigint(20) unsigned NOT NULL;
+
+ALTER TABLE `product_details`
+  MODIFY `advert_id` bigint(20) unsigned NOT NULL;
+
+ALTER TABLE `product_photo`
+  MODIFY `advert_id` bigint(20) unsigned NOT NULL;
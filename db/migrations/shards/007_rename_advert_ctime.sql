@@ -0,0 +1,2 @@
+ALTER TABLE `advert`
+  CHANGE `сtime` `ctime` int(11) unsigned NOT NULL DEFAULT '0';
@@ -0,0 +1,6 @@
+CREATE TABLE `user_guard` (
+  `user_id`    int(11) unsigned NOT NULL,
+  `moving`     tinyint(3) unsigned NOT NULL DEFAULT '0',
+
+  PRIMARY KEY `user_id` (`user_id`)
+) CHARACTER SET utf8 COLLATE utf8_general_ci ENGINE=InnoDB;
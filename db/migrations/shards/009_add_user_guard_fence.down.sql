@@ -0,0 +1,2 @@
+ALTER TABLE `user_guard`
+  DROP `fence`;
@@ -0,0 +1,2 @@
+ALTER TABLE `user_guard`
+  ADD `fence` bigint(20) unsigned NOT NULL DEFAULT '0';
@@ -2,12 +2,13 @@ package advert
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
+	"internal/dbshard"
 	"internal/env"
 	"internal/geo"
+	"internal/quota"
 	"mime/multipart"
 	"net/url"
 	"pkg/db"
@@ -33,12 +34,8 @@ const (
 	ProductStateNew
 )
 
-var (
-	ErrDuplicateAdvert = errors.New("Advert already exist")
-)
-
 type SchemaProductDetails struct {
-	AdvertId     uint32   `db:"advert_id"`
+	AdvertId     uint64   `db:"advert_id"`
 	State        byte     `db:"state"`
 	Price        uint32   `db:"price"`
 	Category     byte     `db:"category"`
@@ -53,7 +50,7 @@ type SchemaProductDetails struct {
 }
 
 type SchemaAdvert struct {
-	Id          uint32 `db:"id"`
+	Id          uint64 `db:"id"`
 	OwnerId     uint32 `db:"owner_id"`
 	Title       string `db:"title"`
 	Description string `db:"description"`
@@ -64,7 +61,7 @@ type SchemaAdvert struct {
 }
 
 type Advert struct {
-	Id             uint32          `json:"id"`
+	Id             uint64          `json:"id"`
 	OwnerId        uint32          `json:"owner_id"`
 	Title          string          `json:"title"`
 	Description    string          `json:"description"`
@@ -98,30 +95,49 @@ type ProductDetails struct {
 	District     byte      `json:"district"`
 }
 
+// CreateAdvert allocates an id on the owner's shard and stores the advert with its photos.
+// The returned quota status is the Active adverts quota of the owner in the advert category,
+// which is only checked here and taken on publishing.
 func CreateAdvert(ctx context.Context, env *env.Environment, advert *Advert,
-	multiFiles []*multipart.FileHeader) error {
+	multiFiles []*multipart.FileHeader, tier string) (*quota.Status, error) {
+
+	err := dbshard.CheckUserNotMoving(env.Rd().MainPool(), advert.OwnerId)
+	if err != nil {
+		return nil, err
+	}
 
-	dbConn, err := env.ShardDb(advert.OwnerId)
+	dbConn, err := env.ShardDbOrRegister(ctx, advert.OwnerId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	category := advert.ProductDetails.Category
+	quotaStatus, err := quota.Check(ctx, dbConn, env.Settings.Quota.Limit(tier, category), advert.OwnerId, category)
+	if err != nil {
+		return nil, err
 	}
 
-	existingAdvert, err := getAdvert(dbConn, advert.Id, advert.OwnerId)
+	if !quotaStatus.Unlimited() && quotaStatus.Remaining == 0 {
+		return quotaStatus, errors.Wrapf(quota.ErrQuotaExceeded, "owner Id %d, category %d", advert.OwnerId, category)
+	}
+
+	shardId, err := env.UserShardId(ctx, advert.OwnerId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if existingAdvert != nil {
-		return errors.Wrapf(ErrDuplicateAdvert, "advert Id %d, owner Id %d", advert.Id, advert.OwnerId)
+	advert.Id, err = env.IdGen().Next(shardId)
+	if err != nil {
+		return nil, err
 	}
 
 	photoNames, err := storeUserPhotos(ctx, env, uint(advert.OwnerId), uint(advert.Id), multiFiles)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if len(photoNames) == 0 {
-		return errors.New("No Photos have been got")
+		return nil, errors.New("No Photos have been got")
 	}
 
 	advert.CTime = uint32(time.Now().Unix())
@@ -131,23 +147,30 @@ func CreateAdvert(ctx context.Context, env *env.Environment, advert *Advert,
 	schemaProductDetails := convertProductDetailsBusinessToDb(advert.Id, advert.ProductDetails)
 	schemaProductPhotos := buildProductPhotosByNames(env.Settings.StaticStorage.Url, advert.Id, photoNames)
 
-	err = dbConn.Transaction(func(conn *db.Conn) error {
+	err = dbConn.Transaction(ctx, func(conn *db.Conn) error {
+		{
+			err := dbshard.GuardUserWrites(ctx, conn, advert.OwnerId)
+			if err != nil {
+				return err
+			}
+		}
+
 		{
-			err := createAdvert(conn, schemaAdvert)
+			err := createAdvert(ctx, conn, schemaAdvert)
 			if err != nil {
 				return err
 			}
 		}
 
 		{
-			err := createProductDetails(conn, schemaProductDetails)
+			err := createProductDetails(ctx, conn, schemaProductDetails)
 			if err != nil {
 				return err
 			}
 		}
 
 		{
-			err := createProductPhotos(conn, schemaProductPhotos)
+			err := createProductPhotos(ctx, conn, schemaProductPhotos)
 			if err != nil {
 				return err
 			}
@@ -164,35 +187,16 @@ func CreateAdvert(ctx context.Context, env *env.Environment, advert *Advert,
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	advert.Photos = convertProductPhotosDbToBusiness(schemaProductPhotos)
 
-	return err
-}
-
-func getAdvert(conn *db.Conn, id uint32, ownerId uint32) (*SchemaAdvert, error) {
-	var advert SchemaAdvert
-	sb := conn.Select("id, owner_id")
-	err := sb.From("advert").
-		Where(sb.Equal("id", id),
-			sb.Equal("owner_id", ownerId),
-		).Limit(1).
-		LoadStruct(&advert)
-
-	if err == sql.ErrNoRows {
-		return nil, nil
-	}
-	if err != nil {
-		return nil, err
-	}
-
-	return &advert, nil
+	return quotaStatus, nil
 }
 
 func sendProcessPhotosRequestToMb(ctx context.Context, env *env.Environment,
-	ownerId uint32, advertId uint32, photos []*SchemaPhoto) error {
+	ownerId uint32, advertId uint64, photos []*SchemaPhoto) error {
 
 	req := &ProcessPhotoRequest{
 		AdvertId: advertId,
@@ -211,7 +215,7 @@ func sendProcessPhotosRequestToMb(ctx context.Context, env *env.Environment,
 	return err
 }
 
-func buildProductPhotosByNames(hostUrl string, advertId uint32, names []string) []*SchemaPhoto {
+func buildProductPhotosByNames(hostUrl string, advertId uint64, names []string) []*SchemaPhoto {
 	photos := make([]*SchemaPhoto, len(names))
 	for i := 0; i < len(names); i++ {
 		id := i + 1
@@ -221,61 +225,43 @@ func buildProductPhotosByNames(hostUrl string, advertId uint32, names []string)
 	return photos
 }
 
-func createProductPhotos(conn *db.Conn, photos []*SchemaPhoto) error {
-	builder := conn.InsertInto("product_photo").
-		Cols("id", "advert_id", "url", "position")
-
-	for _, photo := range photos {
-		builder.Values(photo.Id, photo.AdvertId, photo.Url, photo.Position)
-	}
-
-	_, err := builder.Exec()
+func createProductPhotos(ctx context.Context, conn *db.Conn, photos []*SchemaPhoto) error {
+	_, err := conn.InsertInto("product_photo").Structs(photos).Exec(ctx)
 	return err
 }
 
-func createProductDetails(conn *db.Conn, details *SchemaProductDetails) error {
-	/*_, err := conn.InsertInto("product_details").
-	Cols("advert_id", "State", "Price", "Category", "sub_category_1",
-		"sub_category_2", "sub_category_3", "Geolocation", "Country", "Area",
-		"City", "District").
-	Values(details.AdvertId, details.State, details.Price,
-		details.Category, details.SubCategory1, details.SubCategory2,
-		details.SubCategory3, details.Geolocation, details.Country,
-		details.Area, details.City, details.District).
-	Exec()*/
-
-	_, err := conn.InsertInto("product_details").
-		SQL(
-			fmt.Sprintf("(advert_id, state, price, category, sub_category_1, sub_category_2, sub_category_3, geolocation, country, area, city, district) values (%d,%d,%d,%d,%d,%d,%d,%s,%d,%d,%d,%d)",
-				details.AdvertId, details.State, details.Price,
-				details.Category, details.SubCategory1, details.SubCategory2,
-				details.SubCategory3,
-				fmt.Sprintf("ST_GeomFromText('POINT(%f %f)')", details.Geolocation.Longitude, details.Geolocation.Latitude),
-				details.Country, details.Area, details.City, details.District)).
-		Exec()
-
+func createProductDetails(ctx context.Context, conn *db.Conn, details *SchemaProductDetails) error {
+	_, err := conn.InsertInto("product_details").Struct(details).Exec(ctx)
 	return err
 }
 
-func createAdvert(conn *db.Conn, advert *SchemaAdvert) error {
-	_, err := conn.InsertInto("advert").
-		Cols("id", "owner_id", "title", "description", "сtime", "state").
-		Values(advert.Id, advert.OwnerId, advert.Title, advert.Description,
-			advert.CTime, advert.State).
-		Exec()
-
+func createAdvert(ctx context.Context, conn *db.Conn, advert *SchemaAdvert) error {
+	_, err := conn.InsertInto("advert").Struct(advert).Exec(ctx)
 	return err
 }
 
-func updateAdvertState(dbConn *db.Conn, ownerId uint32, advertId uint32, status Status) error {
+// transitAdvertState changes the state of the advert only if it is in the from state,
+// false means the advert is in another state, e.g. a redelivered message has already changed it
+func transitAdvertState(ctx context.Context, dbConn *db.Conn, ownerId uint32, advertId uint64,
+	from Status, to Status) (bool, error) {
+
 	ub := dbConn.Update("advert")
-	_, err := ub.Set(ub.Assign("state", status)).
+	res, err := ub.Set(ub.Assign("state", to)).
 		Where(
 			ub.Equal("id", advertId),
-			ub.Equal("owner_id", ownerId)).
-		Exec()
+			ub.Equal("owner_id", ownerId),
+			ub.Equal("state", from)).
+		Exec(ctx)
+	if err != nil {
+		return false, err
+	}
 
-	return err
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected > 0, nil
 }
 
 func convertProductPhotosDbToBusiness(schemaPhotos []*SchemaPhoto) []*Photo {
@@ -310,7 +296,7 @@ func convertAdvertBusinessToDb(advert *Advert) *SchemaAdvert {
 	}
 }
 
-func convertProductDetailsBusinessToDb(advertId uint32, details *ProductDetails) *SchemaProductDetails {
+func convertProductDetailsBusinessToDb(advertId uint64, details *ProductDetails) *SchemaProductDetails {
 	return &SchemaProductDetails{
 		advertId,
 		details.State,
@@ -1,8 +1,10 @@
 package advert
 
 import (
+	"context"
 	"encoding/json"
 	"github.com/segmentio/kafka-go"
+	"internal/dbshard"
 	"internal/env"
 	"pkg/db"
 )
@@ -16,13 +18,13 @@ type ProcessPhotoInfo struct {
 }
 
 type ProcessPhotoRequest struct {
-	AdvertId uint32              `json:"advert_id"`
+	AdvertId uint64              `json:"advert_id"`
 	OwnerId  uint32              `json:"owner_id"`
 	Photos   []*ProcessPhotoInfo `json:"photos"`
 }
 
 type ProcessPhotoResponse struct {
-	AdvertId uint32              `json:"advert_id"`
+	AdvertId uint64              `json:"advert_id"`
 	OwnerId  uint32              `json:"owner_id"`
 	Photos   []*ProcessPhotoInfo `json:"photos"`
 }
@@ -31,40 +33,60 @@ func (r *ProcessPhotoResponse) Load(value []byte) error {
 	return json.Unmarshal(value, r)
 }
 
-func ResponsePhotoProcess(env *env.Environment, m *kafka.Message) error {
+func ResponsePhotoProcess(ctx context.Context, env *env.Environment, m *kafka.Message) error {
 	response := &ProcessPhotoResponse{}
 	err := response.Load(m.Value)
 	if err != nil {
 		return err
 	}
 
-	shardDB, err := env.ShardDb(response.OwnerId)
+	err = dbshard.CheckUserNotMoving(env.Rd().MainPool(), response.OwnerId)
 	if err != nil {
 		return err
 	}
 
-	var urls []string
-	sb := shardDB.Select("url")
-	_, err = sb.From("product_photo").
-		Where(sb.Equal("advert_id", response.AdvertId)).LoadValues(&urls)
-
+	shardDB, err := env.ShardDbByAdvertId(ctx, response.AdvertId, response.OwnerId)
 	if err != nil {
 		return err
 	}
 
-	err = shardDB.Transaction(func(dbConn *db.Conn) error {
-		//1. Set photo urls in product_photo database
+	var prepared bool
+	var urls []string
+
+	//NOTE: responses for photos of the same advert may deadlock on product_photo
+	err = shardDB.TransactionRetry(ctx, db.RetryOptions{}, func(dbConn *db.Conn) error {
 		{
-			ub := buildUpdatePhotosQuery(dbConn, response.AdvertId, response.Photos)
-			_, err := ub.Exec()
+			err := dbshard.GuardUserWrites(ctx, dbConn, response.OwnerId)
 			if err != nil {
 				return err
 			}
 		}
 
-		//2. Change status of advert in advert database
+		//1. Change state of the created advert, a redelivered response finds it in another state,
+		// e.g. Active, and must not touch it
+		{
+			var err error
+			prepared, err = transitAdvertState(ctx, dbConn, response.OwnerId, response.AdvertId,
+				StatusCreated, StatusPrepared)
+			if err != nil || !prepared {
+				return err
+			}
+		}
+
+		//2. Get temp photo urls before they are replaced
 		{
-			err := updateAdvertState(dbConn, response.OwnerId, response.AdvertId, StatusPrepared)
+			urls = nil
+			sb := dbConn.Select("url")
+			_, err := sb.From("product_photo").
+				Where(sb.Equal("advert_id", response.AdvertId)).LoadValues(ctx, &urls)
+			if err != nil {
+				return err
+			}
+		}
+
+		//3. Set photo urls in product_photo database
+		{
+			err := updatePhotoUrls(ctx, dbConn, response.AdvertId, response.Photos)
 			if err != nil {
 				return err
 			}
@@ -77,7 +99,13 @@ func ResponsePhotoProcess(env *env.Environment, m *kafka.Message) error {
 		return err
 	}
 
-	//3. Remove temp Photos by Url from storage
+	if !prepared {
+		env.Logger.Info("Skipping photo process response of advert not in Created state",
+			"advert", response.AdvertId, "owner", response.OwnerId)
+		return nil
+	}
+
+	//4. Remove temp Photos by Url from storage
 	err = removeFilesByUrl(env.Settings.StaticStorage.Path, urls)
 	if err != nil {
 		return err
@@ -100,7 +128,7 @@ func getProcessPhotosInfo(schemaPhotos []*SchemaPhoto) []*ProcessPhotoInfo {
 
 type SchemaPhoto struct {
 	Id        uint32 `db:"id"`
-	AdvertId  uint32 `db:"advert_id"`
+	AdvertId  uint64 `db:"advert_id"`
 	Url       string `db:"url"`
 	UrlSmall  string `db:"url_small"`
 	UrlMedium string `db:"url_medium"`
@@ -117,13 +145,34 @@ type Photo struct {
 	Position  byte   `json:"position"`
 }
 
-func buildUpdatePhotosQuery(db *db.Conn, advertId uint32, photos []*ProcessPhotoInfo) *db.InsertBuilder {
-	builder := db.ReplaceInto("product_photo").
-		Cols("id", "advert_id", "url", "url_small", "url_medium", "url_big")
+// schemaPhotoUrls are the columns of product_photo set by the photo processing
+type schemaPhotoUrls struct {
+	Url       string `db:"url"`
+	UrlSmall  string `db:"url_small"`
+	UrlMedium string `db:"url_medium"`
+	UrlBig    string `db:"url_big"`
+}
 
+func updatePhotoUrls(ctx context.Context, dbConn *db.Conn, advertId uint64, photos []*ProcessPhotoInfo) error {
+	//NOTE: the photos are created with the advert, so their rows are only updated keeping the position
 	for _, photo := range photos {
-		builder.Values(photo.Id, advertId, photo.Url, photo.UrlSmall, photo.UrlMedium, photo.UrlBig)
+		urls := &schemaPhotoUrls{
+			Url:       photo.Url,
+			UrlSmall:  photo.UrlSmall,
+			UrlMedium: photo.UrlMedium,
+			UrlBig:    photo.UrlBig,
+		}
+
+		ub := dbConn.Update("product_photo")
+		_, err := ub.SetStruct(urls).
+			Where(
+				ub.Equal("id", photo.Id),
+				ub.Equal("advert_id", advertId)).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
 	}
 
-	return builder
+	return nil
 }
@@ -0,0 +1,311 @@
+package advert
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"internal/dbshard"
+	"internal/env"
+	"internal/global"
+	"internal/quota"
+	"internal/settings"
+	"os"
+	"path/filepath"
+	"pkg/db"
+	"pkg/rd"
+	"strconv"
+	"testing"
+)
+
+const (
+	testOwnerId  = 7
+	testAdvertId = 1001
+	testCategory = 3
+)
+
+var testShardSchema = []string{
+	`CREATE TABLE advert (id INTEGER PRIMARY KEY, owner_id INTEGER NOT NULL, title TEXT NOT NULL,
+		description TEXT NOT NULL, ctime INTEGER NOT NULL DEFAULT 0, stime INTEGER NOT NULL DEFAULT 0,
+		ftime INTEGER NOT NULL DEFAULT 0, state INTEGER NOT NULL)`,
+	`CREATE TABLE product_details (advert_id INTEGER PRIMARY KEY, category INTEGER NOT NULL)`,
+	`CREATE TABLE product_photo (id INTEGER NOT NULL, advert_id INTEGER NOT NULL, url TEXT NOT NULL,
+		url_small TEXT NOT NULL DEFAULT '', url_medium TEXT NOT NULL DEFAULT '', url_big TEXT NOT NULL DEFAULT '',
+		position INTEGER NOT NULL, PRIMARY KEY (advert_id, id))`,
+	`CREATE TABLE owner_quota (owner_id INTEGER NOT NULL, category INTEGER NOT NULL,
+		active INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (owner_id, category))`,
+	`CREATE TABLE user_guard (user_id INTEGER PRIMARY KEY, moving INTEGER NOT NULL DEFAULT 0,
+		fence INTEGER NOT NULL DEFAULT 0)`,
+}
+
+// newTestEnv runs the environment of the owner on SQLite main and shard dbs and miniredis
+func newTestEnv(t *testing.T, s settings.Settings) *env.Environment {
+	t.Helper()
+
+	dir := t.TempDir()
+	spec := func(name string) db.Spec {
+		return db.Spec{
+			Driver: db.DriverSQLite,
+			Name:   filepath.Join(dir, name+".db"),
+			Params: map[string]string{"_pragma": "busy_timeout(5000)"},
+		}
+	}
+	s.DBs = db.Settings{string(db.MainAlias): spec("main"), "shard_01": spec("shard_01")}
+
+	mr := miniredis.RunT(t)
+	s.RDs = rd.Settings{string(rd.MainAlias): {Host: mr.Host(), Port: mr.Server().Addr().Port}}
+
+	s.StaticStorage.Path = filepath.Join(dir, "static")
+	if err := os.Mkdir(s.StaticStorage.Path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logr.Discard()
+	d := db.New(s.DBs, logger)
+	r := rd.New(s.RDs, logger)
+	hub := global.Hub{
+		Settings:   s,
+		Logger:     logger,
+		Db:         d,
+		Rd:         r,
+		ShardCache: dbshard.NewShardCache(s.ShardCache, r.MainPool(), logger, int(d.ShardsAmount())),
+	}
+	t.Cleanup(hub.Dispose)
+
+	e := env.NewEnvironment(hub)
+	t.Cleanup(e.Close)
+
+	mustExec(t, e.MainDb(), "CREATE TABLE user_shard (user_id INTEGER PRIMARY KEY, shard_id INTEGER NOT NULL)")
+	mustExec(t, e.MainDb(), "INSERT INTO user_shard (user_id, shard_id) VALUES (?, 1)", testOwnerId)
+
+	shardDb, err := e.ShardDb(context.Background(), testOwnerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range testShardSchema {
+		mustExec(t, shardDb, query)
+	}
+
+	return e
+}
+
+func mustExec(t *testing.T, dbConn *db.Conn, query string, args ...interface{}) {
+	t.Helper()
+
+	if _, err := dbConn.ExecBySQL(context.Background(), query, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// createTestAdvert creates the advert with photos uploaded to the temp storage, as CreateAdvert does
+func createTestAdvert(t *testing.T, e *env.Environment, advertId uint64, photos int) []string {
+	t.Helper()
+
+	shardDb, err := e.ShardDb(context.Background(), testOwnerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustExec(t, shardDb, "INSERT INTO advert (id, owner_id, title, description, state) VALUES (?, ?, 'chair', '', ?)",
+		advertId, testOwnerId, StatusCreated)
+	mustExec(t, shardDb, "INSERT INTO product_details (advert_id, category) VALUES (?, ?)", advertId, testCategory)
+
+	var tempFiles []string
+	for id := 1; id <= photos; id++ {
+		name := filepath.Base(t.Name()) + "_" + strconv.Itoa(id) + ".jpg"
+		path := filepath.Join(e.Settings.StaticStorage.Path, name)
+		if err := os.WriteFile(path, []byte("jpg"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		tempFiles = append(tempFiles, path)
+
+		mustExec(t, shardDb, "INSERT INTO product_photo (id, advert_id, url, position) VALUES (?, ?, ?, ?)",
+			id, advertId, "/static/"+name, id)
+	}
+
+	return tempFiles
+}
+
+func processedPhotoMessage(t *testing.T, advertId uint64, photos int) *kafka.Message {
+	t.Helper()
+
+	response := &ProcessPhotoResponse{AdvertId: advertId, OwnerId: testOwnerId}
+	for id := 1; id <= photos; id++ {
+		response.Photos = append(response.Photos, &ProcessPhotoInfo{
+			Id:        uint32(id),
+			Url:       "/photos/" + strconv.Itoa(id) + ".jpg",
+			UrlSmall:  "/photos/" + strconv.Itoa(id) + "_s.jpg",
+			UrlMedium: "/photos/" + strconv.Itoa(id) + "_m.jpg",
+			UrlBig:    "/photos/" + strconv.Itoa(id) + "_b.jpg",
+		})
+	}
+
+	value, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &kafka.Message{Value: value}
+}
+
+func loadAdvertState(t *testing.T, e *env.Environment, advertId uint64) Status {
+	t.Helper()
+
+	shardDb, err := e.ShardDb(context.Background(), testOwnerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var state byte
+	sb := shardDb.Select("state")
+	err = sb.From("advert").Where(sb.Equal("id", advertId)).LoadValue(context.Background(), &state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Status(state)
+}
+
+func loadActiveQuota(t *testing.T, e *env.Environment) int {
+	t.Helper()
+
+	shardDb, err := e.ShardDb(context.Background(), testOwnerId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := quota.Check(context.Background(), shardDb, 0, testOwnerId, testCategory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Used
+}
+
+func TestResponsePhotoProcess(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, settings.Settings{})
+	tempFiles := createTestAdvert(t, e, testAdvertId, 2)
+
+	if err := ResponsePhotoProcess(ctx, e, processedPhotoMessage(t, testAdvertId, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := loadAdvertState(t, e, testAdvertId); state != StatusPrepared {
+		t.Errorf("state = %d, want Prepared", state)
+	}
+
+	shardDb, _ := e.ShardDb(ctx, testOwnerId)
+	var photos []*SchemaPhoto
+	sb := shardDb.Select("id", "advert_id", "url", "url_small", "url_medium", "url_big", "position")
+	_, err := sb.From("product_photo").OrderBy("id").LoadStructs(ctx, &photos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SchemaPhoto{Id: 2, AdvertId: testAdvertId,
+		Url: "/photos/2.jpg", UrlSmall: "/photos/2_s.jpg", UrlMedium: "/photos/2_m.jpg", UrlBig: "/photos/2_b.jpg",
+		Position: 2}
+	if len(photos) != 2 || *photos[1] != want {
+		t.Errorf("photos = %+v, want the second one %+v", photos, want)
+	}
+
+	for _, path := range tempFiles {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("temp photo %s is not removed: %v", path, err)
+		}
+	}
+}
+
+func TestResponsePhotoProcessReplay(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, settings.Settings{})
+	createTestAdvert(t, e, testAdvertId, 1)
+	message := processedPhotoMessage(t, testAdvertId, 1)
+
+	if err := ResponsePhotoProcess(ctx, e, message); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublishAdvert(ctx, e, testOwnerId, testAdvertId, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: the broker redelivers the response after the advert is published
+	if err := ResponsePhotoProcess(ctx, e, message); err != nil {
+		t.Fatal(err)
+	}
+
+	if state := loadAdvertState(t, e, testAdvertId); state != StatusActive {
+		t.Errorf("state after replay = %d, want Active", state)
+	}
+	if used := loadActiveQuota(t, e); used != 1 {
+		t.Errorf("active quota after replay = %d, want 1", used)
+	}
+
+	//NOTE: publishing again must not reserve another slot
+	if _, err := PublishAdvert(ctx, e, testOwnerId, testAdvertId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if used := loadActiveQuota(t, e); used != 1 {
+		t.Errorf("active quota after republish = %d, want 1", used)
+	}
+}
+
+func TestWritesOfMovingUser(t *testing.T) {
+	ctx := context.Background()
+	e := newTestEnv(t, settings.Settings{})
+	createTestAdvert(t, e, testAdvertId, 1)
+
+	shardDb, _ := e.ShardDb(ctx, testOwnerId)
+	if err := dbshard.BlockUserWrites(ctx, shardDb, testOwnerId, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	err := ResponsePhotoProcess(ctx, e, processedPhotoMessage(t, testAdvertId, 1))
+	if !errors.Is(err, dbshard.ErrUserMoving) {
+		t.Errorf("err = %v, want %v", err, dbshard.ErrUserMoving)
+	}
+	if state := loadAdvertState(t, e, testAdvertId); state != StatusCreated {
+		t.Errorf("state = %d, want Created", state)
+	}
+}
+
+func TestUnpublishAdvertReleasesQuota(t *testing.T) {
+	ctx := context.Background()
+	s := settings.Settings{}
+	s.Quota = quota.Settings{Tiers: map[string]quota.Tier{"": {MaxActivePerCategory: 1}}}
+	e := newTestEnv(t, s)
+
+	createTestAdvert(t, e, testAdvertId, 1)
+	createTestAdvert(t, e, testAdvertId+1, 1)
+	for _, advertId := range []uint64{testAdvertId, testAdvertId + 1} {
+		if err := ResponsePhotoProcess(ctx, e, processedPhotoMessage(t, advertId, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := PublishAdvert(ctx, e, testOwnerId, testAdvertId, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PublishAdvert(ctx, e, testOwnerId, testAdvertId+1, ""); !errors.Is(err, quota.ErrQuotaExceeded) {
+		t.Fatalf("publish over the limit err = %v, want %v", err, quota.ErrQuotaExceeded)
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err := UnpublishAdvert(ctx, e, testOwnerId, testAdvertId, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.Used != 0 {
+			t.Errorf("unpublish %d: used = %d, want 0", i, status.Used)
+		}
+	}
+	if state := loadAdvertState(t, e, testAdvertId); state != StatusPrepared {
+		t.Errorf("state = %d, want Prepared", state)
+	}
+
+	if _, err := PublishAdvert(ctx, e, testOwnerId, testAdvertId+1, ""); err != nil {
+		t.Fatalf("publish after the release: %v", err)
+	}
+	if used := loadActiveQuota(t, e); used != 1 {
+		t.Errorf("active quota = %d, want 1", used)
+	}
+}
@@ -0,0 +1,166 @@
+package advert
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"internal/dbshard"
+	"internal/env"
+	"internal/quota"
+	"pkg/db"
+	"time"
+)
+
+var (
+	ErrAdvertNotFound    = errors.New("Advert not found")
+	ErrAdvertNotPrepared = errors.New("Advert is not prepared for publishing")
+)
+
+type advertPublishState struct {
+	State    byte `db:"state"`
+	Category byte `db:"category"`
+}
+
+// PublishAdvert makes a prepared advert Active taking a slot of the owner's Active adverts quota
+// in the advert category. Publishing an already Active advert does nothing.
+func PublishAdvert(ctx context.Context, env *env.Environment, ownerId uint32, advertId uint64, tier string) (
+	*quota.Status, error) {
+
+	err := dbshard.CheckUserNotMoving(env.Rd().MainPool(), ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	dbConn, err := env.ShardDbByAdvertId(ctx, advertId, ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotaStatus *quota.Status
+
+	err = dbConn.Transaction(ctx, func(conn *db.Conn) error {
+		err := dbshard.GuardUserWrites(ctx, conn, ownerId)
+		if err != nil {
+			return err
+		}
+
+		current, err := lockAdvertPublishState(ctx, conn, ownerId, advertId)
+		if err != nil {
+			return err
+		}
+
+		limit := env.Settings.Quota.Limit(tier, current.Category)
+
+		if Status(current.State) == StatusActive {
+			quotaStatus, err = quota.Check(ctx, conn, limit, ownerId, current.Category)
+			return err
+		}
+
+		if Status(current.State) != StatusPrepared {
+			return errors.Wrapf(ErrAdvertNotPrepared, "advert Id %d, state %d", advertId, current.State)
+		}
+
+		quotaStatus, err = quota.Reserve(ctx, conn, limit, ownerId, current.Category)
+		if err != nil {
+			return err
+		}
+
+		return activateAdvert(ctx, conn, ownerId, advertId, uint32(time.Now().Unix()))
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return quotaStatus, nil
+}
+
+func activateAdvert(ctx context.Context, dbConn *db.Conn, ownerId uint32, advertId uint64, stime uint32) error {
+	ub := dbConn.Update("advert")
+	_, err := ub.Set(
+		ub.Assign("state", StatusActive),
+		ub.Assign("stime", stime)).
+		Where(
+			ub.Equal("id", advertId),
+			ub.Equal("owner_id", ownerId)).
+		Exec(ctx)
+
+	return err
+}
+
+// UnpublishAdvert makes an Active advert Prepared again releasing its slot of the owner's quota.
+// Unpublishing an advert which is not Active does nothing.
+func UnpublishAdvert(ctx context.Context, env *env.Environment, ownerId uint32, advertId uint64, tier string) (
+	*quota.Status, error) {
+
+	err := dbshard.CheckUserNotMoving(env.Rd().MainPool(), ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	dbConn, err := env.ShardDbByAdvertId(ctx, advertId, ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	var quotaStatus *quota.Status
+
+	err = dbConn.Transaction(ctx, func(conn *db.Conn) error {
+		err := dbshard.GuardUserWrites(ctx, conn, ownerId)
+		if err != nil {
+			return err
+		}
+
+		current, err := lockAdvertPublishState(ctx, conn, ownerId, advertId)
+		if err != nil {
+			return err
+		}
+
+		limit := env.Settings.Quota.Limit(tier, current.Category)
+
+		if Status(current.State) == StatusActive {
+			_, err := transitAdvertState(ctx, conn, ownerId, advertId, StatusActive, StatusPrepared)
+			if err != nil {
+				return err
+			}
+
+			err = quota.Release(ctx, conn, ownerId, current.Category)
+			if err != nil {
+				return err
+			}
+		}
+
+		quotaStatus, err = quota.Check(ctx, conn, limit, ownerId, current.Category)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return quotaStatus, nil
+}
+
+// lockAdvertPublishState locks the advert till the end of the transaction, so its state and quota change together
+func lockAdvertPublishState(ctx context.Context, conn *db.Conn, ownerId uint32, advertId uint64) (
+	*advertPublishState, error) {
+
+	current := &advertPublishState{}
+	sb := conn.Select("a.state", "d.category")
+	err := sb.From("advert a").
+		Join("product_details d", "d.advert_id = a.id").
+		Where(
+			sb.Equal("a.id", advertId),
+			sb.Equal("a.owner_id", ownerId)).
+		ForUpdate().
+		LoadStruct(ctx, current)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.Wrapf(ErrAdvertNotFound, "advert Id %d, owner Id %d", advertId, ownerId)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return current, nil
+}
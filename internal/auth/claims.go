@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"slices"
+	"strconv"
+)
+
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+var (
+	ErrNoClaims      = errors.New("request is not authenticated")
+	ErrOwnerMismatch = errors.New("owner id doesn't match authenticated user")
+)
+
+// Audience is the "aud" claim which may be either a string or an array of strings
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type Claims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss"`
+	Audience  Audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ClientId  string   `json:"azp"`
+	Roles     []string `json:"roles"`
+	Tier      string   `json:"tier"`
+}
+
+// OwnerId returns the verified subject as a user id
+func (c *Claims) OwnerId() (uint32, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 32)
+	if err != nil || id == 0 {
+		return 0, errors.Errorf("bad subject \"%s\"", c.Subject)
+	}
+	return uint32(id), nil
+}
+
+func (c *Claims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+func (c *Claims) IsAdmin() bool {
+	return c.HasRole(RoleAdmin)
+}
+
+func (c *Claims) IsModerator() bool {
+	return c.HasRole(RoleModerator)
+}
+
+// BindOwner resolves the owner of an owner-scoped operation.
+// A zero requested id means "myself". Only admins may act on behalf of another user.
+func (c *Claims) BindOwner(requested uint32) (uint32, error) {
+	ownerId, err := c.OwnerId()
+	if err != nil {
+		return 0, err
+	}
+
+	if requested == 0 || requested == ownerId {
+		return ownerId, nil
+	}
+
+	if c.IsAdmin() {
+		return requested, nil
+	}
+
+	return 0, errors.Wrapf(ErrOwnerMismatch, "requested %d, authenticated %d", requested, ownerId)
+}
+
+type claimsKey struct{}
+
+func WithClaims(ctx context.Context, claims *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+func ClaimsFromContext(ctx context.Context) (*Claims, error) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	if !ok || claims == nil {
+		return nil, ErrNoClaims
+	}
+	return claims, nil
+}
@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBindOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		claims    Claims
+		requested uint32
+		owner     uint32
+		err       error
+	}{
+		{"myself by zero", Claims{Subject: "42"}, 0, 42, nil},
+		{"myself by id", Claims{Subject: "42"}, 42, 42, nil},
+		{"other user", Claims{Subject: "42"}, 7, 0, ErrOwnerMismatch},
+		{"other user by moderator", Claims{Subject: "42", Roles: []string{RoleModerator}}, 7, 0, ErrOwnerMismatch},
+		{"other user by admin", Claims{Subject: "42", Roles: []string{RoleAdmin}}, 7, 7, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owner, err := tt.claims.BindOwner(tt.requested)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if owner != tt.owner {
+				t.Fatalf("owner %d, want %d", owner, tt.owner)
+			}
+		})
+	}
+}
+
+func TestClaimsFromContext(t *testing.T) {
+	if _, err := ClaimsFromContext(context.Background()); !errors.Is(err, ErrNoClaims) {
+		t.Fatalf("error %v, want %v", err, ErrNoClaims)
+	}
+
+	claims := &Claims{Subject: "42"}
+	got, err := ClaimsFromContext(WithClaims(context.Background(), claims))
+	if err != nil || got != claims {
+		t.Fatalf("got %v, %v", got, err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	v := newTestVerifier(t)
+
+	var passed *Claims
+	handler := v.Middleware(logr.Discard(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passed, _ = ClaimsFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		status        int
+	}{
+		{"no header", "", http.StatusUnauthorized},
+		{"not bearer", "Basic Zm9vOmJhcg==", http.StatusUnauthorized},
+		{"invalid token", "Bearer a.b.c", http.StatusUnauthorized},
+		{"valid token", "bearer " + sign(t, header{Alg: algHS256, Kid: "hs"}, validClaims()), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			passed = nil
+			r := httptest.NewRequest(http.MethodPost, "/", nil)
+			if len(tt.authorization) > 0 {
+				r.Header.Set(authorizationHeader, tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if (tt.status == http.StatusOK) != (passed != nil) {
+				t.Fatalf("claims passed %v", passed)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"os"
+)
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// key is a verification key loaded from the JWKS file.
+// Exactly one of secret (HS256) and public (RS256) is set.
+type key struct {
+	kid    string
+	alg    string
+	secret []byte
+	public *rsa.PublicKey
+}
+
+func loadKeys(path string, allowHmac bool) ([]*key, error) {
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var set jsonWebKeySet
+	if err := json.Unmarshal(dat, &set); err != nil {
+		return nil, errors.Wrapf(err, "bad jwks file \"%s\"", path)
+	}
+
+	keys := make([]*key, 0, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if len(jwk.Use) > 0 && jwk.Use != "sig" {
+			continue
+		}
+
+		k, err := parseKey(jwk)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad key \"%s\" in jwks file \"%s\"", jwk.Kid, path)
+		}
+		if k.alg == algHS256 && !allowHmac {
+			return nil, errors.Errorf("hmac key \"%s\" in jwks file \"%s\" is not allowed", jwk.Kid, path)
+		}
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.Errorf("no signing keys in jwks file \"%s\"", path)
+	}
+
+	return keys, nil
+}
+
+func parseKey(jwk jsonWebKey) (*key, error) {
+	switch jwk.Kty {
+	case "oct":
+		if len(jwk.Alg) > 0 && jwk.Alg != algHS256 {
+			return nil, errors.Errorf("unsupported alg \"%s\" for oct key", jwk.Alg)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(secret) == 0 {
+			return nil, errors.New("empty secret")
+		}
+		return &key{kid: jwk.Kid, alg: algHS256, secret: secret}, nil
+
+	case "RSA":
+		if len(jwk.Alg) > 0 && jwk.Alg != algRS256 {
+			return nil, errors.Errorf("unsupported alg \"%s\" for RSA key", jwk.Alg)
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		public := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if public.N.Sign() == 0 || public.E == 0 {
+			return nil, errors.New("empty modulus or exponent")
+		}
+		return &key{kid: jwk.Kid, alg: algRS256, public: public}, nil
+	}
+
+	return nil, errors.Errorf("unsupported key type \"%s\"", jwk.Kty)
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	algHS256 = "HS256"
+	algRS256 = "RS256"
+)
+
+var (
+	ErrMalformedToken   = errors.New("malformed token")
+	ErrUnsupportedAlg   = errors.New("unsupported signing algorithm")
+	ErrUnknownKey       = errors.New("unknown signing key")
+	ErrInvalidSignature = errors.New("invalid signature")
+	ErrTokenExpired     = errors.New("token is expired")
+	ErrTokenNotYetValid = errors.New("token is not valid yet")
+	ErrInvalidIssuer    = errors.New("invalid issuer")
+	ErrInvalidAudience  = errors.New("invalid audience")
+)
+
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verifier checks signatures and registered claims of end-user JWTs
+// against the keys of a local JWKS file
+type Verifier struct {
+	settings Settings
+	keys     []*key
+	now      func() time.Time
+}
+
+func NewVerifier(s Settings) (*Verifier, error) {
+	keys, err := loadKeys(s.JwksPath, s.AllowHmac)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Verifier{settings: s, keys: keys, now: time.Now}, nil
+}
+
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformedToken
+	}
+
+	var h header
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, errors.Wrap(ErrMalformedToken, err.Error())
+	}
+
+	k, err := v.findKey(h)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedToken, err.Error())
+	}
+
+	if err := verifySignature(k, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := &Claims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, errors.Wrap(ErrMalformedToken, err.Error())
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) findKey(h header) (*key, error) {
+	if h.Alg != algHS256 && h.Alg != algRS256 {
+		return nil, errors.Wrapf(ErrUnsupportedAlg, "\"%s\"", h.Alg)
+	}
+
+	for _, k := range v.keys {
+		//NOTE: the alg must match the key type, otherwise an RSA public key could be used as an HMAC secret
+		if k.alg != h.Alg {
+			continue
+		}
+		if len(h.Kid) == 0 || k.kid == h.Kid {
+			return k, nil
+		}
+	}
+
+	return nil, errors.Wrapf(ErrUnknownKey, "kid \"%s\", alg \"%s\"", h.Kid, h.Alg)
+}
+
+func verifySignature(k *key, signingInput string, signature []byte) error {
+	switch k.alg {
+	case algHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrInvalidSignature
+		}
+		return nil
+
+	case algRS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(k.public, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+
+	return ErrUnsupportedAlg
+}
+
+func (v *Verifier) validateClaims(c *Claims) error {
+	now := v.now().Unix()
+	leeway := int64(v.settings.LeewaySec)
+
+	if c.ExpiresAt == 0 {
+		return errors.Wrap(ErrMalformedToken, "no exp claim")
+	}
+	if now > c.ExpiresAt+leeway {
+		return ErrTokenExpired
+	}
+	if c.NotBefore != 0 && now+leeway < c.NotBefore {
+		return ErrTokenNotYetValid
+	}
+
+	if len(v.settings.Issuer) > 0 && c.Issuer != v.settings.Issuer {
+		return errors.Wrapf(ErrInvalidIssuer, "\"%s\"", c.Issuer)
+	}
+	if len(v.settings.Audience) > 0 && !slices.Contains(c.Audience, v.settings.Audience) {
+		return ErrInvalidAudience
+	}
+
+	if _, err := c.OwnerId(); err != nil {
+		return errors.Wrap(ErrMalformedToken, err.Error())
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, dest interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dest)
+}
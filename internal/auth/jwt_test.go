@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testNow    = time.Unix(1700000000, 0)
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testRsaKey = mustRsaKey()
+)
+
+func mustRsaKey() *rsa.PrivateKey {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func writeTestJwks(t *testing.T) string {
+	t.Helper()
+
+	set := jsonWebKeySet{Keys: []jsonWebKey{
+		{Kid: "hs", Kty: "oct", Alg: algHS256, Use: "sig", K: b64(testSecret)},
+		{Kid: "rs", Kty: "RSA", Alg: algRS256, Use: "sig",
+			N: b64(testRsaKey.N.Bytes()), E: b64(big.NewInt(int64(testRsaKey.E)).Bytes())},
+	}}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestVerifier(t *testing.T) *Verifier {
+	t.Helper()
+
+	v, err := NewVerifier(Settings{JwksPath: writeTestJwks(t), Issuer: "pet/auth", Audience: "advertd", LeewaySec: 30,
+		AllowHmac: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+// sign builds a token of the header and claims signed by the key of alg, "none" leaves it unsigned
+func sign(t *testing.T, h header, claims map[string]interface{}) string {
+	t.Helper()
+
+	hData, _ := json.Marshal(h)
+	cData, _ := json.Marshal(claims)
+	input := b64(hData) + "." + b64(cData)
+
+	var signature []byte
+	switch h.Alg {
+	case algHS256:
+		mac := hmac.New(sha256.New, testSecret)
+		mac.Write([]byte(input))
+		signature = mac.Sum(nil)
+	case algRS256:
+		digest := sha256.Sum256([]byte(input))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, testRsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return input + "." + b64(signature)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "42",
+		"iss": "pet/auth",
+		"aud": []string{"advertd", "other"},
+		"exp": testNow.Add(time.Hour).Unix(),
+		"nbf": testNow.Add(-time.Minute).Unix(),
+	}
+}
+
+func withClaim(name string, value interface{}) map[string]interface{} {
+	c := validClaims()
+	if value == nil {
+		delete(c, name)
+	} else {
+		c[name] = value
+	}
+	return c
+}
+
+func TestVerify(t *testing.T) {
+	v := newTestVerifier(t)
+
+	hs := header{Alg: algHS256, Kid: "hs", Typ: "JWT"}
+	rs := header{Alg: algRS256, Kid: "rs", Typ: "JWT"}
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid HS256", sign(t, hs, validClaims()), nil},
+		{"valid RS256", sign(t, rs, validClaims()), nil},
+		{"valid without kid", sign(t, header{Alg: algRS256}, validClaims()), nil},
+		{"single audience", sign(t, hs, withClaim("aud", "advertd")), nil},
+		{"expired within leeway", sign(t, hs, withClaim("exp", testNow.Add(-10*time.Second).Unix())), nil},
+		{"expired", sign(t, hs, withClaim("exp", testNow.Add(-time.Minute).Unix())), ErrTokenExpired},
+		{"no exp", sign(t, hs, withClaim("exp", nil)), ErrMalformedToken},
+		{"not yet valid", sign(t, hs, withClaim("nbf", testNow.Add(time.Minute).Unix())), ErrTokenNotYetValid},
+		{"wrong issuer", sign(t, hs, withClaim("iss", "evil")), ErrInvalidIssuer},
+		{"wrong audience", sign(t, hs, withClaim("aud", "other")), ErrInvalidAudience},
+		{"bad subject", sign(t, hs, withClaim("sub", "admin")), ErrMalformedToken},
+		{"alg none", sign(t, header{Alg: "none", Kid: "hs"}, validClaims()), ErrUnsupportedAlg},
+		{"unsupported alg", sign(t, header{Alg: "HS512", Kid: "hs"}, validClaims()), ErrUnsupportedAlg},
+		{"alg of other key type", sign(t, header{Alg: algHS256, Kid: "rs"}, validClaims()), ErrUnknownKey},
+		{"unknown kid", sign(t, header{Alg: algHS256, Kid: "gone"}, validClaims()), ErrUnknownKey},
+		{"two segments", "a.b", ErrMalformedToken},
+		{"bad header", "!!!.e30.e30", ErrMalformedToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := v.Verify(tt.token)
+			if tt.err == nil {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				if id, _ := claims.OwnerId(); id != 42 {
+					t.Fatalf("owner id %d, want 42", id)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestVerifyTamperedSignature(t *testing.T) {
+	v := newTestVerifier(t)
+
+	// a token signed for user 42 with the claims of user 7
+	signed := sign(t, header{Alg: algHS256, Kid: "hs"}, validClaims())
+	forged := sign(t, header{Alg: algHS256, Kid: "hs"}, withClaim("sub", "7"))
+	parts, forgedParts := strings.Split(signed, "."), strings.Split(forged, ".")
+
+	_, err := v.Verify(parts[0] + "." + forgedParts[1] + "." + parts[2])
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidSignature)
+	}
+}
+
+func TestNewVerifierRejectsHmacKeys(t *testing.T) {
+	_, err := NewVerifier(Settings{JwksPath: writeTestJwks(t)})
+	if err == nil || !strings.Contains(err.Error(), "hmac key \"hs\"") {
+		t.Fatalf("error %v, want the hmac key rejected", err)
+	}
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"github.com/go-logr/logr"
+	"net/http"
+	"strings"
+)
+
+const (
+	authorizationHeader = "Authorization"
+	bearerPrefix        = "Bearer "
+)
+
+// Middleware verifies the bearer token of the request and puts its claims into the request context
+func (v *Verifier) Middleware(logger logr.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get(authorizationHeader)
+		if len(value) <= len(bearerPrefix) || !strings.EqualFold(value[:len(bearerPrefix)], bearerPrefix) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized, bearer token is not specified.", http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := v.Verify(strings.TrimSpace(value[len(bearerPrefix):]))
+		if err != nil {
+			logger.V(1).Info("Rejected bearer token", "error", err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized, invalid token.", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
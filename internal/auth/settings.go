@@ -0,0 +1,11 @@
+package auth
+
+type Settings struct {
+	JwksPath  string `json:"jwks_path"`
+	Issuer    string `json:"issuer"`
+	Audience  string `json:"audience"`
+	LeewaySec int    `json:"leeway_sec"`
+	// AllowHmac accepts HS256 keys of the JWKS. They are shared secrets which sign tokens too,
+	// so only RS256 public keys are accepted by default.
+	AllowHmac bool `json:"allow_hmac"`
+}
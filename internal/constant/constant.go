@@ -6,4 +6,6 @@ const (
 	LogAppPrefix       = "pet/advertd"
 	AppVersion         = "1.0.0"
 	AdvertGatewayToken = "WIJfgniewoWJIFH"
+	// NodeIdEnv overrides the id generator node id of the settings for the instance
+	NodeIdEnv = "ADVERTD_NODE_ID"
 )
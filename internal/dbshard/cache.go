@@ -0,0 +1,243 @@
+package dbshard
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"internal/constant"
+	"pkg/db"
+	"pkg/lru"
+	"pkg/rd"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rdUserShardKey        = constant.AppPrefix + ":user2shard:"
+	rdUserShardChannel    = constant.AppPrefix + ":user2shard_invalidate"
+	defaultCacheTtlSec    = 86400 * 3
+	defaultNegativeTtlSec = 60
+	defaultLocalSize      = 100000
+	defaultLocalTtlSec    = 300
+	defaultInvalidTtlSec  = 10
+
+	// notRegisteredShardId is cached for users without a shard
+	notRegisteredShardId = 0
+	// invalidShardValue replaces the invalidated shard of a user, so lookups racing the change don't cache the old one
+	invalidShardValue = "-"
+)
+
+type CacheSettings struct {
+	TtlSec int `json:"ttl_sec"`
+	// NegativeTtlSec is how long unregistered users are remembered, registration drops it anyway
+	NegativeTtlSec int `json:"negative_ttl_sec"`
+	LocalSize      int `json:"local_size"`
+	// LocalTtlSec bounds the staleness of the in-process cache if an invalidation message is lost
+	LocalTtlSec int `json:"local_ttl_sec"`
+	// InvalidTtlSec is how long the user shard isn't cached after an invalidation,
+	// it must be longer than a lookup in the main db
+	InvalidTtlSec int `json:"invalid_ttl_sec"`
+}
+
+// ShardCache caches user shards in an in-process LRU in front of redis.
+// Changes of a mapping are published to all processes, which drop it from their LRU.
+// Lookups only cache a shard which is not cached yet and wasn't invalidated while they ran,
+// so a lookup of the old shard finishing after the change doesn't cache it again.
+type ShardCache struct {
+	settings     CacheSettings
+	rdp          *rd.Pool
+	logger       logr.Logger
+	shardsAmount int
+	local        *lru.Cache[uint32, uint32]
+	sub          *rd.Subscription
+	// invalidations counts the drops of the local cache, lookups racing any of them don't cache locally
+	invalidations atomic.Uint64
+}
+
+func NewShardCache(s CacheSettings, rdp *rd.Pool, logger logr.Logger, shardsAmount int) *ShardCache {
+	if s.TtlSec == 0 {
+		s.TtlSec = defaultCacheTtlSec
+	}
+	if s.NegativeTtlSec == 0 {
+		s.NegativeTtlSec = defaultNegativeTtlSec
+	}
+	if s.LocalSize == 0 {
+		s.LocalSize = defaultLocalSize
+	}
+	if s.LocalTtlSec == 0 {
+		s.LocalTtlSec = defaultLocalTtlSec
+	}
+	if s.InvalidTtlSec == 0 {
+		s.InvalidTtlSec = defaultInvalidTtlSec
+	}
+
+	c := &ShardCache{
+		settings:     s,
+		rdp:          rdp,
+		logger:       logger.WithName("[shardCache]"),
+		shardsAmount: shardsAmount,
+		local:        lru.New[uint32, uint32](s.LocalSize),
+	}
+
+	c.sub = rd.Subscribe(rdp, c.logger, c.onInvalidate, c.purgeLocal, rdUserShardChannel)
+
+	return c
+}
+
+func (c *ShardCache) Close() {
+	c.sub.Close()
+}
+
+// UserShardId returns the shard of the user looking it up in the main db on a cache miss
+func (c *ShardCache) UserShardId(ctx context.Context, mainDb *db.Conn, userId uint32) (uint32, error) {
+	invalidations := c.invalidations.Load()
+
+	shardId, ok := c.local.Get(userId)
+	if !ok {
+		shardId, ok = c.getRedis(userId)
+		if ok {
+			c.addLocal(invalidations, userId, shardId)
+		}
+	}
+
+	if !ok {
+		dbShardId, err := FindUserShardById(ctx, mainDb, userId)
+		switch {
+		case errors.Is(err, errUserNotRegistered):
+			shardId = notRegisteredShardId
+		case err != nil:
+			//NOTE: lookup failures are not cached
+			return 0, err
+		case !c.validShardId(uint32(dbShardId)):
+			return 0, errors.Errorf("user id %d is on invalid shard %d", userId, dbShardId)
+		default:
+			shardId = uint32(dbShardId)
+		}
+
+		if c.storeLookup(userId, shardId) {
+			c.addLocal(invalidations, userId, shardId)
+		}
+	}
+
+	if shardId == notRegisteredShardId {
+		return 0, errors.Wrapf(errUserNotRegistered, ": user id \"%d\" not found", userId)
+	}
+
+	return shardId, nil
+}
+
+// Set stores the new shard of the user and drops the old one in all processes
+func (c *ShardCache) Set(userId, shardId uint32) error {
+	c.store(userId, shardId)
+	return c.publish(userId)
+}
+
+// Invalidate drops the shard of the user in redis and in all processes
+func (c *ShardCache) Invalidate(userId uint32) error {
+	c.removeLocal(userId)
+
+	if _, err := c.rdp.Do("SETEX", userShardKey(userId), c.settings.InvalidTtlSec, invalidShardValue); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return c.publish(userId)
+}
+
+func (c *ShardCache) getRedis(userId uint32) (uint32, bool) {
+	value, err := redis.String(c.rdp.Do("GET", userShardKey(userId)))
+	if err == redis.ErrNil || value == invalidShardValue {
+		return 0, false
+	}
+	if err != nil {
+		//NOTE: falling back to the main db
+		c.logger.Error(err, "Can't get cached user shard", "user", userId)
+		return 0, false
+	}
+
+	shardId, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || (shardId != notRegisteredShardId && !c.validShardId(uint32(shardId))) {
+		//NOTE: the broken value is dropped, the shard is looked up in the main db
+		c.logger.Error(err, "Invalid cached user shard", "user", userId, "shard", value)
+		c.rdp.Do("DEL", userShardKey(userId))
+		return 0, false
+	}
+
+	return uint32(shardId), true
+}
+
+func (c *ShardCache) ttlSec(shardId uint32) int {
+	if shardId == notRegisteredShardId {
+		return c.settings.NegativeTtlSec
+	}
+	return c.settings.TtlSec
+}
+
+func (c *ShardCache) store(userId, shardId uint32) {
+	//NOTE: don't care about error here
+	c.rdp.Do("SETEX", userShardKey(userId), c.ttlSec(shardId), shardId)
+
+	c.local.Add(userId, shardId, c.localTtl(shardId))
+}
+
+// storeLookup caches the shard found by a lookup unless the user shard is cached or invalidated meanwhile
+func (c *ShardCache) storeLookup(userId, shardId uint32) bool {
+	_, err := redis.String(c.rdp.Do("SET", userShardKey(userId), shardId, "EX", c.ttlSec(shardId), "NX"))
+	if err != nil && err != redis.ErrNil {
+		c.logger.Error(err, "Can't cache user shard", "user", userId)
+	}
+	return err == nil
+}
+
+// addLocal caches the shard in the process unless the local cache was dropped since the lookup started
+func (c *ShardCache) addLocal(invalidations uint64, userId, shardId uint32) {
+	c.local.Add(userId, shardId, c.localTtl(shardId))
+
+	//NOTE: an invalidation between the check and the add is caught by the check after it
+	if c.invalidations.Load() != invalidations {
+		c.local.Remove(userId)
+	}
+}
+
+func (c *ShardCache) removeLocal(userId uint32) {
+	c.invalidations.Add(1)
+	c.local.Remove(userId)
+}
+
+func (c *ShardCache) purgeLocal() {
+	c.invalidations.Add(1)
+	c.local.Purge()
+}
+
+func (c *ShardCache) publish(userId uint32) error {
+	_, err := c.rdp.Do("PUBLISH", rdUserShardChannel, userId)
+	return errors.WithStack(err)
+}
+
+func (c *ShardCache) onInvalidate(_ string, data []byte) {
+	userId, err := strconv.ParseUint(string(data), 10, 32)
+	if err != nil {
+		c.logger.Error(err, "Bad user shard invalidation message", "data", string(data))
+		return
+	}
+
+	c.removeLocal(uint32(userId))
+}
+
+func (c *ShardCache) localTtl(shardId uint32) time.Duration {
+	ttlSec := c.settings.LocalTtlSec
+	if shardId == notRegisteredShardId && c.settings.NegativeTtlSec < ttlSec {
+		ttlSec = c.settings.NegativeTtlSec
+	}
+	return time.Duration(ttlSec) * time.Second
+}
+
+func (c *ShardCache) validShardId(shardId uint32) bool {
+	return shardId > 0 && int(shardId) <= c.shardsAmount
+}
+
+func userShardKey(userId uint32) string {
+	return rdUserShardKey + fmt.Sprintf("%d", userId)
+}
@@ -0,0 +1,97 @@
+package dbshard
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"pkg/db"
+	"testing"
+	"time"
+)
+
+func setUserShard(t *testing.T, mainDb *db.Conn, userId, shardId uint32) {
+	t.Helper()
+
+	ub := mainDb.Update("user_shard")
+	_, err := ub.Set(ub.Assign("shard_id", shardId)).Where(ub.Equal("user_id", userId)).Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShardCacheLookup(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 2)
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	addUsers(t, mainDb, 1, 1, 1)
+	cache, mr := newTestShardCache(t, 2)
+
+	if shardId, err := cache.UserShardId(ctx, mainDb, 1); err != nil || shardId != 1 {
+		t.Fatalf("shard = %d, %v, want 1", shardId, err)
+	}
+	if got, _ := mr.Get(userShardKey(1)); got != "1" {
+		t.Errorf("cached shard = %q, want 1", got)
+	}
+
+	//NOTE: the cached shard is returned till it is invalidated
+	setUserShard(t, mainDb, 1, 2)
+	if shardId, err := cache.UserShardId(ctx, mainDb, 1); err != nil || shardId != 1 {
+		t.Errorf("cached shard = %d, %v, want 1", shardId, err)
+	}
+
+	if _, err := cache.UserShardId(ctx, mainDb, 5); !errors.Is(err, errUserNotRegistered) {
+		t.Errorf("not registered user err = %v, want %v", err, errUserNotRegistered)
+	}
+	if err := cache.Set(5, 2); err != nil {
+		t.Fatal(err)
+	}
+	if shardId, err := cache.UserShardId(ctx, mainDb, 5); err != nil || shardId != 2 {
+		t.Errorf("set shard = %d, %v, want 2", shardId, err)
+	}
+}
+
+func TestShardCacheStaleLookupAfterInvalidate(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 2)
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	addUsers(t, mainDb, 1, 1, 1)
+	cache, mr := newTestShardCache(t, 2)
+
+	//NOTE: the lookup reads the old shard from the main db, the move switches and invalidates before it caches
+	if err := cache.Invalidate(1); err != nil {
+		t.Fatal(err)
+	}
+	if shardId, err := cache.UserShardId(ctx, mainDb, 1); err != nil || shardId != 1 {
+		t.Fatalf("shard = %d, %v, want 1", shardId, err)
+	}
+
+	setUserShard(t, mainDb, 1, 2)
+	if shardId, err := cache.UserShardId(ctx, mainDb, 1); err != nil || shardId != 2 {
+		t.Errorf("shard after the switch = %d, %v, want 2 as the stale lookup isn't cached", shardId, err)
+	}
+
+	mr.FastForward(time.Duration(defaultInvalidTtlSec) * time.Second)
+	if shardId, err := cache.UserShardId(ctx, mainDb, 1); err != nil || shardId != 2 {
+		t.Fatalf("shard = %d, %v, want 2", shardId, err)
+	}
+	if got, _ := mr.Get(userShardKey(1)); got != "2" {
+		t.Errorf("cached shard after the invalidation expired = %q, want 2", got)
+	}
+}
+
+func TestShardCacheLocalInvalidatedDuringLookup(t *testing.T) {
+	cache, _ := newTestShardCache(t, 2)
+
+	invalidations := cache.invalidations.Load()
+	cache.onInvalidate(rdUserShardChannel, []byte("1"))
+	cache.addLocal(invalidations, 1, 1)
+
+	if _, ok := cache.local.Get(1); ok {
+		t.Error("shard looked up before the invalidation is cached locally")
+	}
+
+	cache.addLocal(cache.invalidations.Load(), 1, 2)
+	if shardId, ok := cache.local.Get(1); !ok || shardId != 2 {
+		t.Errorf("local shard = %d, %v, want 2", shardId, ok)
+	}
+}
@@ -1,59 +1,131 @@
 package dbshard
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"github.com/go-logr/logr"
-	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
-	"internal/constant"
 	"pkg/db"
-	"pkg/rd"
+	"pkg/idgen"
 )
 
-const (
-	rdUserShardKey      = constant.AppPrefix + ":user2shard:"
-	rdUserShardCacheSec = 86400 * 3
-)
+func GetShardDbByUserId(ctx context.Context, mainDb *db.Conn, shardPools []*db.Pool, cache *ShardCache,
+	logger logr.Logger, id uint32) (*db.Conn, uint32, error) {
 
-func GetShardDbByUserId(mainDb *db.Conn, shardPools []*db.Pool, rdp *rd.Pool, logger logr.Logger, id uint32) (
-	*db.Conn, uint32, error) {
+	shardId, err := cache.UserShardId(ctx, mainDb, id)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	rdKey := rdUserShardKey + fmt.Sprintf("%d", id)
+	db, err := GetShardDbConn(logger, shardPools, shardId)
+	return db, shardId, err
+}
 
-	var shardId uint32 = 0
+// GetShardDbByAdvertId returns the shard of the advert by the shard encoded in its id, so the owner's shard
+// is not looked up. Adverts of users moved to another shard keep the shard they were allocated on in the id,
+// the owner's shard is looked up if the advert is not there anymore or the owner was moved from it.
+func GetShardDbByAdvertId(ctx context.Context, mainDb *db.Conn, shardPools []*db.Pool, cache *ShardCache,
+	logger logr.Logger, advertId uint64, ownerId uint32) (*db.Conn, uint32, error) {
 
-	rdShardId, err := redis.Uint64(rdp.Do("GET", rdKey))
-	if err == redis.ErrNil {
-		dbShardId, err := FindUserShardById(mainDb, id)
+	shardId := idgen.ShardOf(advertId)
+	if conn, err := GetShardDbConn(logger, shardPools, shardId); err == nil {
+		found, err := isAdvertOnShard(ctx, conn, advertId, ownerId)
 		if err != nil {
 			return nil, 0, err
 		}
-
-		//NOTE: don't care about error here
-		rdp.Do("SETEX", rdKey, rdUserShardCacheSec, dbShardId)
-		shardId = uint32(dbShardId)
-	} else {
-		if err != nil {
-			return nil, 0, errors.WithStack(err)
+		if found {
+			return conn, shardId, nil
 		}
-		shardId = uint32(rdShardId)
 	}
 
-	if shardId == 0 {
-		return nil, 0, errors.Wrapf(db.ErrNotFound, "invalid shard(0), passed id:%d, cached in redis as:%d", id, rdShardId)
+	return GetShardDbByUserId(ctx, mainDb, shardPools, cache, logger, ownerId)
+}
+
+// isAdvertOnShard checks the advert of the owner is on the shard and the owner was not moved from it.
+// The rows of a moved user may stay on the source shard, its guard row blocks the user writes there for good.
+func isAdvertOnShard(ctx context.Context, conn *db.Conn, advertId uint64, ownerId uint32) (bool, error) {
+	var moving bool
+	sb := conn.Select("COALESCE(g.moving, 0)")
+	//NOTE: a lagging replica could miss the advert or the block of the user writes
+	err := sb.From("advert a").
+		LeftJoin("user_guard g", "g.user_id = a.owner_id").
+		Where(sb.Equal("a.id", advertId), sb.Equal("a.owner_id", ownerId)).
+		Limit(1).
+		Primary().
+		LoadValue(ctx, &moving)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.WithStack(err)
 	}
 
-	db, err := GetShardDbConn(logger, shardPools, shardId)
-	return db, shardId, err
+	return !moving, nil
+}
+
+// GetOrRegisterShardDbByUserId is GetShardDbByUserId placing unknown users on a shard picked by the policy
+func GetOrRegisterShardDbByUserId(ctx context.Context, mainDb *db.Conn, shardPools []*db.Pool, cache *ShardCache,
+	logger logr.Logger, placement *Placement, id uint32) (*db.Conn, uint32, error) {
+
+	conn, shardId, err := GetShardDbByUserId(ctx, mainDb, shardPools, cache, logger, id)
+	if !errors.Is(err, errUserNotRegistered) {
+		return conn, shardId, err
+	}
+
+	shardId, err = RegisterUser(ctx, mainDb, shardPools, cache, placement, id)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn, err = GetShardDbConn(logger, shardPools, shardId)
+	return conn, shardId, err
+}
+
+// RegisterUser assigns a shard to the user unless it already has one and returns the user's shard.
+// Concurrent registrations of the same user are safe: the first written shard wins.
+func RegisterUser(ctx context.Context, mainDb *db.Conn, shardPools []*db.Pool, cache *ShardCache,
+	placement *Placement, id uint32) (uint32, error) {
+
+	pickedShardId, err := placement.PickShard(ctx, mainDb, shardPools)
+	if err != nil {
+		return 0, err
+	}
+
+	if pickedShardId == 0 || int(pickedShardId) > len(shardPools) {
+		return 0, errors.Errorf("placement policy picked shard out of range: %d", pickedShardId)
+	}
+
+	res, err := mainDb.InsertIgnoreInto("user_shard").
+		Cols("user_id", "shard_id").
+		Values(id, pickedShardId).
+		Exec(ctx)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if inserted, _ := res.RowsAffected(); inserted > 0 {
+		placement.Placed(pickedShardId)
+	}
+
+	//NOTE: reading back as a concurrent registration could have written another shard
+	dbShardId, err := FindUserShardById(ctx, mainDb, id)
+	if err != nil {
+		return 0, err
+	}
+
+	//NOTE: replacing the cached negative lookup, don't care about error here
+	cache.Set(id, uint32(dbShardId))
+
+	return uint32(dbShardId), nil
 }
 
 var errUserNotRegistered = errors.New("user not registered")
 
-func FindUserShardById(mainDb *db.Conn, userId uint32) (int, error) {
+func FindUserShardById(ctx context.Context, mainDb *db.Conn, userId uint32) (int, error) {
 	var shardId int
 	sb := mainDb.Select("shard_id")
-	err := sb.From("user_shard").Where(sb.Equal("user_id", userId)).Limit(1).LoadValue(&shardId)
+	//NOTE: a lagging replica could return the shard the user was moved from or miss a just registered user
+	err := sb.From("user_shard").Where(sb.Equal("user_id", userId)).Limit(1).Primary().LoadValue(ctx, &shardId)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -0,0 +1,164 @@
+package dbshard
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"pkg/db"
+	"pkg/idgen"
+	"pkg/rd"
+	"testing"
+)
+
+// newTestDB opens SQLite main and shard dbs with the user_shard table in the main one
+func newTestDB(t *testing.T, shards int) *db.DB {
+	t.Helper()
+
+	dir := t.TempDir()
+	settings := db.Settings{}
+	for _, alias := range append([]string{string(db.MainAlias)}, testShardAliases(shards)...) {
+		settings[alias] = db.Spec{Driver: db.DriverSQLite, Name: filepath.Join(dir, alias+".db")}
+	}
+
+	d := db.New(settings, logr.Discard())
+	t.Cleanup(d.Dispose)
+
+	_, err := db.NewDbConn(d.MainPool(), logr.Discard()).ExecBySQL(context.Background(),
+		"CREATE TABLE user_shard (user_id INTEGER PRIMARY KEY, shard_id INTEGER NOT NULL)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+func testShardAliases(shards int) []string {
+	aliases := make([]string, shards)
+	for i := range aliases {
+		aliases[i] = fmt.Sprintf("shard_%02d", i+1)
+	}
+	return aliases
+}
+
+func addUsers(t *testing.T, mainDb *db.Conn, fromUserId uint32, shardId uint32, users int) {
+	t.Helper()
+
+	ib := mainDb.InsertInto("user_shard").Cols("user_id", "shard_id")
+	for i := 0; i < users; i++ {
+		ib.Values(fromUserId+uint32(i), shardId)
+	}
+	if _, err := ib.Exec(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestShardCache caches the shards in miniredis
+func newTestShardCache(t *testing.T, shards int) (*ShardCache, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdp := rd.OpenPool(rd.Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, logr.Discard())
+	t.Cleanup(func() { rdp.Close() })
+
+	cache := NewShardCache(CacheSettings{}, rdp, logr.Discard(), shards)
+	t.Cleanup(cache.Close)
+
+	return cache, mr
+}
+
+func TestRegisterUser(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 2)
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	addUsers(t, mainDb, 100, 1, 1)
+
+	placement, err := NewPlacement(PlacementSettings{LoadsTtlSec: 3600}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := newTestShardCache(t, 2)
+
+	for _, user := range []struct{ id, shardId uint32 }{{1, 2}, {2, 1}, {3, 2}} {
+		shardId, err := RegisterUser(ctx, mainDb, d.Shards(), cache, placement, user.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shardId != user.shardId {
+			t.Errorf("user %d shard = %d, want %d", user.id, shardId, user.shardId)
+		}
+	}
+
+	//NOTE: registering again keeps the shard and isn't counted
+	if shardId, err := RegisterUser(ctx, mainDb, d.Shards(), cache, placement, 1); err != nil || shardId != 2 {
+		t.Errorf("registered again shard = %d, %v, want 2", shardId, err)
+	}
+	if loads := placement.loads; loads[0].Users != 2 || loads[1].Users != 2 {
+		t.Errorf("loads = %+v, want 2 users on both shards", loads)
+	}
+}
+
+func TestGetShardDbByAdvertId(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 2)
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	cache, _ := newTestShardCache(t, 2)
+
+	shardDbs := make([]*db.Conn, 2)
+	for i := range shardDbs {
+		shardDbs[i] = db.NewDbConn(d.ShardPoolById(uint(i+1)), logr.Discard())
+		_, err := shardDbs[i].ExecBySQL(ctx, "CREATE TABLE advert (id INTEGER PRIMARY KEY, owner_id INTEGER NOT NULL);"+
+			"CREATE TABLE user_guard (user_id INTEGER PRIMARY KEY, moving INTEGER NOT NULL DEFAULT 0, fence INTEGER NOT NULL DEFAULT 0)")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gen, err := idgen.New(idgen.Settings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	advertId, err := gen.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addAdvert := func(shardDb *db.Conn) {
+		if _, err := shardDb.InsertInto("advert").Cols("id", "owner_id").Values(advertId, 7).Exec(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup := func() (uint32, error) {
+		_, shardId, err := GetShardDbByAdvertId(ctx, mainDb, d.Shards(), cache, logr.Discard(), advertId, 7)
+		return shardId, err
+	}
+
+	//NOTE: the user is not registered in user_shard, the lookup must not need it
+	addAdvert(shardDbs[0])
+	if shardId, err := lookup(); err != nil || shardId != 1 {
+		t.Fatalf("advert on its allocation shard = %d, %v, want 1", shardId, err)
+	}
+	//NOTE: an advert of another owner doesn't tell the shard of the owner
+	_, _, err = GetShardDbByAdvertId(ctx, mainDb, d.Shards(), cache, logr.Discard(), advertId, 8)
+	if !errors.Is(err, errUserNotRegistered) {
+		t.Errorf("advert of another owner err = %v, want %v", err, errUserNotRegistered)
+	}
+
+	//NOTE: the user is moved to shard 2, the source rows are left on shard 1 till the cleanup
+	addUsers(t, mainDb, 7, 2, 1)
+	addAdvert(shardDbs[1])
+	if err := BlockUserWrites(ctx, shardDbs[0], 7, 1); err != nil {
+		t.Fatal(err)
+	}
+	if shardId, err := lookup(); err != nil || shardId != 2 {
+		t.Errorf("advert of a user moved from its allocation shard = %d, %v, want 2", shardId, err)
+	}
+
+	if _, err := shardDbs[0].ExecBySQL(ctx, "DELETE FROM advert"); err != nil {
+		t.Fatal(err)
+	}
+	if shardId, err := lookup(); err != nil || shardId != 2 {
+		t.Errorf("advert deleted from its allocation shard = %d, %v, want 2", shardId, err)
+	}
+}
@@ -0,0 +1,123 @@
+package dbshard
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"internal/constant"
+	"pkg/db"
+	"pkg/rd"
+)
+
+const rdUserMoveLockKey = constant.AppPrefix + ":user_move:"
+
+var (
+	ErrUserMoving = errors.New("user is being moved to another shard")
+	// ErrMoveFenced rejects the writes of a move which lost its lock to a move with a greater fencing token
+	ErrMoveFenced = errors.New("user is moved by a newer move")
+)
+
+// UserMoveLockName is the name of the redis lock held while the user is switched to another shard
+func UserMoveLockName(userId uint32) string {
+	return rdUserMoveLockKey + fmt.Sprintf("%d", userId)
+}
+
+// CheckUserNotMoving rejects the writes of a moving user before they start their work,
+// the writes are guarded against the move by GuardUserWrites in their transaction
+func CheckUserNotMoving(rdp *rd.Pool, userId uint32) error {
+	moving, err := rd.LockHeld(rdp, UserMoveLockName(userId))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if moving {
+		return errors.Wrapf(ErrUserMoving, "user id %d", userId)
+	}
+
+	return nil
+}
+
+// GuardUserWrites must be called first in the shard transaction of every writer of user data.
+// It locks the guard row of the user till the end of the transaction, so blocking the writes by the move
+// waits for the running writers, and fails with ErrUserMoving once the writes on the shard are blocked.
+// Users without the row are not moving, the lock of the missing row blocks its insert by the move as well.
+func GuardUserWrites(ctx context.Context, conn *db.Conn, userId uint32) error {
+	var moving bool
+	sb := conn.Select("moving")
+	err := sb.From("user_guard").
+		Where(sb.Equal("user_id", userId)).
+		ForUpdate().
+		LoadValue(ctx, &moving)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if moving {
+		return errors.Wrapf(ErrUserMoving, "user id %d", userId)
+	}
+
+	return nil
+}
+
+// BlockUserWrites makes the writes of the user on the shard fail after the running ones are committed.
+// The fence is the fencing token of the move lock, moves with a lower one can't unblock the writes then.
+func BlockUserWrites(ctx context.Context, conn *db.Conn, userId uint32, fence int64) error {
+	return setUserMoving(ctx, conn, userId, true, fence)
+}
+
+// UnblockUserWrites lets the user write to the shard, e.g. the target shard of the user moved from it before
+func UnblockUserWrites(ctx context.Context, conn *db.Conn, userId uint32, fence int64) error {
+	return setUserMoving(ctx, conn, userId, false, fence)
+}
+
+// CheckMoveFence locks the guard row of the user till the end of the transaction and fails with ErrMoveFenced
+// if a move with a greater fencing token guarded the shard, so a move which lost its lock can't change it
+func CheckMoveFence(ctx context.Context, conn *db.Conn, userId uint32, fence int64) error {
+	var guardFence int64
+	sb := conn.Select("fence")
+	err := sb.From("user_guard").
+		Where(sb.Equal("user_id", userId)).
+		ForUpdate().
+		LoadValue(ctx, &guardFence)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if guardFence > fence {
+		return errors.Wrapf(ErrMoveFenced, "user id %d, fencing token %d, guarded by %d", userId, fence, guardFence)
+	}
+
+	return nil
+}
+
+func setUserMoving(ctx context.Context, conn *db.Conn, userId uint32, moving bool, fence int64) error {
+	return conn.Transaction(ctx, func(conn *db.Conn) error {
+		_, err := conn.InsertIgnoreInto("user_guard").
+			Cols("user_id").
+			Values(userId).
+			Exec(ctx)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+
+		if err := CheckMoveFence(ctx, conn, userId, fence); err != nil {
+			return err
+		}
+
+		ub := conn.Update("user_guard")
+		_, err = ub.Set(ub.Assign("moving", moving), ub.Assign("fence", fence)).
+			Where(ub.Equal("user_id", userId)).
+			Exec(ctx)
+
+		return errors.WithStack(err)
+	})
+}
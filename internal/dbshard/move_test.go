@@ -0,0 +1,55 @@
+package dbshard
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"pkg/db"
+	"testing"
+)
+
+func TestGuardUserWrites(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 1)
+	shardDb := db.NewDbConn(d.ShardPoolById(1), logr.Discard())
+	_, err := shardDb.ExecBySQL(ctx,
+		"CREATE TABLE user_guard (user_id INTEGER PRIMARY KEY, moving INTEGER NOT NULL DEFAULT 0, fence INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	guard := func() error {
+		return shardDb.Transaction(ctx, func(conn *db.Conn) error {
+			return GuardUserWrites(ctx, conn, 7)
+		})
+	}
+
+	if err := guard(); err != nil {
+		t.Errorf("user without the guard row err = %v", err)
+	}
+
+	if err := BlockUserWrites(ctx, shardDb, 7, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard(); !errors.Is(err, ErrUserMoving) {
+		t.Errorf("blocked user err = %v, want %v", err, ErrUserMoving)
+	}
+	if err := shardDb.Transaction(ctx, func(conn *db.Conn) error { return GuardUserWrites(ctx, conn, 8) }); err != nil {
+		t.Errorf("other user err = %v", err)
+	}
+
+	//NOTE: a move which lost its lock to the blocking one can't unblock the writes
+	if err := UnblockUserWrites(ctx, shardDb, 7, 1); !errors.Is(err, ErrMoveFenced) {
+		t.Errorf("unblock by a former move err = %v, want %v", err, ErrMoveFenced)
+	}
+	if err := guard(); !errors.Is(err, ErrUserMoving) {
+		t.Errorf("user unblocked by a former move err = %v, want %v", err, ErrUserMoving)
+	}
+
+	if err := UnblockUserWrites(ctx, shardDb, 7, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := guard(); err != nil {
+		t.Errorf("unblocked user err = %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+package dbshard
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"pkg/db"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	PolicyLeastLoaded = "least_loaded"
+	PolicyWeighted    = "weighted"
+	PolicyPinned      = "pinned"
+
+	defaultLoadsTtlSec = 10
+)
+
+var ErrNoShards = errors.New("no shards to place user on")
+
+type PlacementSettings struct {
+	Policy string `json:"policy"`
+	// Capacities are relative weights of shards by shard id for the weighted policy, 1 if not set
+	Capacities  map[uint32]int `json:"capacities"`
+	PinnedShard uint32         `json:"pinned_shard"`
+	// LoadsTtlSec is how long the user counts of the shards are cached, 10 if 0
+	LoadsTtlSec int `json:"loads_ttl_sec"`
+}
+
+// ShardLoad is the amount of users registered on a shard
+type ShardLoad struct {
+	ShardId uint32 `db:"shard_id"`
+	Users   int    `db:"users"`
+}
+
+// PlacementPolicy picks a shard for a new user
+type PlacementPolicy interface {
+	PickShard(loads []ShardLoad) (uint32, error)
+}
+
+// Placement picks shards for new users by the policy. The user counts of the shards are cached
+// and the users placed by the process are added to them, so registrations don't count all users every time.
+type Placement struct {
+	policy PlacementPolicy
+	ttl    time.Duration
+
+	mu       sync.Mutex
+	loads    []ShardLoad
+	loadedAt time.Time
+}
+
+func NewPlacement(s PlacementSettings, shardsAmount int) (*Placement, error) {
+	policy, err := NewPlacementPolicy(s, shardsAmount)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.LoadsTtlSec == 0 {
+		s.LoadsTtlSec = defaultLoadsTtlSec
+	}
+
+	return &Placement{policy: policy, ttl: time.Duration(s.LoadsTtlSec) * time.Second}, nil
+}
+
+// PickShard picks a healthy shard for a new user
+func (p *Placement) PickShard(ctx context.Context, mainDb *db.Conn, shardPools []*db.Pool) (uint32, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	//NOTE: concurrent registrations wait for one count
+	if p.loads == nil || time.Since(p.loadedAt) >= p.ttl {
+		loads, err := loadShardLoads(ctx, mainDb, len(shardPools))
+		if err != nil {
+			return 0, err
+		}
+		p.loads = loads
+		p.loadedAt = time.Now()
+	}
+
+	//NOTE: new users are not placed on shards which are down
+	return p.policy.PickShard(healthyLoads(slices.Clone(p.loads), shardPools))
+}
+
+// Placed counts the user placed on the shard till the next count
+func (p *Placement) Placed(shardId uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := range p.loads {
+		if p.loads[i].ShardId == shardId {
+			p.loads[i].Users++
+		}
+	}
+}
+
+func NewPlacementPolicy(s PlacementSettings, shardsAmount int) (PlacementPolicy, error) {
+	switch s.Policy {
+	case "", PolicyLeastLoaded:
+		return &LeastLoaded{}, nil
+	case PolicyWeighted:
+		for shardId, capacity := range s.Capacities {
+			if capacity < 0 {
+				return nil, errors.Errorf("negative capacity %d of shard %d", capacity, shardId)
+			}
+		}
+		return &Weighted{Capacities: s.Capacities}, nil
+	case PolicyPinned:
+		if s.PinnedShard == 0 || int(s.PinnedShard) > shardsAmount {
+			return nil, errors.Errorf("pinned shard id is out of range: %d", s.PinnedShard)
+		}
+		return &Pinned{ShardId: s.PinnedShard}, nil
+	}
+
+	return nil, errors.Errorf("unknown placement policy \"%s\"", s.Policy)
+}
+
+// LeastLoaded places users on the shard with the fewest users
+type LeastLoaded struct{}
+
+func (p *LeastLoaded) PickShard(loads []ShardLoad) (uint32, error) {
+	if len(loads) == 0 {
+		return 0, ErrNoShards
+	}
+
+	best := loads[0]
+	for _, load := range loads[1:] {
+		if load.Users < best.Users {
+			best = load
+		}
+	}
+	return best.ShardId, nil
+}
+
+// Weighted places users on the shard with the lowest users to capacity ratio,
+// shards with zero capacity don't get new users
+type Weighted struct {
+	Capacities map[uint32]int
+}
+
+func (p *Weighted) capacity(shardId uint32) int {
+	capacity, ok := p.Capacities[shardId]
+	if !ok {
+		return 1
+	}
+	return capacity
+}
+
+func (p *Weighted) PickShard(loads []ShardLoad) (uint32, error) {
+	var best *ShardLoad
+	for i := range loads {
+		load := &loads[i]
+		capacity := p.capacity(load.ShardId)
+		if capacity == 0 {
+			continue
+		}
+		//NOTE: comparing users/capacity ratios without division
+		if best == nil || load.Users*p.capacity(best.ShardId) < best.Users*capacity {
+			best = load
+		}
+	}
+
+	if best == nil {
+		return 0, ErrNoShards
+	}
+	return best.ShardId, nil
+}
+
+// Pinned places all users on one shard, no users are placed while it is down
+type Pinned struct {
+	ShardId uint32
+}
+
+func (p *Pinned) PickShard(loads []ShardLoad) (uint32, error) {
+	for _, load := range loads {
+		if load.ShardId == p.ShardId {
+			return p.ShardId, nil
+		}
+	}
+	return 0, errors.Wrapf(ErrNoShards, "pinned shard %d is unavailable", p.ShardId)
+}
+
+// loadShardLoads counts users of every shard, shards without users are included with zero load
+func loadShardLoads(ctx context.Context, mainDb *db.Conn, shardsAmount int) ([]ShardLoad, error) {
+	var counted []*ShardLoad
+	sb := mainDb.Select("shard_id", "COUNT(*) AS users")
+	_, err := sb.From("user_shard").GroupBy("shard_id").LoadStructs(ctx, &counted)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	loads := make([]ShardLoad, shardsAmount)
+	for i := range loads {
+		loads[i].ShardId = uint32(i + 1)
+	}
+	for _, load := range counted {
+		index := int(load.ShardId) - 1
+		if index >= 0 && index < shardsAmount {
+			loads[index].Users = load.Users
+		}
+	}
+
+	return loads, nil
+}
+
+// healthyLoads drops the loads of unhealthy shards
+func healthyLoads(loads []ShardLoad, shardPools []*db.Pool) []ShardLoad {
+	healthy := loads[:0]
+	for _, load := range loads {
+		if shardPools[load.ShardId-1].Healthy() {
+			healthy = append(healthy, load)
+		}
+	}
+	return healthy
+}
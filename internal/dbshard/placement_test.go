@@ -0,0 +1,96 @@
+package dbshard
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"pkg/db"
+	"testing"
+)
+
+func TestPolicies(t *testing.T) {
+	loads := []ShardLoad{{ShardId: 1, Users: 10}, {ShardId: 2, Users: 4}, {ShardId: 3, Users: 6}}
+
+	tests := []struct {
+		name   string
+		policy PlacementPolicy
+		loads  []ShardLoad
+		want   uint32
+		err    error
+	}{
+		{name: "least loaded", policy: &LeastLoaded{}, loads: loads, want: 2},
+		{name: "least loaded without shards", policy: &LeastLoaded{}, err: ErrNoShards},
+		{name: "weighted", policy: &Weighted{Capacities: map[uint32]int{1: 4, 2: 1}}, loads: loads, want: 1},
+		{name: "weighted default capacity", policy: &Weighted{}, loads: loads, want: 2},
+		{name: "weighted zero capacity", policy: &Weighted{Capacities: map[uint32]int{1: 0, 2: 0, 3: 0}},
+			loads: loads, err: ErrNoShards},
+		{name: "pinned", policy: &Pinned{ShardId: 3}, loads: loads, want: 3},
+		{name: "pinned shard is down", policy: &Pinned{ShardId: 3}, loads: loads[:2], err: ErrNoShards},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.PickShard(tt.loads)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if got != tt.want {
+				t.Errorf("shard = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPlacementPolicy(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       PlacementSettings
+		wantErr bool
+	}{
+		{name: "default", s: PlacementSettings{}},
+		{name: "weighted", s: PlacementSettings{Policy: PolicyWeighted, Capacities: map[uint32]int{1: 2}}},
+		{name: "negative capacity", s: PlacementSettings{Policy: PolicyWeighted, Capacities: map[uint32]int{1: -1}},
+			wantErr: true},
+		{name: "pinned", s: PlacementSettings{Policy: PolicyPinned, PinnedShard: 2}},
+		{name: "pinned out of range", s: PlacementSettings{Policy: PolicyPinned, PinnedShard: 3}, wantErr: true},
+		{name: "unknown", s: PlacementSettings{Policy: "random"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewPlacementPolicy(tt.s, 2)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlacementCachesLoads(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 2)
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	addUsers(t, mainDb, 1, 1, 2)
+
+	placement, err := NewPlacement(PlacementSettings{LoadsTtlSec: 3600}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shardId, err := placement.PickShard(ctx, mainDb, d.Shards()); err != nil || shardId != 2 {
+		t.Fatalf("shard = %d, %v, want 2", shardId, err)
+	}
+
+	//NOTE: users registered by other processes are not seen till the next count
+	addUsers(t, mainDb, 100, 2, 5)
+	if shardId, err := placement.PickShard(ctx, mainDb, d.Shards()); err != nil || shardId != 2 {
+		t.Fatalf("shard with the cached loads = %d, %v, want 2", shardId, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		placement.Placed(2)
+	}
+	if shardId, err := placement.PickShard(ctx, mainDb, d.Shards()); err != nil || shardId != 1 {
+		t.Fatalf("shard after the placed users = %d, %v, want 1", shardId, err)
+	}
+}
@@ -1,11 +1,13 @@
 package env
 
 import (
+	"context"
 	"github.com/go-logr/logr"
 	"internal/dbshard"
 	"internal/global"
 	"internal/settings"
 	"pkg/db"
+	"pkg/idgen"
 	"pkg/mb"
 	"pkg/rd"
 )
@@ -13,7 +15,8 @@ import (
 type Environment struct {
 	hub          global.Hub
 	mainDbConn   *db.Conn
-	user2ShardDb map[uint32]*db.Conn
+	user2ShardId map[uint32]uint32
+	shardDbs     map[uint32]*db.Conn
 	Settings     settings.Settings
 	Logger       logr.Logger
 }
@@ -29,14 +32,27 @@ func NewEnvironment(hub global.Hub) *Environment {
 
 func (env *Environment) Close() {
 	if env.mainDbConn != nil {
-		env.mainDbConn.Rollback()
+		env.rollbackLeft(env.mainDbConn)
 		env.mainDbConn = nil
 	}
 
-	for _, db := range env.user2ShardDb {
-		db.Rollback()
+	for _, db := range env.shardDbs {
+		env.rollbackLeft(db)
+	}
+	env.shardDbs = nil
+	env.user2ShardId = nil
+}
+
+// rollbackLeft rolls back a transaction left open by a failed request
+func (env *Environment) rollbackLeft(conn *db.Conn) {
+	if !conn.InTransaction() {
+		return
+	}
+
+	env.Logger.Info("Rolling back transaction left open")
+	if err := conn.Rollback(); err != nil {
+		env.Logger.Error(err, "Failed to roll back transaction left open")
 	}
-	env.user2ShardDb = nil
 }
 
 func (env *Environment) MainDb() *db.Conn {
@@ -47,34 +63,84 @@ func (env *Environment) MainDb() *db.Conn {
 	return env.mainDbConn
 }
 
-func (env *Environment) ShardDb(userId uint32) (*db.Conn, error) {
-	if env.user2ShardDb == nil {
-		env.user2ShardDb = make(map[uint32]*db.Conn)
+func (env *Environment) ShardDb(ctx context.Context, userId uint32) (*db.Conn, error) {
+	return env.shardDb(ctx, userId, false)
+}
+
+// ShardDbOrRegister is ShardDb placing the user on a shard on the first use
+func (env *Environment) ShardDbOrRegister(ctx context.Context, userId uint32) (*db.Conn, error) {
+	return env.shardDb(ctx, userId, true)
+}
+
+func (env *Environment) shardDb(ctx context.Context, userId uint32, register bool) (*db.Conn, error) {
+	if env.user2ShardId == nil {
+		env.user2ShardId = make(map[uint32]uint32)
 	}
-	if db, ok := env.user2ShardDb[userId]; ok {
-		return db, nil
+	if shardId, ok := env.user2ShardId[userId]; ok {
+		return env.shardDbs[shardId], nil
 	}
 
-	db, shardId, err := dbshard.GetShardDbByUserId(env.MainDb(), env.hub.Db.Shards(), env.hub.Rd.MainPool(), env.Logger, userId)
+	var shardDb *db.Conn
+	var shardId uint32
+	var err error
+	if register {
+		shardDb, shardId, err = dbshard.GetOrRegisterShardDbByUserId(ctx, env.MainDb(), env.hub.Db.Shards(),
+			env.hub.ShardCache, env.Logger, env.hub.Placement, userId)
+	} else {
+		shardDb, shardId, err = dbshard.GetShardDbByUserId(ctx, env.MainDb(), env.hub.Db.Shards(),
+			env.hub.ShardCache, env.Logger, userId)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if !env.isShardDbRegistered(db) {
-		env.setupShardDb(shardId, db)
+	env.user2ShardId[userId] = shardId
+
+	return env.registerShardDb(shardId, shardDb), nil
+}
+
+// ShardDbByAdvertId returns the shard of the owner's advert by the shard encoded in the advert id,
+// the owner's shard is looked up only if the advert is not there, e.g. the owner was moved to another shard
+func (env *Environment) ShardDbByAdvertId(ctx context.Context, advertId uint64, ownerId uint32) (*db.Conn, error) {
+	if shardId, ok := env.user2ShardId[ownerId]; ok {
+		return env.shardDbs[shardId], nil
 	}
-	env.user2ShardDb[userId] = db
 
-	return db, nil
+	shardDb, shardId, err := dbshard.GetShardDbByAdvertId(ctx, env.MainDb(), env.hub.Db.Shards(),
+		env.hub.ShardCache, env.Logger, advertId, ownerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.user2ShardId == nil {
+		env.user2ShardId = make(map[uint32]uint32)
+	}
+	env.user2ShardId[ownerId] = shardId
+
+	return env.registerShardDb(shardId, shardDb), nil
 }
 
-func (env *Environment) isShardDbRegistered(shardDb *db.Conn) bool {
-	for _, registeredShardDb := range env.user2ShardDb {
-		if shardDb == registeredShardDb {
-			return true
-		}
+// UserShardId returns the shard of the user, resolving it the same way as ShardDb
+func (env *Environment) UserShardId(ctx context.Context, userId uint32) (uint32, error) {
+	if _, err := env.ShardDb(ctx, userId); err != nil {
+		return 0, err
 	}
-	return false
+	return env.user2ShardId[userId], nil
+}
+
+// registerShardDb makes all users of the same shard share one connection
+func (env *Environment) registerShardDb(shardId uint32, shardDb *db.Conn) *db.Conn {
+	if env.shardDbs == nil {
+		env.shardDbs = make(map[uint32]*db.Conn)
+	}
+	if registered, ok := env.shardDbs[shardId]; ok {
+		return registered
+	}
+
+	env.setupShardDb(shardId, shardDb)
+	env.shardDbs[shardId] = shardDb
+
+	return shardDb
 }
 
 func (env *Environment) setupShardDb(shardId uint32, shardDb *db.Conn) {
@@ -90,6 +156,10 @@ func (env *Environment) AppName() string {
 	return env.hub.AppName
 }
 
-func (env *Environment) MbProducer() *mb.Producer {
+func (env *Environment) MbProducer() mb.Producer {
 	return env.hub.MbProducer
 }
+
+func (env *Environment) IdGen() *idgen.Generator {
+	return env.hub.IdGen
+}
@@ -2,10 +2,17 @@ package global
 
 import (
 	"github.com/go-logr/logr"
+	"internal/auth"
+	"internal/constant"
+	"internal/dbshard"
 	"internal/settings"
+	"os"
+	"path/filepath"
 	"pkg/db"
+	"pkg/idgen"
 	"pkg/mb"
 	"pkg/rd"
+	"strconv"
 )
 
 type Hub struct {
@@ -15,10 +22,24 @@ type Hub struct {
 	AppName    string
 	Db         *db.DB
 	Rd         *rd.RD
-	MbProducer *mb.Producer
+	MbProducer mb.Producer
+	Auth       *auth.Verifier
+	IdGen      *idgen.Generator
+	Placement  *dbshard.Placement
+	ShardCache *dbshard.ShardCache
 }
 
 func (g *Hub) Dispose() {
+	if g.ShardCache != nil {
+		g.ShardCache.Close()
+	}
+
+	if g.IdGen != nil {
+		if err := g.IdGen.Close(); err != nil {
+			g.Logger.Error(err, "Can't release id generator node id")
+		}
+	}
+
 	if g.Db != nil {
 		g.Db.Dispose()
 	}
@@ -29,14 +50,61 @@ func (g *Hub) Dispose() {
 }
 
 func New(exPath string, settings settings.Settings, logger logr.Logger, appName string,
-	mbProducer *mb.Producer) Hub {
+	mbProducer mb.Producer) Hub {
+	d := db.New(settings.DBs, logger)
+	r := rd.New(settings.RDs, logger)
 	return Hub{
 		ExPath:     exPath,
 		Settings:   settings,
 		Logger:     logger,
-		Db:         db.New(settings.DBs),
-		Rd:         rd.New(settings.RDs, logger),
+		Db:         d,
+		Rd:         r,
 		AppName:    appName,
 		MbProducer: mbProducer,
+		Auth:       newAuthVerifier(exPath, settings.Auth),
+		IdGen:      newIdGenerator(settings.IdGen, r.MainPool(), logger),
+		Placement:  newPlacement(settings.Placement, d),
+		ShardCache: dbshard.NewShardCache(settings.ShardCache, r.MainPool(), logger, int(d.ShardsAmount())),
+	}
+}
+
+func newAuthVerifier(exPath string, s auth.Settings) *auth.Verifier {
+	if !filepath.IsAbs(s.JwksPath) {
+		s.JwksPath = filepath.Join(exPath, s.JwksPath)
+	}
+
+	verifier, err := auth.NewVerifier(s)
+	if err != nil {
+		panic("failed to load auth keys: " + err.Error())
+	}
+
+	return verifier
+}
+
+// newIdGenerator leases the node id of the instance, so instances started with the same node id fail
+func newIdGenerator(s idgen.Settings, pool *rd.Pool, logger logr.Logger) *idgen.Generator {
+	if nodeId, ok := os.LookupEnv(constant.NodeIdEnv); ok {
+		var err error
+		s.NodeId, err = strconv.Atoi(nodeId)
+		if err != nil {
+			panic("bad " + constant.NodeIdEnv + ": " + err.Error())
+		}
+	}
+
+	gen, err := idgen.Lease(pool, constant.AppPrefix+":id_node:", s)
+	if err != nil {
+		panic("failed to lease id generator node id: " + err.Error())
 	}
+	logger.Info("Id generator node id leased", "node_id", gen.NodeId())
+
+	return gen
+}
+
+func newPlacement(s dbshard.PlacementSettings, d *db.DB) *dbshard.Placement {
+	placement, err := dbshard.NewPlacement(s, int(d.ShardsAmount()))
+	if err != nil {
+		panic("failed to create shard placement policy: " + err.Error())
+	}
+
+	return placement
 }
@@ -0,0 +1,329 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"internal/auth"
+	"internal/constant"
+	"net/http"
+	"pkg/rd"
+	"sync"
+	"time"
+)
+
+const (
+	rdIdempotencyPrefix = constant.AppPrefix + ":idempotency:"
+	keyHeader           = "Idempotency-Key"
+	replayedHeader      = "Idempotent-Replayed"
+	maxKeyLength        = 255
+	defaultTtlSec       = 86400
+	defaultLockTtlSec   = 60
+)
+
+// replayedHeaders are the response headers stored together with the body
+var replayedHeaders = []string{"Content-Type", "X-Quota-Limit", "X-Quota-Remaining"}
+
+// Fingerprint identifies the payload of the request, retries must have the same one
+type Fingerprint func(r *http.Request) (string, error)
+
+type record struct {
+	Fingerprint string            `json:"fingerprint"`
+	Done        bool              `json:"done"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+	// Owner tells apart the locks of concurrent requests with the same key, so only the holder stores the response
+	Owner string `json:"owner,omitempty"`
+}
+
+// Middleware replays the stored response for retries of a request with the same Idempotency-Key.
+// Keys are scoped by the authenticated owner, so it must be placed after the auth middleware.
+type Middleware struct {
+	settings    Settings
+	logger      logr.Logger
+	rdp         *rd.Pool
+	fingerprint Fingerprint
+	next        http.Handler
+}
+
+func NewMiddleware(s Settings, logger logr.Logger, rdp *rd.Pool, fingerprint Fingerprint, next http.Handler) *Middleware {
+	if s.TtlSec == 0 {
+		s.TtlSec = defaultTtlSec
+	}
+	if s.LockTtlSec == 0 {
+		s.LockTtlSec = defaultLockTtlSec
+	}
+
+	return &Middleware{
+		settings:    s,
+		logger:      logger.WithName("[idempotency]"),
+		rdp:         rdp,
+		fingerprint: fingerprint,
+		next:        next,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(keyHeader)
+	if len(key) == 0 {
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	if len(key) > maxKeyLength {
+		http.Error(w, fmt.Sprintf("Bad request, %s is too long.", keyHeader), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ClaimsFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	fingerprint, err := m.fingerprint(r)
+	if err != nil {
+		http.Error(w, "Bad request. Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rdKey := fmt.Sprintf("%s%s:%x", rdIdempotencyPrefix, claims.Subject, sha256.Sum256([]byte(key)))
+
+	lock, err := m.lock(rdKey, fingerprint)
+	if err != nil {
+		m.logger.Error(err, "Can't lock idempotency key")
+		http.Error(w, "Service unavailable, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if lock == nil {
+		m.replay(w, rdKey, fingerprint)
+		return
+	}
+
+	//NOTE: the lock is extended while the request runs, so a slow request is not run twice by a retry
+	stop := m.keepLocked(rdKey, lock)
+	defer func() {
+		stop()
+		//NOTE: the lock of a panicked request is released, otherwise its retries are rejected while it is extended
+		if p := recover(); p != nil {
+			m.release(rdKey, lock)
+			panic(p)
+		}
+	}()
+
+	rec := &recorder{origin: w, status: http.StatusOK}
+	m.next.ServeHTTP(rec, r)
+	stop()
+
+	m.store(rdKey, lock, fingerprint, rec)
+}
+
+// lock returns the value of the taken lock, nil if the key is locked or done by another request
+func (m *Middleware) lock(rdKey string, fingerprint string) ([]byte, error) {
+	owner := make([]byte, 16)
+	rand.Read(owner)
+
+	data, err := json.Marshal(&record{Fingerprint: fingerprint, Owner: hex.EncodeToString(owner)})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = redis.String(m.rdp.Do("SET", rdKey, data, "NX", "EX", m.settings.LockTtlSec))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// extendScript extends the lock only if it is still held by the request
+var extendScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// storeScript replaces the lock by the response only if it is still held by the request
+var storeScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[2], 'EX', ARGV[3])
+	return 1
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// keepLocked extends the lock every third of its ttl until stop is called, stop may be called more than once
+func (m *Middleware) keepLocked(rdKey string, lock []byte) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(time.Duration(m.settings.LockTtlSec) * time.Second / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			conn := m.rdp.Get()
+			extended, err := redis.Bool(extendScript.Do(conn, rdKey, lock, m.settings.LockTtlSec))
+			conn.Close()
+
+			if err != nil {
+				//NOTE: retried on the next tick, the lock lives a ttl since the last extend
+				m.logger.Error(err, "Can't extend idempotency key lock")
+				continue
+			}
+			if !extended {
+				m.logger.Info("Idempotency key lock is lost, the request may be run again")
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+		<-stopped
+	}
+}
+
+// release deletes the lock unless it expired and was taken by a retry
+func (m *Middleware) release(rdKey string, lock []byte) {
+	conn := m.rdp.Get()
+	defer conn.Close()
+
+	if _, err := releaseScript.Do(conn, rdKey, lock); err != nil {
+		m.logger.Error(err, "Can't release idempotency key")
+	}
+}
+
+func (m *Middleware) replay(w http.ResponseWriter, rdKey string, fingerprint string) {
+	data, err := redis.Bytes(m.rdp.Do("GET", rdKey))
+	if err == redis.ErrNil {
+		//NOTE: the first request has just failed or its lock expired, the client may retry
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Conflict, the request is being processed.", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		m.logger.Error(err, "Can't read idempotency key")
+		http.Error(w, "Service unavailable, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+
+	rec := &record{}
+	if err := json.Unmarshal(data, rec); err != nil {
+		m.logger.Error(err, "Can't parse idempotency record")
+		http.Error(w, "Service unavailable, try again later.", http.StatusServiceUnavailable)
+		return
+	}
+
+	if rec.Fingerprint != fingerprint {
+		http.Error(w, fmt.Sprintf("Unprocessable entity, %s is reused with a different payload.", keyHeader),
+			http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !rec.Done {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "Conflict, the request is being processed.", http.StatusConflict)
+		return
+	}
+
+	for name, value := range rec.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set(replayedHeader, "true")
+	w.WriteHeader(rec.Status)
+	w.Write(rec.Body)
+}
+
+// store replaces the lock by the response, unless the lock expired and was taken by a retry
+func (m *Middleware) store(rdKey string, lock []byte, fingerprint string, rec *recorder) {
+	//NOTE: server errors and throttled requests are not stored, so the client is able to retry them
+	if rec.status >= http.StatusInternalServerError || rec.status == http.StatusTooManyRequests {
+		m.release(rdKey, lock)
+		return
+	}
+
+	stored := &record{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      rec.status,
+		Header:      make(map[string]string),
+		Body:        rec.body.Bytes(),
+	}
+	for _, name := range replayedHeaders {
+		if value := rec.Header().Get(name); len(value) > 0 {
+			stored.Header[name] = value
+		}
+	}
+
+	data, err := json.Marshal(stored)
+	if err != nil {
+		m.logger.Error(err, "Can't save idempotency record")
+		return
+	}
+
+	conn := m.rdp.Get()
+	defer conn.Close()
+
+	saved, err := redis.Bool(storeScript.Do(conn, rdKey, lock, data, m.settings.TtlSec))
+	if err != nil {
+		m.logger.Error(err, "Can't save idempotency record")
+		return
+	}
+	if !saved {
+		m.logger.Info("Idempotency key lock is lost, the response is not saved")
+	}
+}
+
+// recorder passes the response through keeping a copy of it
+type recorder struct {
+	origin      http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header {
+	return r.origin.Header()
+}
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.origin.WriteHeader(status)
+}
+
+func (r *recorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.origin.Write(data)
+}
@@ -0,0 +1,158 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"pkg/rd"
+	"testing"
+	"time"
+)
+
+const testKey = "retry-1"
+
+func newTestMiddleware(t *testing.T, s Settings, next http.HandlerFunc) (*Middleware, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdp := rd.OpenPool(rd.Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, logr.Discard())
+	t.Cleanup(func() { rdp.Close() })
+
+	fingerprint := func(r *http.Request) (string, error) {
+		return r.URL.Query().Get("payload"), nil
+	}
+
+	return NewMiddleware(s, logr.Discard(), rdp, fingerprint, next), mr
+}
+
+func serve(m *Middleware, payload string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/gateway_create_advert?payload="+payload, nil)
+	r.Header.Set(keyHeader, testKey)
+	r = r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Subject: "7"}))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	return w
+}
+
+func testRdKey() string {
+	return fmt.Sprintf("%s7:%x", rdIdempotencyPrefix, sha256.Sum256([]byte(testKey)))
+}
+
+func TestReplay(t *testing.T) {
+	calls := 0
+	m, _ := newTestMiddleware(t, Settings{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("X-Quota-Remaining", "4")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"advert_id":1}`))
+	})
+
+	first := serve(m, "a")
+	second := serve(m, "a")
+
+	if calls != 1 {
+		t.Errorf("handler calls = %d, want 1", calls)
+	}
+	if second.Code != http.StatusCreated || second.Body.String() != first.Body.String() {
+		t.Errorf("replayed %d %q, want %d %q", second.Code, second.Body, first.Code, first.Body)
+	}
+	if second.Header().Get(replayedHeader) != "true" || second.Header().Get("X-Quota-Remaining") != "4" {
+		t.Errorf("replayed headers = %v", second.Header())
+	}
+
+	if other := serve(m, "b"); other.Code != http.StatusUnprocessableEntity {
+		t.Errorf("other payload status = %d, want %d", other.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestServerErrorIsNotStored(t *testing.T) {
+	calls := 0
+	m, mr := newTestMiddleware(t, Settings{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	serve(m, "a")
+	if mr.Exists(testRdKey()) {
+		t.Error("failed request keeps the key")
+	}
+
+	serve(m, "a")
+	if calls != 2 {
+		t.Errorf("handler calls = %d, want 2", calls)
+	}
+}
+
+func TestLockExtendedWhileRunning(t *testing.T) {
+	var mr *miniredis.Miniredis
+	locked := true
+
+	m, mr := newTestMiddleware(t, Settings{LockTtlSec: 1}, func(w http.ResponseWriter, r *http.Request) {
+		//NOTE: the request runs 3 lock ttls, the lock is extended every third of it
+		for i := 0; i < 9; i++ {
+			mr.FastForward(time.Second / 3)
+			time.Sleep(time.Second / 3)
+			locked = locked && mr.Exists(testRdKey())
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	serve(m, "a")
+
+	if !locked {
+		t.Error("lock expired while the request was running")
+	}
+	if replayed := serve(m, "a"); replayed.Code != http.StatusCreated {
+		t.Errorf("retry after the request status = %d, want %d", replayed.Code, http.StatusCreated)
+	}
+}
+
+func TestLostLockIsNotOverwritten(t *testing.T) {
+	var mr *miniredis.Miniredis
+	const taken = `{"fingerprint":"a","owner":"another"}`
+
+	m, mr := newTestMiddleware(t, Settings{}, func(w http.ResponseWriter, r *http.Request) {
+		//NOTE: the lock expires and a retry takes the key
+		mr.Set(testRdKey(), taken)
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	serve(m, "a")
+
+	if got, _ := mr.Get(testRdKey()); got != taken {
+		t.Errorf("key = %q, want the lock of the retry %q", got, taken)
+	}
+}
+
+func TestPanickedRequestReleasesLock(t *testing.T) {
+	calls := 0
+	m, mr := newTestMiddleware(t, Settings{}, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	func() {
+		defer func() {
+			if p := recover(); p != "handler failed" {
+				t.Errorf("recovered %v, want the handler panic", p)
+			}
+		}()
+		serve(m, "a")
+	}()
+
+	if mr.Exists(testRdKey()) {
+		t.Error("panicked request keeps the key locked")
+	}
+	if retried := serve(m, "a"); retried.Code != http.StatusCreated || calls != 2 {
+		t.Errorf("retry after the panic status = %d, handler calls = %d, want %d, 2", retried.Code, calls,
+			http.StatusCreated)
+	}
+}
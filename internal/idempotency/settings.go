@@ -0,0 +1,7 @@
+package idempotency
+
+type Settings struct {
+	TtlSec int `json:"ttl_sec"`
+	// LockTtlSec is how long a request is locked if its process dies, the lock is extended while it runs
+	LockTtlSec int `json:"lock_ttl_sec"`
+}
@@ -0,0 +1,102 @@
+package quota
+
+import (
+	"context"
+	"database/sql"
+	"github.com/pkg/errors"
+	"pkg/db"
+)
+
+var ErrQuotaExceeded = errors.New("active adverts quota exceeded")
+
+// Status is the usage of the Active adverts quota of one owner in one category.
+// Limit 0 means unlimited, Remaining is -1 then.
+type Status struct {
+	Limit     int `json:"limit"`
+	Used      int `json:"used"`
+	Remaining int `json:"remaining"`
+}
+
+func newStatus(limit int, used int) *Status {
+	remaining := -1
+	if limit > 0 {
+		remaining = max(limit-used, 0)
+	}
+	return &Status{Limit: limit, Used: used, Remaining: remaining}
+}
+
+func (s *Status) Unlimited() bool {
+	return s.Limit == 0
+}
+
+// Check returns the current usage without reserving anything
+func Check(ctx context.Context, conn *db.Conn, limit int, ownerId uint32, category byte) (*Status, error) {
+	var used int
+	sb := conn.Select("active")
+	err := sb.From("owner_quota").
+		Where(
+			sb.Equal("owner_id", ownerId),
+			sb.Equal("category", category)).
+		LoadValue(ctx, &used)
+
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.WithStack(err)
+	}
+
+	return newStatus(limit, used), nil
+}
+
+// Reserve takes one Active advert slot of the category.
+// It must be called inside the transaction which activates the advert, so the counter
+// stays consistent with the advert state; the usage row is locked until the transaction ends.
+func Reserve(ctx context.Context, conn *db.Conn, limit int, ownerId uint32, category byte) (*Status, error) {
+	_, err := conn.InsertIgnoreInto("owner_quota").
+		Cols("owner_id", "category").
+		Values(ownerId, category).
+		Exec(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var used int
+	sb := conn.Select("active")
+	err = sb.From("owner_quota").
+		Where(
+			sb.Equal("owner_id", ownerId),
+			sb.Equal("category", category)).
+		ForUpdate().
+		LoadValue(ctx, &used)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if limit > 0 && used >= limit {
+		return nil, errors.Wrapf(ErrQuotaExceeded, "owner %d, category %d, limit %d", ownerId, category, limit)
+	}
+
+	ub := conn.Update("owner_quota")
+	_, err = ub.Set("active = active + 1").
+		Where(
+			ub.Equal("owner_id", ownerId),
+			ub.Equal("category", category)).
+		Exec(ctx)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return newStatus(limit, used+1), nil
+}
+
+// Release frees one Active advert slot of the category. It must be called inside the transaction
+// which moves the advert out of the Active state, like Reserve.
+func Release(ctx context.Context, conn *db.Conn, ownerId uint32, category byte) error {
+	ub := conn.Update("owner_quota")
+	_, err := ub.Set("active = active - 1").
+		Where(
+			ub.Equal("owner_id", ownerId),
+			ub.Equal("category", category),
+			"active > 0").
+		Exec(ctx)
+
+	return errors.WithStack(err)
+}
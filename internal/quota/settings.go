@@ -0,0 +1,26 @@
+package quota
+
+// Tier limits the amount of Active adverts an owner may have in every category, zero means unlimited
+type Tier struct {
+	MaxActivePerCategory int          `json:"max_active_per_category"`
+	Categories           map[byte]int `json:"categories"`
+}
+
+type Settings struct {
+	DefaultTier string          `json:"default_tier"`
+	Tiers       map[string]Tier `json:"tiers"`
+}
+
+// Limit returns the Active adverts limit of the category for the tier,
+// unknown tiers fall back to the default one
+func (s Settings) Limit(tier string, category byte) int {
+	t, ok := s.Tiers[tier]
+	if !ok {
+		t = s.Tiers[s.DefaultTier]
+	}
+
+	if limit, ok := t.Categories[category]; ok {
+		return limit
+	}
+	return t.MaxActivePerCategory
+}
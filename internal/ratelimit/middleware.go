@@ -0,0 +1,154 @@
+package ratelimit
+
+import (
+	"fmt"
+	"github.com/go-logr/logr"
+	"internal/auth"
+	"internal/constant"
+	"math"
+	"net"
+	"net/http"
+	"pkg/rd"
+	"strconv"
+	"time"
+)
+
+const (
+	rdRateLimitPrefix = constant.AppPrefix + ":rate:"
+	retryAfterHeader  = "Retry-After"
+	day               = 24 * time.Hour
+)
+
+// Costs returns the amount of adverts and photos the request is going to create
+type Costs func(r *http.Request) (adverts int, photos int, err error)
+
+// Middleware throttles requests per gateway client and per owner, the requests which fail are refunded.
+// Must be placed after the auth middleware as both are taken from the token claims.
+type Middleware struct {
+	settings Settings
+	logger   logr.Logger
+	limiter  *rd.RateLimiter
+	costs    Costs
+	next     http.Handler
+}
+
+func NewMiddleware(s Settings, logger logr.Logger, rdp *rd.Pool, costs Costs, next http.Handler) *Middleware {
+	return &Middleware{
+		settings: s,
+		logger:   logger.WithName("[rateLimit]"),
+		limiter:  rd.NewRateLimiter(rdp, rdRateLimitPrefix),
+		costs:    costs,
+		next:     next,
+	}
+}
+
+func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	claims, err := auth.ClaimsFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ownerId, err := claims.OwnerId()
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	adverts, photos, err := m.costs(r)
+	if err != nil {
+		http.Error(w, "Bad request. Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limits := make([]rd.Limit, 0, 4)
+	limits = appendQuotaLimits(limits, "client:"+clientId(r, claims), m.settings.Client, adverts, photos)
+	limits = appendQuotaLimits(limits, fmt.Sprintf("owner:%d", ownerId), m.settings.Owner, adverts, photos)
+
+	result, err := m.limiter.Allow(limits...)
+	if err != nil {
+		//NOTE: failing open, the rate limiter must not take the service down together with redis
+		m.logger.Error(err, "Can't check rate limits")
+		m.next.ServeHTTP(w, r)
+		return
+	}
+
+	if !result.Allowed {
+		m.logger.V(1).Info("Rate limit exceeded", "key", result.Key, "retry_after", result.RetryAfter)
+		retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+		w.Header().Set(retryAfterHeader, strconv.Itoa(max(retryAfter, 1)))
+		http.Error(w, fmt.Sprintf("Too many requests, quota \"%s\" is exhausted.", result.Key),
+			http.StatusTooManyRequests)
+		return
+	}
+
+	sw := &statusWriter{ResponseWriter: w}
+	m.next.ServeHTTP(sw, r)
+
+	//NOTE: failed requests don't consume the quotas, the throttled ones do to slow down the clients
+	if sw.status >= http.StatusBadRequest && sw.status != http.StatusTooManyRequests {
+		if err := m.limiter.Refund(result); err != nil {
+			m.logger.Error(err, "Can't refund rate limits")
+		}
+	}
+}
+
+// statusWriter keeps the status of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func appendQuotaLimits(limits []rd.Limit, scope string, quota Quota, adverts int, photos int) []rd.Limit {
+	if quota.AdvertsPerDay > 0 && adverts > 0 {
+		limits = append(limits, rd.Limit{
+			Key:    scope + ":adverts",
+			Max:    quota.AdvertsPerDay,
+			Window: day,
+			Cost:   adverts,
+		})
+	}
+
+	if quota.PhotosPerHour > 0 && photos > 0 {
+		limits = append(limits, rd.Limit{
+			Key:    scope + ":photos",
+			Max:    quota.PhotosPerHour,
+			Window: time.Hour,
+			Cost:   photos,
+		})
+	}
+
+	return limits
+}
+
+// clientId identifies the gateway client by the authorized party of the token,
+// falling back to the remote address for tokens issued without one
+func clientId(r *http.Request, claims *auth.Claims) string {
+	if len(claims.ClientId) > 0 {
+		return claims.ClientId
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"internal/auth"
+	"net/http"
+	"net/http/httptest"
+	"pkg/rd"
+	"testing"
+)
+
+func newTestMiddleware(t *testing.T, status *int) (*Middleware, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdp := rd.OpenPool(rd.Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, logr.Discard())
+	t.Cleanup(rdp.Close)
+
+	costs := func(r *http.Request) (int, int, error) {
+		return 1, 2, nil
+	}
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(*status)
+	})
+
+	s := Settings{Owner: Quota{AdvertsPerDay: 2, PhotosPerHour: 10}}
+	return NewMiddleware(s, logr.Discard(), rdp, costs, next), mr
+}
+
+func serve(m *Middleware) int {
+	r := httptest.NewRequest(http.MethodPost, "/gateway_create_advert", nil)
+	r = r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Subject: "7"}))
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestFailedRequestsAreRefunded(t *testing.T) {
+	status := http.StatusCreated
+	m, mr := newTestMiddleware(t, &status)
+
+	for _, status = range []int{http.StatusBadRequest, http.StatusForbidden, http.StatusServiceUnavailable} {
+		if code := serve(m); code != status {
+			t.Fatalf("status = %d, want %d", code, status)
+		}
+	}
+	if mr.Exists(rdRateLimitPrefix+"owner:7:adverts") || mr.Exists(rdRateLimitPrefix+"owner:7:photos") {
+		t.Error("failed requests consumed the owner quotas")
+	}
+
+	status = http.StatusCreated
+	for i := 0; i < 2; i++ {
+		if code := serve(m); code != http.StatusCreated {
+			t.Fatalf("status = %d, want %d", code, http.StatusCreated)
+		}
+	}
+	if code := serve(m); code != http.StatusTooManyRequests {
+		t.Errorf("status over the quota = %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
+
+func TestThrottledRequestsAreNotRefunded(t *testing.T) {
+	status := http.StatusTooManyRequests
+	m, mr := newTestMiddleware(t, &status)
+
+	serve(m)
+	if members, _ := mr.ZMembers(rdRateLimitPrefix + "owner:7:adverts"); len(members) != 1 {
+		t.Errorf("owner advert units = %d, want 1", len(members))
+	}
+}
@@ -0,0 +1,12 @@
+package ratelimit
+
+// Quota holds the limits of one scope, zero means unlimited
+type Quota struct {
+	AdvertsPerDay int `json:"adverts_per_day"`
+	PhotosPerHour int `json:"photos_per_hour"`
+}
+
+type Settings struct {
+	Client Quota `json:"client"`
+	Owner  Quota `json:"owner"`
+}
@@ -1,6 +1,7 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/segmentio/kafka-go"
@@ -24,7 +25,8 @@ func (h *MbHandler) Handle(logger logr.Logger, m *kafka.Message) error {
 
 	switch m.Topic {
 	case "advert_process_photo_response":
-		return advert.ResponsePhotoProcess(env, m)
+		//NOTE: the handler isn't cancellable, its queries are bounded by the default db timeouts
+		return advert.ResponsePhotoProcess(context.Background(), env, m)
 	}
 	return nil
 }
@@ -2,20 +2,33 @@ package settings
 
 import (
 	"encoding/json"
+	"internal/auth"
+	"internal/dbshard"
+	"internal/idempotency"
+	"internal/quota"
+	"internal/ratelimit"
 	"internal/static_storage"
 	"os"
 	"pkg/db"
+	"pkg/idgen"
 	"pkg/mb"
 	"pkg/rd"
 )
 
 type Settings struct {
-	UrlListen     string                  `json:"url_listen"`
-	LogLevel      int                     `json:"log_level"`
-	DBs           db.Settings             `json:"dbs"`
-	RDs           rd.Settings             `json:"rds"`
-	MessageBroker mb.Settings             `json:"mb"`
-	StaticStorage static_storage.Settings `json:"static_storage"`
+	UrlListen     string                    `json:"url_listen"`
+	LogLevel      int                       `json:"log_level"`
+	DBs           db.Settings               `json:"dbs"`
+	RDs           rd.Settings               `json:"rds"`
+	MessageBroker mb.Settings               `json:"mb"`
+	StaticStorage static_storage.Settings   `json:"static_storage"`
+	Auth          auth.Settings             `json:"auth"`
+	RateLimit     ratelimit.Settings        `json:"rate_limit"`
+	Quota         quota.Settings            `json:"quota"`
+	Idempotency   idempotency.Settings      `json:"idempotency"`
+	IdGen         idgen.Settings            `json:"id_gen"`
+	Placement     dbshard.PlacementSettings `json:"placement"`
+	ShardCache    dbshard.CacheSettings     `json:"shard_cache"`
 }
 
 func (s *Settings) Read(filePath string) error {
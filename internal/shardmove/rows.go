@@ -0,0 +1,173 @@
+package shardmove
+
+import (
+	"context"
+	"internal/dbshard"
+	"pkg/db"
+)
+
+type advertRow struct {
+	Id          uint64 `db:"id"`
+	OwnerId     uint32 `db:"owner_id"`
+	Title       string `db:"title"`
+	Description string `db:"description"`
+	CTime       uint32 `db:"ctime"`
+	STime       uint32 `db:"stime"`
+	FTime       uint32 `db:"ftime"`
+	State       byte   `db:"state"`
+}
+
+type detailsRow struct {
+	AdvertId     uint64 `db:"advert_id"`
+	State        byte   `db:"state"`
+	Price        uint32 `db:"price"`
+	Category     byte   `db:"category"`
+	SubCategory1 byte   `db:"sub_category_1"`
+	SubCategory2 byte   `db:"sub_category_2"`
+	SubCategory3 byte   `db:"sub_category_3"`
+	// NOTE: geometry is copied as is in the MySQL internal format
+	Geolocation []byte `db:"geolocation"`
+	Country     uint16 `db:"country"`
+	Area        uint16 `db:"area"`
+	City        uint32 `db:"city"`
+	District    byte   `db:"district"`
+}
+
+type photoRow struct {
+	Id        uint32 `db:"id"`
+	AdvertId  uint64 `db:"advert_id"`
+	Url       string `db:"url"`
+	UrlSmall  string `db:"url_small"`
+	UrlMedium string `db:"url_medium"`
+	UrlBig    string `db:"url_big"`
+	Position  byte   `db:"position"`
+}
+
+type quotaRow struct {
+	OwnerId  uint32 `db:"owner_id"`
+	Category byte   `db:"category"`
+	Active   int    `db:"active"`
+}
+
+// userRows are all rows of one user on a shard
+type userRows struct {
+	Adverts []*advertRow
+	Details []*detailsRow
+	Photos  []*photoRow
+	Quotas  []*quotaRow
+}
+
+func loadUserRows(ctx context.Context, conn *db.Conn, userId uint32) (*userRows, error) {
+	rows := &userRows{}
+
+	sb := conn.Select("id", "owner_id", "title", "description", "ctime", "stime", "ftime", "state")
+	_, err := sb.From("advert").
+		Where(sb.Equal("owner_id", userId)).
+		OrderBy("id").
+		LoadStructs(ctx, &rows.Adverts)
+	if err != nil {
+		return nil, err
+	}
+
+	sb = conn.Select("d.*")
+	_, err = sb.From("product_details d").
+		Join("advert a", "a.id = d.advert_id").
+		Where(sb.Equal("a.owner_id", userId)).
+		OrderBy("d.advert_id").
+		LoadStructs(ctx, &rows.Details)
+	if err != nil {
+		return nil, err
+	}
+
+	sb = conn.Select("p.*")
+	_, err = sb.From("product_photo p").
+		Join("advert a", "a.id = p.advert_id").
+		Where(sb.Equal("a.owner_id", userId)).
+		OrderBy("p.advert_id", "p.id").
+		LoadStructs(ctx, &rows.Photos)
+	if err != nil {
+		return nil, err
+	}
+
+	sb = conn.Select("owner_id", "category", "active")
+	_, err = sb.From("owner_quota").
+		Where(sb.Equal("owner_id", userId)).
+		OrderBy("category").
+		LoadStructs(ctx, &rows.Quotas)
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// writeUserRows replaces all rows of the user with the passed ones, so it may be repeated for the same user
+func writeUserRows(ctx context.Context, conn *db.Conn, userId uint32, rows *userRows, fence int64) error {
+	return conn.Transaction(ctx, func(conn *db.Conn) error {
+		//NOTE: dropping rows left by a previous copy which are already deleted on source
+		if err := deleteUserRows(ctx, conn, userId, fence); err != nil {
+			return err
+		}
+
+		if len(rows.Adverts) > 0 {
+			if _, err := conn.InsertInto("advert").Structs(rows.Adverts).Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		if len(rows.Details) > 0 {
+			if _, err := conn.InsertInto("product_details").Structs(rows.Details).Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		if len(rows.Photos) > 0 {
+			if _, err := conn.InsertInto("product_photo").Structs(rows.Photos).Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		if len(rows.Quotas) > 0 {
+			if _, err := conn.InsertInto("owner_quota").Structs(rows.Quotas).Exec(ctx); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func deleteUserRows(ctx context.Context, conn *db.Conn, userId uint32, fence int64) error {
+	return conn.Transaction(ctx, func(conn *db.Conn) error {
+		//NOTE: the rows are kept if the user was moved back to the shard by a newer move
+		if err := dbshard.CheckMoveFence(ctx, conn, userId, fence); err != nil {
+			return err
+		}
+
+		_, err := conn.DeleteBySQL(
+			"DELETE p FROM product_photo p JOIN advert a ON a.id = p.advert_id WHERE a.owner_id = ?", userId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		_, err = conn.DeleteBySQL(
+			"DELETE d FROM product_details d JOIN advert a ON a.id = d.advert_id WHERE a.owner_id = ?", userId).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+
+		db := conn.DeleteFrom("advert")
+		if _, err := db.Where(db.Equal("owner_id", userId)).Exec(ctx); err != nil {
+			return err
+		}
+
+		db = conn.DeleteFrom("owner_quota")
+		if _, err := db.Where(db.Equal("owner_id", userId)).Exec(ctx); err != nil {
+			return err
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,334 @@
+package shardmove
+
+import (
+	"context"
+	"database/sql"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"internal/dbshard"
+	"internal/global"
+	"pkg/db"
+	"pkg/rd"
+	"reflect"
+	"time"
+)
+
+// Step is the checkpoint of a move, a restarted move continues from its last step
+type Step byte
+
+const (
+	// StepCopy copies the user rows to the target shard while the user keeps writing to the source one
+	StepCopy Step = iota + 1
+	// StepCutover blocks the user writes, copies the rest, verifies the copy and switches the user to the target shard
+	StepCutover
+	// StepCleanup deletes the user rows from the source shard, its writes stay blocked for the writers
+	// which resolve the user shard from a stale cache
+	StepCleanup
+	StepDone
+)
+
+var ErrVerificationFailed = errors.New("rows on target shard differ from source shard")
+
+type Options struct {
+	UserId      uint32
+	TargetShard uint32
+	// LockTtl is how long the user writes are rejected before they start and other moves of the user are refused
+	// if the move dies during the cutover, the lock is extended while the cutover runs.
+	// The writes on the source shard stay blocked till the move is resumed then.
+	LockTtl    time.Duration
+	KeepSource bool
+}
+
+type checkpoint struct {
+	UserId      uint32 `db:"user_id"`
+	SourceShard uint32 `db:"source_shard"`
+	TargetShard uint32 `db:"target_shard"`
+	Step        Step   `db:"step"`
+	MTime       uint32 `db:"mtime"`
+	// Fence is the fencing token of the move lock of the last cutover, moves with a lower one can't save the move
+	Fence int64 `db:"fence"`
+}
+
+type mover struct {
+	ctx    context.Context
+	hub    global.Hub
+	logger logr.Logger
+	opts   Options
+	mainDb *db.Conn
+	source *db.Conn
+	target *db.Conn
+}
+
+// Move moves all rows of the user to the target shard. Unfinished moves of the user are resumed.
+func Move(ctx context.Context, hub global.Hub, logger logr.Logger, opts Options) error {
+	m := &mover{
+		ctx:    ctx,
+		hub:    hub,
+		logger: logger.WithValues("user", opts.UserId, "target_shard", opts.TargetShard),
+		opts:   opts,
+		mainDb: db.NewDbConn(hub.Db.MainPool(), logger),
+	}
+	defer m.mainDb.Rollback()
+	//NOTE: the copy is verified against the primaries, replicas may lag behind
+	m.mainDb.PinPrimary()
+
+	cp, err := m.start()
+	if err != nil || cp == nil {
+		return err
+	}
+
+	m.logger = m.logger.WithValues("source_shard", cp.SourceShard)
+
+	m.source, err = dbshard.GetShardDbConn(m.logger, hub.Db.Shards(), cp.SourceShard)
+	if err != nil {
+		return err
+	}
+	m.target, err = dbshard.GetShardDbConn(m.logger, hub.Db.Shards(), cp.TargetShard)
+	if err != nil {
+		return err
+	}
+	m.source.PinPrimary()
+	m.target.PinPrimary()
+
+	for cp.Step != StepDone {
+		m.logger.Info("Moving user", "step", cp.Step)
+
+		switch cp.Step {
+		case StepCopy:
+			err = m.copy(cp)
+			if err == nil {
+				err = m.advance(cp, StepCutover)
+			}
+		case StepCutover:
+			err = m.cutover(cp)
+		case StepCleanup:
+			err = m.cleanup(cp)
+			if err == nil {
+				err = m.advance(cp, StepDone)
+			}
+		default:
+			err = errors.Errorf("unknown move step %d", cp.Step)
+		}
+
+		if err != nil {
+			return errors.Wrapf(err, "move of user %d failed on step %d", opts.UserId, cp.Step)
+		}
+	}
+
+	m.logger.Info("User moved")
+
+	return nil
+}
+
+// start returns the checkpoint to continue from or nil if the user is already on the target shard
+func (m *mover) start() (*checkpoint, error) {
+	cp, err := loadCheckpoint(m.ctx, m.mainDb, m.opts.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	if cp != nil && cp.Step != StepDone {
+		if cp.TargetShard != m.opts.TargetShard {
+			return nil, errors.Errorf("user %d has an unfinished move to shard %d", m.opts.UserId, cp.TargetShard)
+		}
+		m.logger.Info("Resuming move", "step", cp.Step)
+		return cp, nil
+	}
+
+	currentShard, err := dbshard.FindUserShardById(m.ctx, m.mainDb, m.opts.UserId)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint32(currentShard) == m.opts.TargetShard {
+		m.logger.Info("User is already on target shard")
+		return nil, nil
+	}
+
+	cp = &checkpoint{
+		UserId:      m.opts.UserId,
+		SourceShard: uint32(currentShard),
+		TargetShard: m.opts.TargetShard,
+		Step:        StepCopy,
+		Fence:       previousFence(cp),
+	}
+
+	return cp, saveCheckpoint(m.ctx, m.mainDb, cp)
+}
+
+func (m *mover) advance(cp *checkpoint, step Step) error {
+	cp.Step = step
+	return saveCheckpoint(m.ctx, m.mainDb, cp)
+}
+
+func (m *mover) copy(cp *checkpoint) error {
+	rows, err := loadUserRows(m.ctx, m.source, m.opts.UserId)
+	if err != nil {
+		return err
+	}
+
+	m.logger.V(1).Info("Copying rows", "adverts", len(rows.Adverts), "photos", len(rows.Photos))
+
+	return writeUserRows(m.ctx, m.target, m.opts.UserId, rows, cp.Fence)
+}
+
+func (m *mover) verify() error {
+	sourceRows, err := loadUserRows(m.ctx, m.source, m.opts.UserId)
+	if err != nil {
+		return err
+	}
+
+	targetRows, err := loadUserRows(m.ctx, m.target, m.opts.UserId)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(sourceRows, targetRows) {
+		return errors.Wrapf(ErrVerificationFailed, "source adverts %d, photos %d; target adverts %d, photos %d",
+			len(sourceRows.Adverts), len(sourceRows.Photos), len(targetRows.Adverts), len(targetRows.Photos))
+	}
+
+	return nil
+}
+
+func (m *mover) cutover(cp *checkpoint) error {
+	rdp := m.hub.Rd.MainPool()
+
+	lock, err := rd.TryLock(m.ctx, rdp, dbshard.UserMoveLockName(m.opts.UserId), rd.LockOptions{Ttl: m.opts.LockTtl})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := lock.Release(); err != nil {
+			m.logger.Error(err, "Can't unlock user writes")
+		}
+	}()
+
+	m.logger.V(1).Info("User writes locked", "fencing_token", lock.Token())
+
+	//NOTE: a move which lost the lock to this one can't save the move or change the guards of the shards anymore
+	cp.Fence = lock.Token()
+	if err := saveCheckpoint(m.ctx, m.mainDb, cp); err != nil {
+		return err
+	}
+
+	//NOTE: the cutover stops if the lock is lost, as another move of the user may run then
+	ctx := m.ctx
+	m.ctx = lock.Context()
+	defer func() { m.ctx = ctx }()
+
+	//NOTE: blocking waits for the transactions of the writers running on the source shard, the later ones fail
+	if err := dbshard.BlockUserWrites(m.ctx, m.source, m.opts.UserId, cp.Fence); err != nil {
+		return err
+	}
+
+	switching := false
+	defer func() {
+		if switching {
+			return
+		}
+		//NOTE: the user stays on the source shard, the lock context may be done already
+		if err := dbshard.UnblockUserWrites(ctx, m.source, m.opts.UserId, cp.Fence); err != nil {
+			m.logger.Error(err, "Can't unblock user writes on source shard, they are blocked till the move is resumed")
+		}
+	}()
+
+	//NOTE: the writes on the target shard are blocked if the user was moved from it before
+	if err := dbshard.UnblockUserWrites(m.ctx, m.target, m.opts.UserId, cp.Fence); err != nil {
+		return err
+	}
+
+	if err := m.copy(cp); err != nil {
+		return err
+	}
+
+	if err := m.verify(); err != nil {
+		return err
+	}
+
+	if err := lock.Err(); err != nil {
+		return err
+	}
+
+	//NOTE: a failed switch may be committed anyway, the source writes stay blocked till the move is resumed.
+	// The switch is saved with the checkpoint, so it fails if a newer move took over meanwhile.
+	switching = true
+	err = m.mainDb.Transaction(m.ctx, func(conn *db.Conn) error {
+		ub := conn.Update("user_shard")
+		_, err := ub.Set(ub.Assign("shard_id", cp.TargetShard)).
+			Where(ub.Equal("user_id", m.opts.UserId)).
+			Exec(m.ctx)
+		if err != nil {
+			return err
+		}
+
+		return m.advance(cp, StepCleanup)
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.hub.ShardCache.Invalidate(m.opts.UserId)
+}
+
+func (m *mover) cleanup(cp *checkpoint) error {
+	//NOTE: invalidating again in case the previous run failed right after the switch
+	if err := m.hub.ShardCache.Invalidate(m.opts.UserId); err != nil {
+		return err
+	}
+
+	if m.opts.KeepSource {
+		return nil
+	}
+
+	return deleteUserRows(m.ctx, m.source, m.opts.UserId, cp.Fence)
+}
+
+func loadCheckpoint(ctx context.Context, mainDb *db.Conn, userId uint32) (*checkpoint, error) {
+	cp := &checkpoint{}
+	sb := mainDb.Select("user_id", "source_shard", "target_shard", "step", "mtime", "fence")
+	err := sb.From("user_move").Where(sb.Equal("user_id", userId)).Limit(1).LoadStruct(ctx, cp)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	return cp, nil
+}
+
+// saveCheckpoint saves the checkpoint unless a move with a greater fencing token saved the move of the user
+func saveCheckpoint(ctx context.Context, mainDb *db.Conn, cp *checkpoint) error {
+	cp.MTime = uint32(time.Now().Unix())
+
+	return mainDb.Transaction(ctx, func(conn *db.Conn) error {
+		var fence int64
+		sb := conn.Select("fence")
+		err := sb.From("user_move").Where(sb.Equal("user_id", cp.UserId)).ForUpdate().LoadValue(ctx, &fence)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return errors.WithStack(err)
+		}
+
+		if fence > cp.Fence {
+			return errors.Wrapf(dbshard.ErrMoveFenced, "user id %d, fencing token %d, saved by %d",
+				cp.UserId, cp.Fence, fence)
+		}
+
+		_, err = conn.ReplaceInto("user_move").
+			Cols("user_id", "source_shard", "target_shard", "step", "mtime", "fence").
+			Values(cp.UserId, cp.SourceShard, cp.TargetShard, cp.Step, cp.MTime, cp.Fence).
+			Exec(ctx)
+
+		return errors.WithStack(err)
+	})
+}
+
+// previousFence keeps the fencing token of the finished move for the next one, the tokens never decrease
+func previousFence(cp *checkpoint) int64 {
+	if cp == nil {
+		return 0
+	}
+	return cp.Fence
+}
@@ -0,0 +1,75 @@
+package shardmove
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"internal/dbshard"
+	"path/filepath"
+	"pkg/db"
+	"testing"
+)
+
+func newTestMainDb(t *testing.T) *db.Conn {
+	t.Helper()
+
+	d := db.New(db.Settings{string(db.MainAlias): db.Spec{
+		Driver: db.DriverSQLite,
+		Name:   filepath.Join(t.TempDir(), "main.db"),
+		Params: map[string]string{"_pragma": "busy_timeout(5000)"},
+	}}, logr.Discard())
+	t.Cleanup(d.Dispose)
+
+	mainDb := db.NewDbConn(d.MainPool(), logr.Discard())
+	_, err := mainDb.ExecBySQL(context.Background(), "CREATE TABLE user_move (user_id INTEGER PRIMARY KEY, "+
+		"source_shard INTEGER NOT NULL, target_shard INTEGER NOT NULL, step INTEGER NOT NULL, "+
+		"mtime INTEGER NOT NULL DEFAULT 0, fence INTEGER NOT NULL DEFAULT 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mainDb
+}
+
+func TestCheckpointFenced(t *testing.T) {
+	ctx := context.Background()
+	mainDb := newTestMainDb(t)
+
+	cp := &checkpoint{UserId: 7, SourceShard: 1, TargetShard: 2, Step: StepCopy}
+	if err := saveCheckpoint(ctx, mainDb, cp); err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: the move lost its lock during the cutover and a newer one took over
+	stale := *cp
+	stale.Fence = 4
+	newer := *cp
+	newer.Fence = 5
+	if err := saveCheckpoint(ctx, mainDb, &stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveCheckpoint(ctx, mainDb, &newer); err != nil {
+		t.Fatal(err)
+	}
+
+	stale.Step = StepCleanup
+	if err := saveCheckpoint(ctx, mainDb, &stale); !errors.Is(err, dbshard.ErrMoveFenced) {
+		t.Fatalf("save by the former move err = %v, want %v", err, dbshard.ErrMoveFenced)
+	}
+
+	saved, err := loadCheckpoint(ctx, mainDb, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Step != StepCopy || saved.Fence != 5 {
+		t.Errorf("saved step %d, fence %d, want the checkpoint of the newer move", saved.Step, saved.Fence)
+	}
+
+	//NOTE: the next move of the user starts with the token of the finished one
+	if fence := previousFence(saved); fence != 5 {
+		t.Errorf("fence of the next move = %d, want 5", fence)
+	}
+	if fence := previousFence(nil); fence != 0 {
+		t.Errorf("fence of the first move = %d, want 0", fence)
+	}
+}
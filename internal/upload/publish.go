@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"internal/advert"
+	"internal/auth"
+	"internal/dbshard"
+	"internal/env"
+	"internal/global"
+	"internal/quota"
+	"net/http"
+)
+
+type publishRequest struct {
+	OwnerId  uint32 `json:"owner_id"`
+	AdvertId uint64 `json:"advert_id"`
+}
+
+type publishResponse struct {
+	AdvertId uint64        `json:"advert_id"`
+	State    advert.Status `json:"state"`
+	Quota    *quota.Status `json:"quota"`
+}
+
+type PublishServer struct {
+	hub    global.Hub
+	logger logr.Logger
+}
+
+func NewPublishServer(globs global.Hub) *PublishServer {
+	logger := globs.Logger.WithName("[publishAdvert]")
+	return &PublishServer{hub: globs, logger: logger}
+}
+
+func (s *PublishServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &publishRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, "Bad request, bad body. Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.AdvertId == 0 {
+		http.Error(w, "Bad request, bad advert id.", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ClaimsFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ownerId, err := claims.BindOwner(req.OwnerId)
+	if err != nil {
+		http.Error(w, "Forbidden, bad user id. Error: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var env = env.NewEnvironment(s.hub)
+	defer env.Close()
+
+	quotaStatus, err := advert.PublishAdvert(r.Context(), env, ownerId, req.AdvertId, claims.Tier)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, advert.ErrAdvertNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, advert.ErrAdvertNotPrepared):
+			status = http.StatusConflict
+		case errors.Is(err, quota.ErrQuotaExceeded):
+			status = http.StatusForbidden
+		case errors.Is(err, dbshard.ErrUserMoving):
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "Can't publish advert. Error: "+err.Error(), status)
+		return
+	}
+
+	setQuotaHeaders(w, quotaStatus)
+
+	data, err := json.Marshal(&publishResponse{AdvertId: req.AdvertId, State: advert.StatusActive, Quota: quotaStatus})
+	if err != nil {
+		msg := "Can't parse response. Error: " + err.Error()
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -7,18 +7,26 @@ import (
 	"github.com/go-logr/logr"
 	"github.com/pkg/errors"
 	"internal/advert"
+	"internal/auth"
 	"internal/constant"
+	"internal/dbshard"
 	"internal/env"
 	"internal/global"
+	"internal/quota"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 )
 
 const (
-	tokenHeader = "TOKEN"
+	tokenHeader          = "TOKEN"
+	quotaLimitHeader     = "X-Quota-Limit"
+	quotaRemainingHeader = "X-Quota-Remaining"
+	maxUploadMemory      = 5 * 1024 * 1024
 )
 
 type Server struct {
@@ -37,19 +45,7 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := r.Header.Get(tokenHeader)
-	if len(token) == 0 {
-		s.logger.Error(nil, "Can't upload files. Bad request, token is not specified.")
-		http.Error(w, "Bad request, token is not specified.", http.StatusBadRequest)
-		return
-	}
-
-	if !isValidToken(token) {
-		http.Error(w, "Bad request, invalid token", http.StatusBadRequest)
-		return
-	}
-
-	err := r.ParseMultipartForm(5 * 1024 * 1024)
+	err := r.ParseMultipartForm(maxUploadMemory)
 	if err != nil {
 		msg := "Bad request, cant parse files. Error: " + err.Error()
 		http.Error(w, msg, http.StatusBadRequest)
@@ -89,15 +85,16 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if a.OwnerId <= 0 {
-		msg := "Bad request, bad user id. Error: " + err.Error()
-		http.Error(w, msg, http.StatusBadRequest)
+	claims, err := auth.ClaimsFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	if a.Id <= 0 {
-		msg := "Bad request, bad advert id. Error: " + err.Error()
-		http.Error(w, msg, http.StatusBadRequest)
+	a.OwnerId, err = claims.BindOwner(a.OwnerId)
+	if err != nil {
+		msg := "Forbidden, bad user id. Error: " + err.Error()
+		http.Error(w, msg, http.StatusForbidden)
 		return
 	}
 
@@ -149,7 +146,17 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var env = env.NewEnvironment(s.hub)
 	defer env.Close()
 
-	err = advert.CreateAdvert(ctx, env, a, images)
+	quotaStatus, err := advert.CreateAdvert(ctx, env, a, images, claims.Tier)
+	setQuotaHeaders(w, quotaStatus)
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		http.Error(w, "Forbidden. Error: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, dbshard.ErrUserMoving) {
+		w.Header().Set("Retry-After", "10")
+		http.Error(w, "Service unavailable. Error: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 	if err != nil {
 		msg := "Can't save files. Error: " + err.Error()
 		http.Error(w, msg, http.StatusInternalServerError)
@@ -167,6 +174,44 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
+// RequestCosts counts the adverts and photos an upload request is going to create
+func RequestCosts(r *http.Request) (int, int, error) {
+	err := r.ParseMultipartForm(maxUploadMemory)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "cant parse files")
+	}
+
+	return 1, len(r.MultipartForm.File["images"]), nil
+}
+
+// RequestFingerprint hashes the advert body and the content of every image of an upload request
+func RequestFingerprint(r *http.Request) (string, error) {
+	err := r.ParseMultipartForm(maxUploadMemory)
+	if err != nil {
+		return "", errors.Wrap(err, "cant parse files")
+	}
+
+	h := sha256.New()
+	for _, value := range r.MultipartForm.Value["advert"] {
+		fmt.Fprintf(h, "advert:%d:%s\n", len(value), value)
+	}
+
+	for _, image := range r.MultipartForm.File["images"] {
+		f, err := image.Open()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		fmt.Fprintf(h, "image:%s:%d:", image.Filename, image.Size)
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
 var supportedExtension = []string{
 	"png",
 }
@@ -182,9 +227,45 @@ func validateImages(images []*multipart.FileHeader) error {
 	return nil
 }
 
+// GatewayTokenMiddleware rejects the requests without the gateway token,
+// so they don't reach the middlewares which consume quotas or lock idempotency keys
+func GatewayTokenMiddleware(logger logr.Logger, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checkGatewayToken(logger, w, r) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func checkGatewayToken(logger logr.Logger, w http.ResponseWriter, r *http.Request) bool {
+	token := r.Header.Get(tokenHeader)
+	if len(token) == 0 {
+		logger.Error(nil, "Bad request, token is not specified.")
+		http.Error(w, "Bad request, token is not specified.", http.StatusBadRequest)
+		return false
+	}
+
+	if !isValidToken(token) {
+		http.Error(w, "Bad request, invalid token", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func setQuotaHeaders(w http.ResponseWriter, status *quota.Status) {
+	if status == nil || status.Unlimited() {
+		return
+	}
+
+	w.Header().Set(quotaLimitHeader, strconv.Itoa(status.Limit))
+	w.Header().Set(quotaRemainingHeader, strconv.Itoa(status.Remaining))
+}
+
 func isValidToken(token string) bool {
 	tokenBytes := []byte(token)
 	expectedBytes := []byte(constant.AdvertGatewayToken)
 	return subtle.ConstantTimeCompare(tokenBytes, expectedBytes) == 1
-	return true
 }
@@ -0,0 +1,82 @@
+package upload
+
+import (
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"internal/advert"
+	"internal/auth"
+	"internal/dbshard"
+	"internal/env"
+	"internal/global"
+	"net/http"
+)
+
+type UnpublishServer struct {
+	hub    global.Hub
+	logger logr.Logger
+}
+
+func NewUnpublishServer(globs global.Hub) *UnpublishServer {
+	logger := globs.Logger.WithName("[unpublishAdvert]")
+	return &UnpublishServer{hub: globs, logger: logger}
+}
+
+func (s *UnpublishServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &publishRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		http.Error(w, "Bad request, bad body. Error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.AdvertId == 0 {
+		http.Error(w, "Bad request, bad advert id.", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := auth.ClaimsFromContext(r.Context())
+	if err != nil {
+		http.Error(w, "Unauthorized. Error: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	ownerId, err := claims.BindOwner(req.OwnerId)
+	if err != nil {
+		http.Error(w, "Forbidden, bad user id. Error: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var env = env.NewEnvironment(s.hub)
+	defer env.Close()
+
+	quotaStatus, err := advert.UnpublishAdvert(r.Context(), env, ownerId, req.AdvertId, claims.Tier)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, advert.ErrAdvertNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, dbshard.ErrUserMoving):
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, "Can't unpublish advert. Error: "+err.Error(), status)
+		return
+	}
+
+	setQuotaHeaders(w, quotaStatus)
+
+	data, err := json.Marshal(&publishResponse{AdvertId: req.AdvertId, State: advert.StatusPrepared, Quota: quotaStatus})
+	if err != nil {
+		msg := "Can't parse response. Error: " + err.Error()
+		http.Error(w, msg, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
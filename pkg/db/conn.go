@@ -1,31 +1,51 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"github.com/go-logr/logr"
 	"github.com/huandu/go-sqlbuilder"
 	"github.com/jmoiron/sqlx"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type selectRunner interface {
-	Select(dest interface{}, query string, args ...interface{}) error
-	Get(dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	Rebind(query string) string
 }
 
 type execRunner interface {
-	NamedExec(query string, arg interface{}) (sql.Result, error)
-	MustExec(query string, args ...interface{}) sql.Result
-	Exec(query string, args ...interface{}) (sql.Result, error)
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	Rebind(query string) string
 }
 
+var (
+	ErrTxDone       = errors.New("transaction scope is already committed or rolled back")
+	ErrTxNestedOpen = errors.New("transaction scope has an open nested scope")
+)
+
 type Conn struct {
 	Logger    logr.Logger
 	pool      *Pool
 	tx        *sqlx.Tx
-	trRefs    int
-	commitTry int
+	txCtx     context.Context
+	txCancel  context.CancelFunc
+	scopes    []*Tx
+	lastWrite time.Time
+	pinned    bool
+}
+
+// Tx is a scope of the connection transaction. The outermost scope is the database transaction
+// and the nested ones are savepoints, so a nested scope is rolled back on its own.
+// Scopes must be finished in reverse order of Begin.
+type Tx struct {
+	dbConn *Conn
+	depth  int
+	done   bool
 }
 
 func NewDbConn(pool *Pool, logger logr.Logger) *Conn {
@@ -38,82 +58,152 @@ func NewDbConn(pool *Pool, logger logr.Logger) *Conn {
 	return dbc
 }
 
-func (dbConn *Conn) Transaction(txFunc func(dbConn *Conn) error) (err error) {
-	err = dbConn.Begin()
+// Transaction runs txFunc in a scope, which is committed if txFunc succeeds and rolled back otherwise
+func (dbConn *Conn) Transaction(ctx context.Context, txFunc func(dbConn *Conn) error) (err error) {
+	tx, err := dbConn.Begin(ctx)
 	if err != nil {
 		return
 	}
 	defer func() {
 		if p := recover(); p != nil {
-			dbConn.Rollback()
+			tx.Rollback()
 			panic(p) // re-throw panic after Rollback
 		} else if err != nil {
-			dbConn.Rollback() // err is non-nil; don't change it
+			tx.Rollback() // err is non-nil; don't change it
 		} else {
-			err = dbConn.Commit() // err is nil; if Commit returns error update err
+			err = tx.Commit() // err is nil; if Commit returns error update err
 		}
 	}()
 	err = txFunc(dbConn)
 	return err
 }
 
-func (dbConn *Conn) Begin() error {
-	//check if we are already in a transaction
+// Begin starts a transaction, which is rolled back if ctx is done before the commit.
+// Nested calls set a savepoint in the outer transaction.
+func (dbConn *Conn) Begin(ctx context.Context) (*Tx, error) {
 	if dbConn.tx != nil {
-		dbConn.trRefs++
-		return nil
+		tx := &Tx{dbConn: dbConn, depth: len(dbConn.scopes)}
+
+		ctx, cancel := withDefaultTimeout(ctx, dbConn.pool.queryTimeout)
+		defer cancel()
+
+		if _, err := dbConn.tx.ExecContext(ctx, "SAVEPOINT "+tx.savepoint()); err != nil {
+			dbConn.Logger.Error(err, "db.savepoint.error")
+			return nil, err
+		}
+
+		dbConn.scopes = append(dbConn.scopes, tx)
+		return tx, nil
 	}
-	tx, err := dbConn.pool.db.Beginx()
+
+	ctx, cancel := withDefaultTimeout(ctx, dbConn.pool.txTimeout)
+
+	sqlTx, err := dbConn.pool.db.BeginTxx(ctx, nil)
 	if err != nil {
+		cancel()
 		dbConn.Logger.Error(err, "db.begin.error")
-		return err
-	} else {
-		dbConn.Logger.Info("dbr.begin")
+		return nil, err
 	}
+	dbConn.Logger.Info("dbr.begin")
+
+	tx := &Tx{dbConn: dbConn}
+	dbConn.tx = sqlTx
+	dbConn.txCtx = ctx
+	dbConn.txCancel = cancel
+	dbConn.scopes = []*Tx{tx}
 
-	if err == nil {
-		dbConn.tx = tx
-		dbConn.trRefs = 1
-		dbConn.commitTry = 0
+	return tx, nil
+}
+
+// InTransaction tells if the connection has an open transaction
+func (dbConn *Conn) InTransaction() bool {
+	return dbConn.tx != nil
+}
+
+// Rollback rolls back the open transaction with all its scopes, it does nothing outside of a transaction
+func (dbConn *Conn) Rollback() error {
+	if dbConn.tx == nil {
+		return nil
 	}
+
+	//NOTE: the transaction is over even if rollback fails, e.g. when it was rolled back on ctx done
+	err := dbConn.tx.Rollback()
+	dbConn.endTx()
+
 	return err
 }
 
-func (dbConn *Conn) Rollback() error {
-	if dbConn.trRefs > 0 {
-		dbConn.trRefs--
-		if dbConn.trRefs == 0 {
-			if err := dbConn.tx.Rollback(); err != nil {
-				return err
-			}
-			dbConn.tx = nil
-		}
+func (dbConn *Conn) endTx() {
+	for _, tx := range dbConn.scopes {
+		tx.done = true
 	}
-	return nil
+	dbConn.scopes = nil
+	dbConn.tx = nil
+	dbConn.txCtx = nil
+	dbConn.txCancel()
+	dbConn.txCancel = nil
+}
+
+func (tx *Tx) savepoint() string {
+	return "sp_" + strconv.Itoa(tx.depth)
 }
 
-func (dbConn *Conn) RollbackOnDefer() {
-	if dbConn.commitTry == 0 {
-		dbConn.Rollback()
-	} else {
-		dbConn.commitTry--
+// finish checks the scope is the innermost open one and removes it from the connection
+func (tx *Tx) finish() error {
+	if tx.done {
+		return ErrTxDone
 	}
+
+	scopes := tx.dbConn.scopes
+	if scopes[len(scopes)-1] != tx {
+		return ErrTxNestedOpen
+	}
+
+	tx.dbConn.scopes = scopes[:len(scopes)-1]
+	tx.done = true
+
+	return nil
 }
 
-func (dbConn *Conn) Commit() error {
-	dbConn.commitTry++
-	if dbConn.trRefs > 0 {
-		dbConn.trRefs--
-		if dbConn.trRefs == 0 {
-			if err := dbConn.tx.Commit(); err != nil {
-				return err
-			}
-			dbConn.tx = nil
-		}
+func (tx *Tx) Commit() error {
+	if err := tx.finish(); err != nil {
+		return err
+	}
+
+	dbConn := tx.dbConn
+	if tx.depth > 0 {
+		_, err := dbConn.tx.ExecContext(dbConn.txCtx, "RELEASE SAVEPOINT "+tx.savepoint())
+		return err
+	}
+
+	err := dbConn.tx.Commit()
+	dbConn.endTx()
+	if err != nil {
+		return err
 	}
+	dbConn.lastWrite = time.Now()
+
 	return nil
 }
 
+func (tx *Tx) Rollback() error {
+	if err := tx.finish(); err != nil {
+		return err
+	}
+
+	dbConn := tx.dbConn
+	if tx.depth > 0 {
+		_, err := dbConn.tx.ExecContext(dbConn.txCtx, "ROLLBACK TO SAVEPOINT "+tx.savepoint())
+		return err
+	}
+
+	//NOTE: the transaction is over even if rollback fails, e.g. when it was rolled back on ctx done
+	err := dbConn.tx.Rollback()
+	dbConn.endTx()
+
+	return err
+}
+
 func (dbConn *Conn) getSelectRunner() selectRunner {
 	if dbConn.tx != nil {
 		return dbConn.tx
@@ -123,6 +213,8 @@ func (dbConn *Conn) getSelectRunner() selectRunner {
 }
 
 func (dbConn *Conn) getExecRunner() execRunner {
+	dbConn.lastWrite = time.Now()
+
 	if dbConn.tx != nil {
 		return dbConn.tx
 	}
@@ -130,15 +222,138 @@ func (dbConn *Conn) getExecRunner() execRunner {
 	return dbConn.pool.db
 }
 
+// PinPrimary routes all further reads of the connection to the primary
+func (dbConn *Conn) PinPrimary() {
+	dbConn.pinned = true
+}
+
+func (dbConn *Conn) readsPrimary() bool {
+	if dbConn.tx != nil || dbConn.pinned {
+		return true
+	}
+
+	window := dbConn.pool.readYourWrites
+	return window > 0 && time.Since(dbConn.lastWrite) < window
+}
+
+// query runs the read on a replica unless the connection reads from the primary,
+// failed replica reads are repeated on the primary
+func (dbConn *Conn) query(ctx context.Context, primary bool, query string, args []interface{},
+	read func(ctx context.Context, runner selectRunner, query string) error) (err error) {
+
+	ctx, cancel := withDefaultTimeout(ctx, dbConn.pool.queryTimeout)
+	defer cancel()
+
+	start := time.Now()
+	defer func() {
+		dbConn.observe(query, args, start, err)
+	}()
+
+	replica := dbConn.pool.replica()
+	if primary || replica == nil || dbConn.readsPrimary() {
+		runner := dbConn.getSelectRunner()
+		return read(ctx, runner, dbConn.rebind(runner, query))
+	}
+
+	err = read(ctx, replica, dbConn.rebind(replica, query))
+	if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+		return err
+	}
+
+	dbConn.Logger.Error(err, "db.replica.error")
+
+	return read(ctx, dbConn.pool.db, dbConn.rebind(dbConn.pool.db, query))
+}
+
+func (dbConn *Conn) exec(ctx context.Context, query string, args []interface{}) (sql.Result, error) {
+	ctx, cancel := withDefaultTimeout(ctx, dbConn.pool.queryTimeout)
+	defer cancel()
+
+	start := time.Now()
+	runner := dbConn.getExecRunner()
+	res, err := runner.ExecContext(ctx, dbConn.rebind(runner, query), args...)
+	dbConn.observe(query, args, start, err)
+
+	return res, err
+}
+
+// rebind turns the "?" placeholders into the ones of the driver. The PostgreSQL flavor builders
+// number their placeholders, they are turned back into "?" first to be numbered along with the raw SQL ones.
+func (dbConn *Conn) rebind(runner interface{ Rebind(string) string }, query string) string {
+	if dbConn.getFlavor() == sqlbuilder.PostgreSQL {
+		query = unnumberPlaceholders(query)
+	}
+	return runner.Rebind(query)
+}
+
+// unnumberPlaceholders replaces $1, $2... outside of quotes by "?"
+func unnumberPlaceholders(query string) string {
+	if !strings.Contains(query, "$") {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query))
+
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			for i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9' {
+				i++
+			}
+			b.WriteByte('?')
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// mergeArgs puts the arguments of the raw SQL before the ones of the builder, as the raw SQL goes first
+func mergeArgs(rawArgs, builtArgs []interface{}) []interface{} {
+	if len(rawArgs) == 0 {
+		return builtArgs
+	}
+	if len(builtArgs) == 0 {
+		return rawArgs
+	}
+
+	args := make([]interface{}, 0, len(rawArgs)+len(builtArgs))
+	args = append(args, rawArgs...)
+	return append(args, builtArgs...)
+}
+
+// withDefaultTimeout bounds ctx by timeout unless ctx has its own deadline or timeout is 0
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// Driver returns the driver name of the connection pool
+func (dbConn *Conn) Driver() string {
+	return dbConn.pool.db.DriverName()
+}
+
 func (dbConn *Conn) getFlavor() sqlbuilder.Flavor {
 	name := strings.ToLower(dbConn.pool.db.DriverName())
 
 	switch name {
 	case "mysql":
 		return sqlbuilder.MySQL
-	case "postgresql":
+	case "postgresql", "postgres", "pgx":
 		return sqlbuilder.PostgreSQL
-	case "sqlite":
+	case "sqlite", "sqlite3":
 		return sqlbuilder.SQLite
 	case "sqlserver":
 		return sqlbuilder.SQLServer
@@ -178,6 +393,13 @@ func (dbConn *Conn) InsertInto(table string) *InsertBuilder {
 	return &InsertBuilder{origin: ib, dbConn: dbConn}
 }
 
+func (dbConn *Conn) InsertIgnoreInto(table string) *InsertBuilder {
+	flavor := dbConn.getFlavor()
+	ib := flavor.NewInsertBuilder()
+	ib = ib.InsertIgnoreInto(table)
+	return &InsertBuilder{origin: ib, dbConn: dbConn}
+}
+
 func (dbConn *Conn) ReplaceInto(table string) *InsertBuilder {
 	flavor := dbConn.getFlavor()
 	ib := flavor.NewInsertBuilder()
@@ -205,3 +427,15 @@ func (dbConn *Conn) DeleteFrom(table string) *DeleteBuilder {
 	db = db.DeleteFrom(table)
 	return &DeleteBuilder{dbConn: dbConn, origin: db}
 }
+
+// ExecBySQL runs a statement the builders can't express, e.g. DDL
+func (dbConn *Conn) ExecBySQL(ctx context.Context, sql string, args ...interface{}) (sql.Result, error) {
+	return dbConn.exec(ctx, sql, args)
+}
+
+func (dbConn *Conn) DeleteBySQL(sql string, args ...interface{}) *DeleteBuilder {
+	flavor := dbConn.getFlavor()
+	db := flavor.NewDeleteBuilder()
+	db = db.SQL(sql)
+	return &DeleteBuilder{dbConn: dbConn, origin: db, args: args}
+}
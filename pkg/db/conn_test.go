@@ -0,0 +1,135 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/go-logr/logr"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newReplicaTestDB opens a SQLite main db with a replica in another file, the item 1 is named after
+// the db it is read from. The replica has no test_item table if broken.
+func newReplicaTestDB(t *testing.T, readYourWritesMs int, broken bool) *Conn {
+	t.Helper()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+	params := map[string]string{"_pragma": "busy_timeout(5000)"}
+	replicaName := filepath.Join(dir, "replica.db")
+
+	if !broken {
+		replica := New(Settings{string(MainAlias): {Driver: DriverSQLite, Name: replicaName, Params: params}},
+			logr.Discard())
+		_, err := NewDbConn(replica.MainPool(), logr.Discard()).ExecBySQL(ctx,
+			"CREATE TABLE test_item (id INTEGER PRIMARY KEY, name TEXT NOT NULL, price INTEGER NOT NULL);"+
+				"INSERT INTO test_item VALUES (1, 'replica', 0)")
+		replica.Dispose()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d := New(Settings{string(MainAlias): {
+		Driver:           DriverSQLite,
+		Name:             filepath.Join(dir, "primary.db"),
+		Params:           params,
+		Replicas:         []Spec{{Name: replicaName}},
+		ReadYourWritesMs: readYourWritesMs,
+	}}, logr.Discard())
+	t.Cleanup(d.Dispose)
+
+	dbConn := NewDbConn(d.MainPool(), logr.Discard())
+	_, err := dbConn.ExecBySQL(ctx,
+		"CREATE TABLE test_item (id INTEGER PRIMARY KEY, name TEXT NOT NULL, price INTEGER NOT NULL);"+
+			"INSERT INTO test_item VALUES (1, 'primary', 0)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: a fresh connection, so the writes above don't pin its reads
+	return NewDbConn(d.MainPool(), logr.Discard())
+}
+
+// readFrom returns the name of the db the item 1 is read from
+func readFrom(t *testing.T, dbConn *Conn, primary bool) string {
+	t.Helper()
+
+	var name string
+	sb := dbConn.Select("name")
+	sb.From("test_item").Where(sb.Equal("id", 1))
+	if primary {
+		sb.Primary()
+	}
+	if err := sb.LoadValue(context.Background(), &name); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReplicaRouting(t *testing.T) {
+	ctx := context.Background()
+	dbConn := newReplicaTestDB(t, 0, false)
+
+	if from := readFrom(t, dbConn, false); from != "replica" {
+		t.Errorf("read from %s, want replica", from)
+	}
+	if from := readFrom(t, dbConn, true); from != "primary" {
+		t.Errorf("primary read from %s, want primary", from)
+	}
+
+	err := dbConn.Transaction(ctx, func(conn *Conn) error {
+		if from := readFrom(t, conn, false); from != "primary" {
+			t.Errorf("read in a transaction from %s, want primary", from)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: a lagging replica misses the row, it is not read again from the primary
+	var name string
+	sb := dbConn.Select("name")
+	err = sb.From("test_item").Where(sb.Equal("id", 2)).LoadValue(ctx, &name)
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("read of a missing row err = %v, want %v", err, sql.ErrNoRows)
+	}
+
+	dbConn.PinPrimary()
+	if from := readFrom(t, dbConn, false); from != "primary" {
+		t.Errorf("read of a pinned connection from %s, want primary", from)
+	}
+}
+
+func TestReplicaFallback(t *testing.T) {
+	dbConn := newReplicaTestDB(t, 0, true)
+
+	if from := readFrom(t, dbConn, false); from != "primary" {
+		t.Errorf("read of a failed replica from %s, want primary", from)
+	}
+}
+
+func TestReadYourWrites(t *testing.T) {
+	ctx := context.Background()
+	dbConn := newReplicaTestDB(t, 200, false)
+
+	if from := readFrom(t, dbConn, false); from != "replica" {
+		t.Errorf("read before writes from %s, want replica", from)
+	}
+
+	ub := dbConn.Update("test_item")
+	if _, err := ub.Set(ub.Assign("price", 10)).Where(ub.Equal("id", 1)).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if from := readFrom(t, dbConn, false); from != "primary" {
+		t.Errorf("read right after the write from %s, want primary", from)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if from := readFrom(t, dbConn, false); from != "replica" {
+		t.Errorf("read after the window from %s, want replica", from)
+	}
+}
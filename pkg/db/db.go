@@ -3,11 +3,12 @@ package db
 import (
 	"errors"
 	"fmt"
+	"github.com/go-logr/logr"
 	_ "github.com/go-sql-driver/mysql"
-	"sort"
-
-	//_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+	"sort"
 	"strings"
 	"time"
 )
@@ -25,12 +26,21 @@ var (
 
 type DB struct {
 	settings   Settings
+	logger     logr.Logger
 	pools      map[string]*Pool
 	shardPools []*Pool
+	stopHealth chan struct{}
+	healthDone chan struct{}
 }
 
-func New(s Settings) *DB {
-	d := &DB{settings: s}
+// New opens the pools of the settings and connects them with retries. It panics on invalid settings
+// or unavailable main db, unavailable shards are reported by Health and checked again in background.
+func New(s Settings, logger logr.Logger) *DB {
+	if err := s.Validate(); err != nil {
+		panic("invalid db settings: " + err.Error())
+	}
+
+	d := &DB{settings: s, logger: logger.WithName("[db]")}
 	d.init()
 	return d
 }
@@ -38,6 +48,8 @@ func New(s Settings) *DB {
 func (d *DB) init() {
 	d.openConnectionsPools()
 	d.defineShardsPools()
+	d.connectPools()
+	d.startHealthChecks()
 }
 
 func (d *DB) Shards() []*Pool {
@@ -60,23 +72,42 @@ func (d *DB) openConnectionsPools() {
 	d.pools = make(map[string]*Pool)
 
 	for alias, spec := range d.settings {
-		db := openPool(spec)
-		d.pools[alias] = &Pool{db: db, alias: alias}
+		pool := &Pool{
+			db:             openPool(spec),
+			alias:          alias,
+			readYourWrites: time.Duration(spec.ReadYourWritesMs) * time.Millisecond,
+			queryTimeout:   time.Duration(spec.QueryTimeoutMs) * time.Millisecond,
+			txTimeout:      time.Duration(spec.TxTimeoutMs) * time.Millisecond,
+			slowQuery:      time.Duration(spec.SlowQueryMs) * time.Millisecond,
+			logLevel:       spec.LogLevel,
+		}
+		for i := range spec.Replicas {
+			pool.replicas = append(pool.replicas, openPool(spec.replicaSpec(i)))
+		}
+		d.pools[alias] = pool
 	}
 }
 
+func init() {
+	//NOTE: sqlx doesn't know the name of the pure Go SQLite driver
+	sqlx.BindDriver(DriverSQLite, sqlx.QUESTION)
+}
+
+// openPool doesn't connect, so an unavailable db doesn't stop the app on start
 func openPool(s Spec) *sqlx.DB {
-	driver := s.Driver
-	if len(driver) == 0 {
-		driver = "mysql"
-	}
-	//NOTE: sql.Open(..) doesn't happen to return an error
+	driver := s.driver()
 
-	sqlDb, err := sqlx.Connect(driver, s.ConnStr())
+	sqlDb, err := sqlx.Open(driver, s.ConnStr())
 	if err != nil {
-		panic("failed to connect to mysql on start: " + err.Error())
+		panic("failed to open " + driver + " pool on start: " + err.Error())
 	}
 
+	setPoolLimits(sqlDb, s)
+
+	return sqlDb
+}
+
+func setPoolLimits(sqlDb *sqlx.DB, s Spec) {
 	if s.MaxIdleCons == 0 {
 		//NOTE: using default sql.DB settings
 		sqlDb.SetMaxIdleConns(2)
@@ -92,8 +123,6 @@ func openPool(s Spec) *sqlx.DB {
 	if s.ConnMaxIdleTimeSec != 0 {
 		sqlDb.SetConnMaxIdleTime(time.Second * time.Duration(s.ConnMaxIdleTimeSec))
 	}
-
-	return sqlDb
 }
 
 func getShardAlias(shardId uint) string {
@@ -143,6 +172,7 @@ func (d *DB) ForEachShardPool(f func(pool *Pool) error) error {
 }
 
 func (d *DB) Dispose() {
+	d.stopHealthChecks()
 	d.closeConnectionsPools()
 }
 
@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-logr/logr"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type testItem struct {
+	Id    uint64 `db:"id"`
+	Name  string `db:"name"`
+	Price int    `db:"price"`
+}
+
+// newTestDB opens the main db and the shards as SQLite files with the test_item table
+func newTestDB(t *testing.T, shards int) *DB {
+	t.Helper()
+
+	dir := t.TempDir()
+	spec := func(name string) Spec {
+		return Spec{
+			Driver: DriverSQLite,
+			Name:   filepath.Join(dir, name+".db"),
+			Params: map[string]string{"_pragma": "busy_timeout(5000)"},
+		}
+	}
+
+	settings := Settings{string(MainAlias): spec(string(MainAlias))}
+	for shardId := uint(1); shardId <= uint(shards); shardId++ {
+		settings[getShardAlias(shardId)] = spec(getShardAlias(shardId))
+	}
+
+	d := New(settings, logr.Discard())
+	t.Cleanup(d.Dispose)
+
+	for _, alias := range append([]string{string(MainAlias)}, shardAliases(shards)...) {
+		dbConn := NewDbConn(d.getPoolByAlias(alias), logr.Discard())
+		_, err := dbConn.ExecBySQL(context.Background(),
+			"CREATE TABLE test_item (id INTEGER PRIMARY KEY, name TEXT NOT NULL, price INTEGER NOT NULL)")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return d
+}
+
+func shardAliases(shards int) []string {
+	aliases := make([]string, shards)
+	for i := range aliases {
+		aliases[i] = getShardAlias(uint(i + 1))
+	}
+	return aliases
+}
+
+func loadTestItems(t *testing.T, dbConn *Conn) []*testItem {
+	t.Helper()
+
+	var items []*testItem
+	sb := dbConn.Select("id", "name", "price")
+	_, err := sb.From("test_item").OrderBy("id").LoadStructs(context.Background(), &items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+func TestSQLiteBuilders(t *testing.T) {
+	ctx := context.Background()
+	dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+
+	_, err := dbConn.InsertInto("test_item").
+		Structs([]*testItem{{Id: 1, Name: "chair", Price: 10}, {Id: 2, Name: "table", Price: 30}}).
+		Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ub := dbConn.Update("test_item")
+	_, err = ub.SetStruct(&testItem{Name: "sofa", Price: 50}, "name", "price").
+		Where(ub.Equal("id", 2)).
+		Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var name string
+	sb := dbConn.Select("name")
+	err = sb.From("test_item").
+		Where(sb.In("id", 2), sb.GreaterThan("price", 40)).
+		ForUpdate().
+		LoadValue(ctx, &name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "sofa" {
+		t.Errorf("name = %q, want sofa", name)
+	}
+
+	delb := dbConn.DeleteFrom("test_item")
+	if _, err := delb.Where(delb.Equal("id", 1)).Exec(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	items := loadTestItems(t, dbConn)
+	if len(items) != 1 || *items[0] != (testItem{Id: 2, Name: "sofa", Price: 50}) {
+		t.Errorf("items = %+v", items)
+	}
+}
+
+func TestSQLiteNestedTransaction(t *testing.T) {
+	ctx := context.Background()
+	dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+	errNested := errors.New("nested failed")
+
+	err := dbConn.Transaction(ctx, func(dbConn *Conn) error {
+		if _, err := dbConn.InsertInto("test_item").Struct(&testItem{Id: 1, Name: "outer"}).Exec(ctx); err != nil {
+			return err
+		}
+
+		err := dbConn.Transaction(ctx, func(dbConn *Conn) error {
+			if _, err := dbConn.InsertInto("test_item").Struct(&testItem{Id: 2, Name: "nested"}).Exec(ctx); err != nil {
+				return err
+			}
+			return errNested
+		})
+		if !errors.Is(err, errNested) {
+			t.Errorf("nested err = %v, want %v", err, errNested)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := loadTestItems(t, dbConn)
+	if len(items) != 1 || items[0].Name != "outer" {
+		t.Errorf("items = %+v, want only the outer one", items)
+	}
+}
+
+func TestSQLiteTransactionRollback(t *testing.T) {
+	ctx := context.Background()
+	dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+	errTx := errors.New("tx failed")
+
+	err := dbConn.Transaction(ctx, func(dbConn *Conn) error {
+		if _, err := dbConn.InsertInto("test_item").Struct(&testItem{Id: 1, Name: "chair"}).Exec(ctx); err != nil {
+			return err
+		}
+		return errTx
+	})
+	if !errors.Is(err, errTx) {
+		t.Fatalf("err = %v, want %v", err, errTx)
+	}
+	if dbConn.InTransaction() {
+		t.Error("transaction is left open")
+	}
+
+	if items := loadTestItems(t, dbConn); len(items) != 0 {
+		t.Errorf("items = %+v, want none", items)
+	}
+}
+
+func TestUnnumberPlaceholders(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"SELECT 1", "SELECT 1"},
+		{"SELECT * FROM t WHERE a = $1 AND b = $2", "SELECT * FROM t WHERE a = ? AND b = ?"},
+		{"SELECT * FROM t WHERE a IN ($10, $11)", "SELECT * FROM t WHERE a IN (?, ?)"},
+		{"SELECT '$1', a FROM t WHERE b = $1", "SELECT '$1', a FROM t WHERE b = ?"},
+		{`SELECT "col$1" FROM t WHERE b = $1`, `SELECT "col$1" FROM t WHERE b = ?`},
+		{"SELECT 'it''s $1' WHERE a = $1", "SELECT 'it''s $1' WHERE a = ?"},
+		{"SELECT price$ FROM t WHERE a = $", "SELECT price$ FROM t WHERE a = $"},
+	}
+
+	for _, tt := range tests {
+		if got := unnumberPlaceholders(tt.query); got != tt.want {
+			t.Errorf("unnumberPlaceholders(%q) = %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestMysqlConnStr(t *testing.T) {
+	tests := []struct {
+		name string
+		spec Spec
+		want string
+	}{
+		{
+			name: "plain",
+			spec: Spec{Host: "db", Port: 3306, Username: "app", Password: "secret", Name: "adverts"},
+			want: "app:secret@tcp(db:3306)/adverts",
+		},
+		{
+			name: "default port",
+			spec: Spec{Host: "db", Username: "app", Password: "secret", Name: "adverts"},
+			want: "app:secret@tcp(db)/adverts",
+		},
+		{
+			name: "special chars in password",
+			spec: Spec{Host: "db", Port: 3306, Username: "app", Password: "p@ss/w:rd?", Name: "adverts"},
+			want: "app:p@ss/w:rd?@tcp(db:3306)/adverts",
+		},
+		{
+			name: "ipv6 host",
+			spec: Spec{Host: "::1", Port: 3307, Username: "app", Name: "adverts"},
+			want: "app@tcp([::1]:3307)/adverts",
+		},
+		{
+			name: "params",
+			spec: Spec{Host: "db", Port: 3306, Username: "app", Name: "adverts",
+				Params: map[string]string{"parseTime": "true", "charset": "utf8mb4"}},
+			want: "app@tcp(db:3306)/adverts?parseTime=true&charset=utf8mb4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.spec.ConnStr(); got != tt.want {
+				t.Errorf("ConnStr() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateMysqlParams(t *testing.T) {
+	spec := Spec{Host: "db", Name: "adverts", Params: map[string]string{"parseTime": "maybe"}}
+	if err := spec.validate(); err == nil {
+		t.Error("invalid parseTime is accepted")
+	}
+}
+
+func TestSpecRejectsUnknownKeys(t *testing.T) {
+	var s Settings
+	err := json.Unmarshal([]byte(`{"main": {"diver": "sqlite", "name": "main.db"}}`), &s)
+	if err == nil || !strings.Contains(err.Error(), "diver") {
+		t.Errorf("err = %v, want the unknown key rejected", err)
+	}
+
+	if err := json.Unmarshal([]byte(`{"main": {"driver": "sqlite", "name": "main.db"}}`), &s); err != nil {
+		t.Errorf("valid spec err = %v", err)
+	}
+}
+
+func TestValidateShardGaps(t *testing.T) {
+	spec := Spec{Driver: DriverSQLite, Name: "db"}
+
+	valid := Settings{string(MainAlias): spec, "shard_01": spec, "shard_02": spec}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("shards without gaps err = %v", err)
+	}
+
+	gap := Settings{string(MainAlias): spec, "shard_01": spec, "shard_03": spec}
+	if err := gap.Validate(); err == nil || !strings.Contains(err.Error(), "shard_01 to shard_02") {
+		t.Errorf("shards with a gap err = %v, want the gap rejected", err)
+	}
+
+	if err := (Settings{"shard_01": spec}).Validate(); err == nil {
+		t.Error("settings without the main db are accepted")
+	}
+}
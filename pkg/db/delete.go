@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"github.com/huandu/go-sqlbuilder"
 )
@@ -9,10 +10,19 @@ import (
 type DeleteBuilder struct {
 	dbConn *Conn
 	origin *sqlbuilder.DeleteBuilder
+	args   []interface{}
 }
 
-func (b *DeleteBuilder) Exec() (sql.Result, error) {
+func (b *DeleteBuilder) Exec(ctx context.Context) (sql.Result, error) {
 	sql, args := b.origin.Build()
-	runner := b.dbConn.getExecRunner()
-	return runner.NamedExec(sql, args)
+	return b.dbConn.exec(ctx, sql, mergeArgs(b.args, args))
+}
+
+func (b *DeleteBuilder) Where(andExpr ...string) *DeleteBuilder {
+	b.origin.Where(andExpr...)
+	return b
+}
+
+func (b *DeleteBuilder) Equal(field string, value interface{}) string {
+	return b.origin.Equal(field, value)
 }
@@ -0,0 +1,168 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConnectAttempts = 5
+	defaultConnectBackoff  = 500 * time.Millisecond
+	maxConnectBackoff      = 5 * time.Second
+
+	healthCheckInterval = 10 * time.Second
+	healthCheckTimeout  = 2 * time.Second
+)
+
+// Health is the state of a pool by its last ping
+type Health struct {
+	Alias     string    `json:"alias"`
+	Healthy   bool      `json:"healthy"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (p *Pool) Health() Health {
+	if h := p.health.Load(); h != nil {
+		return *h
+	}
+	return Health{Alias: p.alias}
+}
+
+// Healthy tells if the last ping of the pool succeeded
+func (p *Pool) Healthy() bool {
+	return p.Health().Healthy
+}
+
+func (p *Pool) ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	err := p.db.PingContext(ctx)
+
+	h := &Health{Alias: p.alias, Healthy: err == nil, CheckedAt: time.Now()}
+	if err != nil {
+		h.Error = err.Error()
+	}
+	p.health.Store(h)
+
+	return err
+}
+
+// connect pings the pool until it succeeds or the attempts of the spec are over, doubling the backoff
+func (p *Pool) connect(s Spec) error {
+	attempts := s.ConnectAttempts
+	if attempts == 0 {
+		attempts = defaultConnectAttempts
+	}
+	backoff := time.Duration(s.ConnectBackoffMs) * time.Millisecond
+	if backoff == 0 {
+		backoff = defaultConnectBackoff
+	}
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = p.ping(context.Background()); err == nil || attempt >= attempts {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff = min(backoff*2, maxConnectBackoff)
+	}
+}
+
+// connectPools connects all pools at once. The app can't run without the main db, so it panics
+// if the main db is unavailable, the other pools are left unhealthy.
+func (d *DB) connectPools() {
+	var wg sync.WaitGroup
+	for alias, pool := range d.pools {
+		wg.Add(1)
+		go func(spec Spec, pool *Pool) {
+			defer wg.Done()
+			if err := pool.connect(spec); err != nil {
+				d.logger.Error(err, "Db is unavailable", "db", pool.alias)
+			}
+		}(d.settings[alias], pool)
+	}
+	wg.Wait()
+
+	if main := d.MainPool(); !main.Healthy() {
+		panic("failed to connect to main db on start: " + main.Health().Error)
+	}
+
+	if d.Degraded() {
+		d.logger.Info("Starting degraded, unavailable dbs are checked in background")
+	}
+}
+
+// Health returns the health of all pools ordered by alias
+func (d *DB) Health() []Health {
+	healths := make([]Health, 0, len(d.pools))
+	for _, pool := range d.pools {
+		healths = append(healths, pool.Health())
+	}
+
+	sort.Slice(healths, func(i, j int) bool {
+		return healths[i].Alias < healths[j].Alias
+	})
+
+	return healths
+}
+
+// Degraded tells if any pool is unhealthy
+func (d *DB) Degraded() bool {
+	for _, pool := range d.pools {
+		if !pool.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DB) startHealthChecks() {
+	d.stopHealth = make(chan struct{})
+	d.healthDone = make(chan struct{})
+
+	go func() {
+		defer close(d.healthDone)
+
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-d.stopHealth:
+				return
+			case <-ticker.C:
+				d.checkHealth()
+			}
+		}
+	}()
+}
+
+func (d *DB) stopHealthChecks() {
+	if d.stopHealth == nil {
+		return
+	}
+
+	close(d.stopHealth)
+	<-d.healthDone
+	d.stopHealth = nil
+}
+
+// checkHealth pings all pools and logs the changes of their health
+func (d *DB) checkHealth() {
+	for _, pool := range d.pools {
+		wasHealthy := pool.Healthy()
+		err := pool.ping(context.Background())
+
+		switch {
+		case err != nil && wasHealthy:
+			d.logger.Error(err, "Db became unavailable", "db", pool.alias)
+		case err == nil && !wasHealthy:
+			d.logger.Info("Db became available", "db", pool.alias)
+		}
+	}
+}
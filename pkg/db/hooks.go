@@ -0,0 +1,87 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"strings"
+	"time"
+)
+
+var (
+	queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "db_query_duration_seconds",
+		Help:    "Duration of db queries.",
+		Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"db", "statement"})
+	queryErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_query_errors_total",
+		Help: "Failed db queries, not found rows are not counted.",
+	}, []string{"db", "statement"})
+	slowQueries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "db_slow_queries_total",
+		Help: "Db queries running longer than the slow query threshold of the pool.",
+	}, []string{"db", "statement"})
+)
+
+// observe logs the finished query and records its metrics. Log level 1 of the pool logs the SQL,
+// level 2 adds the redacted arguments. Slow queries are logged at any level.
+func (dbConn *Conn) observe(query string, args []interface{}, start time.Time, err error) {
+	duration := time.Since(start)
+	pool := dbConn.pool
+	statement := statementType(query)
+
+	queryDuration.WithLabelValues(pool.alias, statement).Observe(duration.Seconds())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		queryErrors.WithLabelValues(pool.alias, statement).Inc()
+	}
+
+	logger := dbConn.Logger
+	if pool.slowQuery > 0 && duration >= pool.slowQuery {
+		slowQueries.WithLabelValues(pool.alias, statement).Inc()
+		logger.Info("db.slow_query", "sql", query, "args", redactArgs(args), "duration", duration)
+	} else if pool.logLevel > 1 {
+		logger.V(1).Info("db.query", "sql", query, "args", redactArgs(args), "duration", duration)
+	} else if pool.logLevel > 0 {
+		logger.V(1).Info("db.query", "sql", query, "duration", duration)
+	}
+}
+
+// statementType returns the first keyword of the query in lower case
+func statementType(query string) string {
+	query = strings.TrimSpace(query)
+	if end := strings.IndexAny(query, " \t\r\n("); end > 0 {
+		query = query[:end]
+	}
+
+	switch keyword := strings.ToLower(query); keyword {
+	case "select", "insert", "update", "delete", "replace":
+		return keyword
+	}
+	return "other"
+}
+
+// redactArgs keeps numbers, bools and times of the arguments and replaces strings and bytes
+// by their length, as they may hold personal data
+func redactArgs(args []interface{}) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case nil:
+			redacted[i] = "NULL"
+		case string:
+			redacted[i] = fmt.Sprintf("<string %d>", len(v))
+		case []byte:
+			redacted[i] = fmt.Sprintf("<bytes %d>", len(v))
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+			redacted[i] = fmt.Sprint(v)
+		case time.Time:
+			redacted[i] = v.Format(time.RFC3339)
+		default:
+			redacted[i] = fmt.Sprintf("<%T>", v)
+		}
+	}
+	return redacted
+}
@@ -0,0 +1,36 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedactArgs(t *testing.T) {
+	at := time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)
+	args := []interface{}{nil, "secret@mail.com", []byte{1, 2, 3}, 42, uint32(7), -1.5, true, at, struct{}{}}
+
+	want := []string{"NULL", "<string 15>", "<bytes 3>", "42", "7", "-1.5", "true", "2024-05-01T10:30:00Z", "<struct {}>"}
+	if got := redactArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("redacted = %q, want %q", got, want)
+	}
+}
+
+func TestStatementType(t *testing.T) {
+	tests := map[string]string{
+		"SELECT id FROM advert":           "select",
+		"  insert into advert (id)":       "insert",
+		"UPDATE advert SET state = 1":     "update",
+		"DELETE FROM advert":              "delete",
+		"REPLACE INTO user_move":          "replace",
+		"(SELECT 1) UNION (SELECT 2)":     "other",
+		"SAVEPOINT sp1":                   "other",
+		"select\n\tid FROM product_photo": "select",
+	}
+
+	for query, want := range tests {
+		if got := statementType(query); got != want {
+			t.Errorf("statement type of %q = %q, want %q", query, got, want)
+		}
+	}
+}
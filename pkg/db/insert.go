@@ -1,48 +1,90 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"github.com/huandu/go-sqlbuilder"
 	"reflect"
+	"strings"
 )
 
+// upsertRowAlias names the inserted row in the ON DUPLICATE KEY UPDATE assignments
+const upsertRowAlias = "new"
+
+var ErrUpsertUnsupported = errors.New("ON DUPLICATE KEY UPDATE is supported by MySQL only")
+
 // InsertBuilder contains the clauses for an INSERT statement
 type InsertBuilder struct {
 	origin *sqlbuilder.InsertBuilder
 	dbConn *Conn
+	cols   []string
+	err    error
 }
 
-func (b *InsertBuilder) Exec() (sql.Result, error) {
+func (b *InsertBuilder) Exec(ctx context.Context) (sql.Result, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
 	sql, args := b.origin.Build()
-	runner := b.dbConn.getExecRunner()
-	result, err := runner.Exec(sql, args...)
-	return result, err
+	return b.dbConn.exec(ctx, sql, args)
 }
 
 func (b *InsertBuilder) Cols(col ...string) *InsertBuilder {
+	b.cols = col
 	b.origin.Cols(col...)
 	return b
 }
 
 func (b *InsertBuilder) Values(value ...interface{}) *InsertBuilder {
-	correctValues(&value)
 	b.origin.Values(value...)
 	return b
 }
 
-func correctValues(value *[]interface{}) {
-	for i := 0; i < len(*value); i++ {
-		elem := (*value)[i]
-		val := reflect.ValueOf(elem)
-		if val.Type() == reflect.TypeOf(Point{}) {
-			point := elem.(Point)
-			(*value)[i] = fmt.Sprintf("ST_GeomFromText('POINT(%f %f)')", point.Longitude, point.Latitude)
-		}
+func (b *InsertBuilder) SQL(sql string) *InsertBuilder {
+	b.origin.SQL(sql)
+	return b
+}
+
+// Struct adds a row with the values of the struct fields by their db tags,
+// the columns are taken from the tags unless set by Cols before
+func (b *InsertBuilder) Struct(value interface{}) *InsertBuilder {
+	v := structValue(value)
+	if len(b.cols) == 0 {
+		b.Cols(StructColumns(value)...)
 	}
+	return b.Values(structValues(v, b.cols)...)
 }
 
-func (b *InsertBuilder) SQL(sql string) *InsertBuilder {
-	b.origin.SQL(sql)
+// Structs adds a row for every struct of the slice, see Struct
+func (b *InsertBuilder) Structs(slice interface{}) *InsertBuilder {
+	v := reflect.ValueOf(slice)
+	if v.Kind() != reflect.Slice {
+		panic(fmt.Sprintf("slice expected, got %T", slice))
+	}
+
+	for i := 0; i < v.Len(); i++ {
+		b.Struct(v.Index(i).Interface())
+	}
+	return b
+}
+
+// OnDuplicateKeyUpdate turns the insert into the MySQL upsert, which overwrites the columns
+// of the existing row by the values of the inserted row. The inserted row is referenced by its alias,
+// as VALUES() is deprecated since MySQL 8.0.20, so MySQL 8.0.19 or later is required.
+// Must be called after the values are added, Exec fails with ErrUpsertUnsupported on other drivers.
+func (b *InsertBuilder) OnDuplicateKeyUpdate(col ...string) *InsertBuilder {
+	if b.dbConn.getFlavor() != sqlbuilder.MySQL {
+		b.err = fmt.Errorf("%w, not by %s", ErrUpsertUnsupported, b.dbConn.Driver())
+		return b
+	}
+
+	assignments := make([]string, len(col))
+	for i, c := range col {
+		assignments[i] = c + " = " + upsertRowAlias + "." + c
+	}
+	b.origin.SQL("AS " + upsertRowAlias + " ON DUPLICATE KEY UPDATE " + strings.Join(assignments, ", "))
 	return b
 }
@@ -0,0 +1,88 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/go-logr/logr"
+	"github.com/jmoiron/sqlx"
+	"reflect"
+	"testing"
+)
+
+func TestOnDuplicateKeyUpdate(t *testing.T) {
+	mysqlConn := NewDbConn(&Pool{db: sqlx.NewDb(nil, DriverMySQL)}, logr.Discard())
+	b := mysqlConn.InsertInto("test_item").Cols("id", "name", "price").Values(1, "chair", 10).
+		OnDuplicateKeyUpdate("name", "price")
+
+	sql, _ := b.origin.Build()
+	want := "INSERT INTO test_item (id, name, price) VALUES (?, ?, ?) AS new ON DUPLICATE KEY UPDATE name = new.name, price = new.price"
+	if sql != want || b.err != nil {
+		t.Errorf("sql = %q, err = %v, want %q", sql, b.err, want)
+	}
+
+	dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+	_, err := dbConn.InsertInto("test_item").Cols("id", "name", "price").Values(1, "chair", 10).
+		OnDuplicateKeyUpdate("name", "price").
+		Exec(context.Background())
+	if !errors.Is(err, ErrUpsertUnsupported) {
+		t.Errorf("sqlite err = %v, want %v", err, ErrUpsertUnsupported)
+	}
+	if items := loadTestItems(t, dbConn); len(items) != 0 {
+		t.Errorf("items = %+v, want none", items)
+	}
+}
+
+type testPriced struct {
+	Price int `db:"price"`
+}
+
+type testNamed struct {
+	Name  string `db:"name"`
+	Price int    `db:"price"`
+}
+
+type testEmbeddedItem struct {
+	Id uint64 `db:"id"`
+	*testNamed
+	testPriced
+	Ignored testPriced
+}
+
+func TestStructEmbedded(t *testing.T) {
+	item := &testEmbeddedItem{Id: 1, testNamed: &testNamed{Name: "chair", Price: 5}, testPriced: testPriced{Price: 10}}
+
+	//NOTE: the unexported pointer embed is skipped, its fields can't be set through it
+	columns := StructColumns(item)
+	if len(columns) != 2 || columns[0] != "id" || columns[1] != "price" {
+		t.Errorf("columns = %v, want [id price]", columns)
+	}
+
+	type Named = testNamed
+	type shadowed struct {
+		Id uint64 `db:"id"`
+		*Named
+		Name string `db:"name"`
+	}
+
+	fields := structFields(reflect.TypeOf(shadowed{}))
+	if len(fields) != 3 || fields[1].column != "name" || len(fields[1].index) != 1 || fields[2].column != "price" {
+		t.Errorf("fields = %+v", fields)
+	}
+
+	if values := structValues(reflect.ValueOf(shadowed{Id: 1}), nil); values[2] != nil {
+		t.Errorf("price of nil embedded struct = %v, want nil", values[2])
+	}
+
+	dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+	_, err := dbConn.InsertInto("test_item").Cols("id", "name", "price").
+		Struct(&shadowed{Id: 1, Named: &Named{Name: "hidden", Price: 20}, Name: "table"}).
+		Exec(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items := loadTestItems(t, dbConn)
+	if len(items) != 1 || *items[0] != (testItem{Id: 1, Name: "table", Price: 20}) {
+		t.Errorf("items = %+v", items)
+	}
+}
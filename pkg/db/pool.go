@@ -1,6 +1,10 @@
 package db
 
-import "github.com/jmoiron/sqlx"
+import (
+	"github.com/jmoiron/sqlx"
+	"sync/atomic"
+	"time"
+)
 
 type Pools []*Pool
 
@@ -17,11 +21,38 @@ func (p *Pools) Swap(i, j int) {
 }
 
 type Pool struct {
-	db    *sqlx.DB
-	alias string
+	db             *sqlx.DB
+	replicas       []*sqlx.DB
+	next           atomic.Uint32
+	readYourWrites time.Duration
+	queryTimeout   time.Duration
+	txTimeout      time.Duration
+	slowQuery      time.Duration
+	logLevel       int
+	alias          string
+	health         atomic.Pointer[Health]
+}
+
+// replica picks replicas round-robin, nil if the pool has no replicas
+func (p *Pool) replica() *sqlx.DB {
+	if len(p.replicas) == 0 {
+		return nil
+	}
+
+	i := p.next.Add(1)
+	return p.replicas[int(i)%len(p.replicas)]
+}
+
+func (p *Pool) Alias() string {
+	return p.alias
 }
 
 func (p *Pool) Close() {
 	p.db.Close()
 	p.db = nil
+
+	for _, replica := range p.replicas {
+		replica.Close()
+	}
+	p.replicas = nil
 }
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 20 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+
+	mysqlErrLockWaitTimeout = 1205
+	mysqlErrDeadlock        = 1213
+
+	pgErrDeadlock          = "40P01"
+	pgErrLockNotAvailable  = "55P03"
+	pgErrSerializationFail = "40001"
+)
+
+type RetryOptions struct {
+	// Attempts is the max amount of runs of the transaction, 3 if 0
+	Attempts int
+	// Backoff is the delay before the first retry, it is doubled for every next one, 20ms if 0
+	Backoff time.Duration
+	// MaxBackoff caps the delay, 1s if 0
+	MaxBackoff time.Duration
+}
+
+// IsRetryable tells if the error is a deadlock or lock wait timeout of MySQL or PostgreSQL,
+// after which the transaction may succeed if run again
+func IsRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == mysqlErrDeadlock || mysqlErr.Number == mysqlErrLockWaitTimeout
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == pgErrDeadlock || pgErr.Code == pgErrLockNotAvailable ||
+			pgErr.Code == pgErrSerializationFail
+	}
+
+	return false
+}
+
+// TransactionRetry is Transaction running txFunc again while it fails with a retryable error.
+// txFunc must have no side effects besides the queries of the transaction.
+// Inside of an outer transaction it runs once, as a deadlock rolls back the outer transaction as well.
+func (dbConn *Conn) TransactionRetry(ctx context.Context, opts RetryOptions,
+	txFunc func(dbConn *Conn) error) error {
+
+	if opts.Attempts == 0 {
+		opts.Attempts = defaultRetryAttempts
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = defaultRetryBackoff
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = defaultRetryMaxBackoff
+	}
+
+	if dbConn.InTransaction() {
+		return dbConn.Transaction(ctx, txFunc)
+	}
+
+	backoff := opts.Backoff
+	for attempt := 1; ; attempt++ {
+		err := dbConn.Transaction(ctx, txFunc)
+		if err == nil || attempt >= opts.Attempts || !IsRetryable(err) {
+			return err
+		}
+
+		//NOTE: jitter keeps the transactions which failed on each other from colliding again
+		delay := backoff/2 + rand.N(backoff/2+1)
+		dbConn.Logger.Info("db.transaction.retry", "attempt", attempt, "delay", delay, "error", err.Error())
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+
+		backoff = min(backoff*2, opts.MaxBackoff)
+	}
+}
@@ -0,0 +1,124 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+	"testing"
+	"time"
+)
+
+var errDeadlock = &mysql.MySQLError{Number: mysqlErrDeadlock, Message: "Deadlock found when trying to get lock"}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"mysql deadlock", errDeadlock, true},
+		{"mysql lock wait timeout", &mysql.MySQLError{Number: mysqlErrLockWaitTimeout}, true},
+		{"mysql duplicate entry", &mysql.MySQLError{Number: 1062}, false},
+		{"pg deadlock", &pgconn.PgError{Code: pgErrDeadlock}, true},
+		{"pg lock not available", &pgconn.PgError{Code: pgErrLockNotAvailable}, true},
+		{"pg serialization failure", &pgconn.PgError{Code: pgErrSerializationFail}, true},
+		{"pg unique violation", &pgconn.PgError{Code: "23505"}, false},
+		{"wrapped mysql deadlock", fmt.Errorf("insert advert: %w", errDeadlock), true},
+		{"wrapped pg deadlock", fmt.Errorf("update: %w", &pgconn.PgError{Code: pgErrDeadlock}), true},
+		{"context deadline", context.DeadlineExceeded, false},
+		{"other error", errors.New("deadlock"), false},
+		{"nil", nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+// insertFailing inserts an item and fails with err for the first failures runs
+func insertFailing(calls *int, failures int, err error) func(dbConn *Conn) error {
+	return func(dbConn *Conn) error {
+		*calls++
+		_, insertErr := dbConn.InsertInto("test_item").Cols("id", "name", "price").Values(1, "chair", 10).
+			Exec(context.Background())
+		if insertErr != nil {
+			return insertErr
+		}
+		if *calls <= failures {
+			return err
+		}
+		return nil
+	}
+}
+
+func TestTransactionRetry(t *testing.T) {
+	ctx := context.Background()
+	opts := RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+
+	t.Run("succeeds after retryable errors", func(t *testing.T) {
+		dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+
+		calls := 0
+		if err := dbConn.TransactionRetry(ctx, opts, insertFailing(&calls, 2, errDeadlock)); err != nil {
+			t.Fatal(err)
+		}
+		if calls != 3 {
+			t.Errorf("calls = %d, want 3", calls)
+		}
+		//NOTE: the failed runs are rolled back, otherwise the insert of the last one fails
+		if items := loadTestItems(t, dbConn); len(items) != 1 {
+			t.Errorf("items = %d, want 1", len(items))
+		}
+	})
+
+	t.Run("gives up after the attempts", func(t *testing.T) {
+		dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+
+		calls := 0
+		err := dbConn.TransactionRetry(ctx, opts, insertFailing(&calls, 5, errDeadlock))
+		if !errors.Is(err, errDeadlock) || calls != 3 {
+			t.Errorf("err = %v, calls = %d, want %v after 3 calls", err, calls, errDeadlock)
+		}
+		if items := loadTestItems(t, dbConn); len(items) != 0 {
+			t.Errorf("items = %d, want 0", len(items))
+		}
+	})
+
+	t.Run("doesn't retry other errors", func(t *testing.T) {
+		dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+
+		calls := 0
+		failure := errors.New("invalid advert")
+		if err := dbConn.TransactionRetry(ctx, opts, insertFailing(&calls, 1, failure)); !errors.Is(err, failure) {
+			t.Errorf("err = %v, want %v", err, failure)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+	})
+
+	t.Run("runs once in a transaction", func(t *testing.T) {
+		dbConn := NewDbConn(newTestDB(t, 0).MainPool(), logr.Discard())
+
+		calls := 0
+		err := dbConn.Transaction(ctx, func(conn *Conn) error {
+			return conn.TransactionRetry(ctx, opts, insertFailing(&calls, 1, errDeadlock))
+		})
+		if !errors.Is(err, errDeadlock) {
+			t.Errorf("err = %v, want %v", err, errDeadlock)
+		}
+		if calls != 1 {
+			t.Errorf("calls = %d, want 1", calls)
+		}
+		if items := loadTestItems(t, dbConn); len(items) != 0 {
+			t.Errorf("items = %d, want 0", len(items))
+		}
+	})
+}
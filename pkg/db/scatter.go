@@ -0,0 +1,287 @@
+package db
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PartialPolicy decides whether failures of some shards fail the whole scatter query
+type PartialPolicy int
+
+const (
+	// PartialFail fails the query if any shard fails, the remaining shards are cancelled on the first failure
+	PartialFail PartialPolicy = iota
+	// PartialAllow returns rows of the succeeded shards whatever failed
+	PartialAllow
+	// PartialQuorum fails the query if less than ScatterOptions.MinShards shards succeeded
+	PartialQuorum
+)
+
+type ScatterOptions struct {
+	// Concurrency is the max amount of shards queried at once, all shards if 0
+	Concurrency int
+	// ShardTimeout bounds the query of every shard, no timeout if 0
+	ShardTimeout time.Duration
+	Partial      PartialPolicy
+	MinShards    int
+}
+
+// ShardFunc queries one shard. Shard ids start from 1.
+type ShardFunc[T any] func(ctx context.Context, shardId uint32, conn *Conn) ([]T, error)
+
+// ShardError is the failure of one shard of a scatter query
+type ShardError struct {
+	ShardId uint32
+	Alias   string
+	Err     error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %d (%s): %s", e.ShardId, e.Alias, e.Err)
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// ScatterError is returned when the failed shards break the partial policy
+type ScatterError struct {
+	Errors []*ShardError
+}
+
+func (e *ScatterError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return "scatter query failed: " + strings.Join(msgs, "; ")
+}
+
+func (e *ScatterError) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+var errShardCancelled = errors.New("cancelled after another shard failed")
+
+// ScatterResult holds rows by shard, the rows of shard N are at index N-1
+type ScatterResult[T any] struct {
+	Rows      [][]T
+	Errors    []*ShardError
+	Succeeded int
+}
+
+// All concatenates the rows of all shards in shard order
+func (r *ScatterResult[T]) All() []T {
+	var all []T
+	for _, rows := range r.Rows {
+		all = append(all, rows...)
+	}
+	return all
+}
+
+// Merge merge-sorts the rows of all shards and returns the page of them. Every shard must return
+// its rows ordered by less and at least offset+limit of them (see ShardLimit) for the page to be right.
+// Zero limit returns all rows after offset.
+func (r *ScatterResult[T]) Merge(less func(a, b T) bool, offset, limit int) []T {
+	return MergeSorted(r.Rows, less, offset, limit)
+}
+
+// ShardLimit is the amount of rows every shard must return to get the global page
+func ShardLimit(offset, limit int) int {
+	return offset + limit
+}
+
+// Scatter runs fn on all shards in parallel and gathers their rows. Shards hitting the timeout are
+// reported as failed at once, but fn keeps running and holds its concurrency slot until it returns,
+// so it should respect ctx.
+func Scatter[T any](ctx context.Context, d *DB, logger logr.Logger, opts ScatterOptions, fn ShardFunc[T]) (
+	*ScatterResult[T], error) {
+
+	shards := d.Shards()
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 || concurrency > len(shards) {
+		concurrency = len(shards)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	result := &ScatterResult[T]{Rows: make([][]T, len(shards))}
+	errs := make([]*ShardError, len(shards))
+
+	sem := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+
+	for i, pool := range shards {
+		shardId := uint32(i + 1)
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = &ShardError{ShardId: shardId, Alias: pool.alias, Err: context.Cause(ctx)}
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, shardId uint32, pool *Pool) {
+			defer wg.Done()
+
+			//NOTE: the slot is released when fn returns, timed out queries still use a connection
+			rows, err := queryShard(ctx, pool, logger, opts.ShardTimeout, shardId, fn, func() { <-sem })
+			if err != nil {
+				errs[i] = &ShardError{ShardId: shardId, Alias: pool.alias, Err: err}
+				if opts.Partial == PartialFail {
+					cancel(errShardCancelled)
+				}
+				return
+			}
+			result.Rows[i] = rows
+		}(i, shardId, pool)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+		}
+	}
+	result.Succeeded = len(shards) - len(result.Errors)
+
+	if len(result.Errors) > 0 {
+		logger.Error(&ScatterError{Errors: result.Errors}, "scatter.shards.failed",
+			"failed", len(result.Errors), "succeeded", result.Succeeded)
+	}
+
+	switch opts.Partial {
+	case PartialAllow:
+		return result, nil
+	case PartialQuorum:
+		if result.Succeeded >= opts.MinShards {
+			return result, nil
+		}
+	default:
+		if len(result.Errors) == 0 {
+			return result, nil
+		}
+	}
+
+	return result, &ScatterError{Errors: result.Errors}
+}
+
+// queryShard runs fn and calls release when it returns
+func queryShard[T any](ctx context.Context, pool *Pool, logger logr.Logger, timeout time.Duration,
+	shardId uint32, fn ShardFunc[T], release func()) ([]T, error) {
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type shardRows struct {
+		rows []T
+		err  error
+	}
+	done := make(chan shardRows, 1)
+
+	go func() {
+		defer release()
+
+		conn := NewDbConn(pool, logger)
+		defer conn.Rollback()
+
+		rows, err := fn(ctx, shardId, conn)
+		done <- shardRows{rows: rows, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.rows, r.err
+	case <-ctx.Done():
+		//NOTE: the cause tells the shards cancelled after another shard failure from the timed out ones
+		return nil, context.Cause(ctx)
+	}
+}
+
+// MergeSorted merges lists ordered by less skipping offset rows and returning at most limit rows,
+// zero limit returns all rows after offset
+func MergeSorted[T any](lists [][]T, less func(a, b T) bool, offset, limit int) []T {
+	h := &mergeHeap[T]{less: less}
+	for _, list := range lists {
+		if len(list) > 0 {
+			h.items = append(h.items, list)
+		}
+	}
+	heap.Init(h)
+
+	var merged []T
+	if limit > 0 {
+		merged = make([]T, 0, limit)
+	}
+
+	for skipped := 0; h.Len() > 0; {
+		list := h.items[0]
+		row := list[0]
+
+		if len(list) == 1 {
+			heap.Pop(h)
+		} else {
+			h.items[0] = list[1:]
+			heap.Fix(h, 0)
+		}
+
+		if skipped < offset {
+			skipped++
+			continue
+		}
+
+		merged = append(merged, row)
+		if limit > 0 && len(merged) == limit {
+			break
+		}
+	}
+
+	return merged
+}
+
+// mergeHeap orders the lists by their first rows
+type mergeHeap[T any] struct {
+	items [][]T
+	less  func(a, b T) bool
+}
+
+func (h *mergeHeap[T]) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap[T]) Less(i, j int) bool {
+	return h.less(h.items[i][0], h.items[j][0])
+}
+
+func (h *mergeHeap[T]) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap[T]) Push(x any) {
+	h.items = append(h.items, x.([]T))
+}
+
+func (h *mergeHeap[T]) Pop() any {
+	old := h.items
+	n := len(old)
+	item := old[n-1]
+	h.items = old[:n-1]
+	return item
+}
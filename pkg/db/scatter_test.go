@@ -0,0 +1,154 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"github.com/go-logr/logr"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errTestShard = errors.New("shard is down")
+
+func TestMergeSorted(t *testing.T) {
+	lists := [][]int{{1, 4, 7}, {}, {2, 5, 8}, {3, 6}}
+	less := func(a, b int) bool { return a < b }
+
+	tests := []struct {
+		name          string
+		offset, limit int
+		want          []int
+	}{
+		{name: "all", want: []int{1, 2, 3, 4, 5, 6, 7, 8}},
+		{name: "first page", limit: 3, want: []int{1, 2, 3}},
+		{name: "middle page", offset: 3, limit: 3, want: []int{4, 5, 6}},
+		{name: "last page", offset: 6, limit: 3, want: []int{7, 8}},
+		{name: "after offset", offset: 5, want: []int{6, 7, 8}},
+		{name: "past the end", offset: 10, limit: 3, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergeSorted(lists, less, tt.offset, tt.limit)
+			if len(got) != len(tt.want) || (len(got) > 0 && !reflect.DeepEqual(got, tt.want)) {
+				t.Errorf("merged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestScatterMergesShardPages(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDB(t, 3)
+
+	for i, alias := range shardAliases(3) {
+		dbConn := NewDbConn(d.getPoolByAlias(alias), logr.Discard())
+		for j := 0; j < 4; j++ {
+			//NOTE: prices interleave across the shards
+			_, err := dbConn.InsertInto("test_item").Cols("id", "name", "price").
+				Values(j+1, alias, j*3+i).Exec(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	offset, limit := 4, 3
+	res, err := Scatter(ctx, d, logr.Discard(), ScatterOptions{Concurrency: 2},
+		func(ctx context.Context, shardId uint32, conn *Conn) ([]*testItem, error) {
+			var items []*testItem
+			sb := conn.Select("id", "name", "price")
+			_, err := sb.From("test_item").OrderBy("price").Limit(ShardLimit(offset, limit)).
+				LoadStructs(ctx, &items)
+			return items, err
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	page := res.Merge(func(a, b *testItem) bool { return a.Price < b.Price }, offset, limit)
+	var prices []int
+	for _, item := range page {
+		prices = append(prices, item.Price)
+	}
+	if !reflect.DeepEqual(prices, []int{4, 5, 6}) {
+		t.Errorf("page prices = %v, want [4 5 6]", prices)
+	}
+	if res.Succeeded != 3 || len(res.All()) != 12 {
+		t.Errorf("succeeded %d with %d rows", res.Succeeded, len(res.All()))
+	}
+}
+
+func TestScatterPartialPolicies(t *testing.T) {
+	d := newTestDB(t, 3)
+	failSecond := func(ctx context.Context, shardId uint32, conn *Conn) ([]uint32, error) {
+		if shardId == 2 {
+			return nil, errTestShard
+		}
+		return []uint32{shardId}, nil
+	}
+
+	tests := []struct {
+		name    string
+		opts    ScatterOptions
+		wantErr bool
+	}{
+		{name: "fail", opts: ScatterOptions{Concurrency: 1}, wantErr: true},
+		{name: "allow", opts: ScatterOptions{Partial: PartialAllow}},
+		{name: "quorum", opts: ScatterOptions{Partial: PartialQuorum, MinShards: 2}},
+		{name: "no quorum", opts: ScatterOptions{Partial: PartialQuorum, MinShards: 3}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := Scatter(context.Background(), d, logr.Discard(), tt.opts, failSecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !errors.Is(err, errTestShard) && tt.wantErr {
+				t.Errorf("err = %v, want the shard error", err)
+			}
+
+			var shardErr *ShardError
+			if len(res.Errors) == 0 || !errors.As(res.Errors[0], &shardErr) || shardErr.ShardId != 2 {
+				t.Errorf("shard errors = %v, want the error of shard 2", res.Errors)
+			}
+		})
+	}
+}
+
+func TestScatterTimeoutHoldsSlot(t *testing.T) {
+	d := newTestDB(t, 3)
+
+	release := make(chan struct{})
+	var running, maxRunning atomic.Int32
+
+	res, err := Scatter(context.Background(), d, logr.Discard(),
+		ScatterOptions{Concurrency: 1, ShardTimeout: 10 * time.Millisecond, Partial: PartialAllow},
+		func(ctx context.Context, shardId uint32, conn *Conn) ([]uint32, error) {
+			n := running.Add(1)
+			defer running.Add(-1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+
+			//NOTE: the first shard ignores ctx and keeps running after its timeout
+			if shardId == 1 {
+				time.AfterFunc(50*time.Millisecond, func() { close(release) })
+				<-release
+			}
+			return []uint32{shardId}, nil
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Succeeded != 2 || !errors.Is(res.Errors[0], context.DeadlineExceeded) {
+		t.Errorf("succeeded %d, errors %v, want the first shard timed out", res.Succeeded, res.Errors)
+	}
+	if maxRunning.Load() != 1 {
+		t.Errorf("max running shards = %d, want the concurrency 1", maxRunning.Load())
+	}
+}
@@ -1,21 +1,23 @@
 package db
 
 import (
+	"context"
 	"github.com/huandu/go-sqlbuilder"
 	"reflect"
 )
 
 // SelectBuilder contains the clauses for a SELECT statement
 type SelectBuilder struct {
-	dbConn *Conn
-	origin *sqlbuilder.SelectBuilder
-	args   []interface{}
+	dbConn  *Conn
+	origin  *sqlbuilder.SelectBuilder
+	args    []interface{}
+	primary bool
 }
 
 // LoadStructs executes the SelectBuilder and loads the resulting data into a slice of structs
 // dest must be a pointer to a slice of pointers to structs
 // Returns the number of items found (which is not necessarily the # of items set)
-func (b *SelectBuilder) LoadStructs(dest interface{}) (int, error) {
+func (b *SelectBuilder) LoadStructs(ctx context.Context, dest interface{}) (int, error) {
 	// Validate the dest, and extract the reflection values we need.
 	valueOfDest := reflect.ValueOf(dest)
 	kindOfDest := valueOfDest.Kind()
@@ -43,22 +45,18 @@ func (b *SelectBuilder) LoadStructs(dest interface{}) (int, error) {
 		panic("Elements must to be pointers to structures")
 	}
 
-	sql, args := b.origin.Build()
-	if len(args) == 0 {
-		args = b.args
-	} else if len(b.args) != 0 {
-		args = append(b.args, args...)
-	}
+	sql, args := b.build()
 
-	runner := b.dbConn.getSelectRunner()
-	err := runner.Select(dest, sql, args...)
+	err := b.dbConn.query(ctx, b.primary, sql, args, func(ctx context.Context, runner selectRunner, query string) error {
+		return runner.SelectContext(ctx, dest, query, args...)
+	})
 
 	return valueOfDest.Len(), err
 }
 
 // LoadStruct executes the SelectBuilder and loads the resulting data into a struct
 // dest must be a pointer to a struct
-func (b *SelectBuilder) LoadStruct(dest interface{}) error {
+func (b *SelectBuilder) LoadStruct(ctx context.Context, dest interface{}) error {
 	// Validate the dest, and extract the reflection values we need.
 	valueOfDest := reflect.ValueOf(dest)
 	indirectOfDest := reflect.Indirect(valueOfDest)
@@ -68,22 +66,18 @@ func (b *SelectBuilder) LoadStruct(dest interface{}) error {
 		panic("you must pass in the address of a struct")
 	}
 
-	sql, args := b.origin.Build()
-	if len(args) == 0 {
-		args = b.args
-	} else if len(b.args) != 0 {
-		args = append(b.args, args...)
-	}
+	sql, args := b.build()
 
-	runner := b.dbConn.getSelectRunner()
-	err := runner.Get(dest, runner.Rebind(sql), args...)
+	err := b.dbConn.query(ctx, b.primary, sql, args, func(ctx context.Context, runner selectRunner, query string) error {
+		return runner.GetContext(ctx, dest, query, args...)
+	})
 
 	return err
 }
 
 // LoadValues executes the SelectBuilder and loads the resulting data into a slice of primitive values
 // Returns ErrNotFound if no value was found, and it was therefore not set.
-func (b *SelectBuilder) LoadValues(dest interface{}) (int, error) {
+func (b *SelectBuilder) LoadValues(ctx context.Context, dest interface{}) (int, error) {
 	// Validate the dest and reflection values we need
 
 	// This must be a pointer to a slice
@@ -102,21 +96,17 @@ func (b *SelectBuilder) LoadValues(dest interface{}) (int, error) {
 		panic("invalid type passed to LoadValues. Need a pointer to a slice")
 	}
 
-	sql, args := b.origin.Build()
-	if len(args) == 0 {
-		args = b.args
-	} else if len(b.args) != 0 {
-		args = append(b.args, args...)
-	}
+	sql, args := b.build()
 
-	runner := b.dbConn.getSelectRunner()
-	err := runner.Select(dest, sql, args...)
+	err := b.dbConn.query(ctx, b.primary, sql, args, func(ctx context.Context, runner selectRunner, query string) error {
+		return runner.SelectContext(ctx, dest, query, args...)
+	})
 
 	return valueOfDest.Len(), err
 }
 
 // LoadValue executes the SelectBuilder and loads the resulting data into a primitive value
-func (b *SelectBuilder) LoadValue(dest interface{}) error {
+func (b *SelectBuilder) LoadValue(ctx context.Context, dest interface{}) error {
 	// Validate the dest
 	valueOfDest := reflect.ValueOf(dest)
 	kindOfDest := valueOfDest.Kind()
@@ -125,34 +115,190 @@ func (b *SelectBuilder) LoadValue(dest interface{}) error {
 		panic("Destination must be a pointer")
 	}
 
-	sql, args := b.origin.Build()
-	if len(args) == 0 {
-		args = b.args
-	} else if len(b.args) != 0 {
-		args = append(b.args, args...)
-	}
+	sql, args := b.build()
 
-	runner := b.dbConn.getSelectRunner()
-	err := runner.Get(dest, sql, args...)
+	err := b.dbConn.query(ctx, b.primary, sql, args, func(ctx context.Context, runner selectRunner, query string) error {
+		return runner.GetContext(ctx, dest, query, args...)
+	})
 
 	return err
 }
 
+// build returns the statement with the arguments of the raw SQL followed by the builder ones
+func (b *SelectBuilder) build() (string, []interface{}) {
+	sql, args := b.origin.Build()
+	return sql, mergeArgs(b.args, args)
+}
+
+// Primary reads from the primary even if the connection reads from replicas,
+// for reads which must not lag behind writes of other connections
+func (b *SelectBuilder) Primary() *SelectBuilder {
+	b.primary = true
+	return b
+}
+
+func (b *SelectBuilder) Distinct() *SelectBuilder {
+	b.origin.Distinct()
+	return b
+}
+
 func (b *SelectBuilder) From(table ...string) *SelectBuilder {
 	b.origin.From(table...)
 	return b
 }
 
+// Join adds "JOIN table ON onExpr[0] AND onExpr[1] ..."
+func (b *SelectBuilder) Join(table string, onExpr ...string) *SelectBuilder {
+	b.origin.Join(table, onExpr...)
+	return b
+}
+
+// LeftJoin adds "LEFT JOIN table ON onExpr[0] AND onExpr[1] ..."
+func (b *SelectBuilder) LeftJoin(table string, onExpr ...string) *SelectBuilder {
+	b.origin.JoinWithOption(sqlbuilder.LeftJoin, table, onExpr...)
+	return b
+}
+
 func (b *SelectBuilder) Where(andExpr ...string) *SelectBuilder {
 	b.origin.Where(andExpr...)
 	return b
 }
 
+func (b *SelectBuilder) GroupBy(col ...string) *SelectBuilder {
+	b.origin.GroupBy(col...)
+	return b
+}
+
+func (b *SelectBuilder) Having(andExpr ...string) *SelectBuilder {
+	b.origin.Having(andExpr...)
+	return b
+}
+
+// OrderBy sets the ORDER BY columns, the direction is set by Asc/Desc or within the column expression
+func (b *SelectBuilder) OrderBy(col ...string) *SelectBuilder {
+	b.origin.OrderBy(col...)
+	return b
+}
+
+func (b *SelectBuilder) Asc() *SelectBuilder {
+	b.origin.Asc()
+	return b
+}
+
+func (b *SelectBuilder) Desc() *SelectBuilder {
+	b.origin.Desc()
+	return b
+}
+
 func (b *SelectBuilder) Limit(limit int) *SelectBuilder {
 	b.origin.Limit(limit)
 	return b
 }
 
+func (b *SelectBuilder) Offset(offset int) *SelectBuilder {
+	b.origin.Offset(offset)
+	return b
+}
+
+// ForUpdate locks the selected rows till the end of the transaction, so the query goes to the primary.
+// SQLite has no row locks and rejects the clause, its writing transactions lock the whole db instead.
+func (b *SelectBuilder) ForUpdate() *SelectBuilder {
+	if b.dbConn.getFlavor() != sqlbuilder.SQLite {
+		b.origin.ForUpdate()
+	}
+	b.primary = true
+	return b
+}
+
+// As returns "name AS alias"
+func (b *SelectBuilder) As(name, alias string) string {
+	return b.origin.As(name, alias)
+}
+
 func (b *SelectBuilder) Equal(field string, value interface{}) string {
 	return b.origin.Equal(field, value)
 }
+
+func (b *SelectBuilder) NotEqual(field string, value interface{}) string {
+	return b.origin.NotEqual(field, value)
+}
+
+func (b *SelectBuilder) GreaterThan(field string, value interface{}) string {
+	return b.origin.GreaterThan(field, value)
+}
+
+func (b *SelectBuilder) GreaterEqualThan(field string, value interface{}) string {
+	return b.origin.GreaterEqualThan(field, value)
+}
+
+func (b *SelectBuilder) LessThan(field string, value interface{}) string {
+	return b.origin.LessThan(field, value)
+}
+
+func (b *SelectBuilder) LessEqualThan(field string, value interface{}) string {
+	return b.origin.LessEqualThan(field, value)
+}
+
+// In returns "field IN (value...)", or an always false expression for no values
+func (b *SelectBuilder) In(field string, value ...interface{}) string {
+	if len(value) == 0 {
+		return "0 = 1"
+	}
+	return b.origin.In(field, value...)
+}
+
+// NotIn returns "field NOT IN (value...)", or an always true expression for no values
+func (b *SelectBuilder) NotIn(field string, value ...interface{}) string {
+	if len(value) == 0 {
+		return "1 = 1"
+	}
+	return b.origin.NotIn(field, value...)
+}
+
+func (b *SelectBuilder) Between(field string, lower, upper interface{}) string {
+	return b.origin.Between(field, lower, upper)
+}
+
+func (b *SelectBuilder) Like(field string, value interface{}) string {
+	return b.origin.Like(field, value)
+}
+
+func (b *SelectBuilder) NotLike(field string, value interface{}) string {
+	return b.origin.NotLike(field, value)
+}
+
+func (b *SelectBuilder) IsNull(field string) string {
+	return b.origin.IsNull(field)
+}
+
+func (b *SelectBuilder) IsNotNull(field string) string {
+	return b.origin.IsNotNull(field)
+}
+
+func (b *SelectBuilder) Or(orExpr ...string) string {
+	return b.origin.Or(orExpr...)
+}
+
+func (b *SelectBuilder) And(andExpr ...string) string {
+	return b.origin.And(andExpr...)
+}
+
+// DistanceSphere returns the expression of the distance in meters on the Earth sphere between the POINT column and p
+func (b *SelectBuilder) DistanceSphere(field string, p Point) string {
+	return "ST_Distance_Sphere(" + field + ", ST_GeomFromText(" + b.origin.Var(p.WKT()) + "))"
+}
+
+// WithinDistance returns "the POINT column is at most meters away from p"
+func (b *SelectBuilder) WithinDistance(field string, p Point, meters float64) string {
+	return b.DistanceSphere(field, p) + " <= " + b.origin.Var(meters)
+}
+
+// MBRContains returns "the geometry column is inside the box", which uses the spatial index
+func (b *SelectBuilder) MBRContains(box Box, field string) string {
+	return "MBRContains(ST_GeomFromText(" + b.origin.Var(box.WKT()) + "), " + field + ")"
+}
+
+// Var binds the value as an argument and returns its placeholder, for expressions without a helper
+func (b *SelectBuilder) Var(value interface{}) string {
+	return b.origin.Var(value)
+}
@@ -1,10 +1,27 @@
 package db
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Drivers registered by pkg/db, the driver of a spec is mysql if empty
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "pgx"
+	DriverSQLite   = "sqlite"
 )
 
 type Spec struct {
+	// Driver is mysql, pgx or sqlite, the name of sqlite spec is the path of the db file or :memory:
 	Driver             string `json:"driver"`
 	Host               string `json:"host"`
 	Port               int    `json:"port"`
@@ -15,6 +32,34 @@ type Spec struct {
 	MaxOpenCons        int    `json:"max_open_cons"`
 	ConnMaxLifetimeSec int    `json:"conn_max_lifetime_sec"`
 	ConnMaxIdleTimeSec int    `json:"conn_max_idle_time_sec"`
+	// Replicas serve reads outside of transactions, empty fields are taken from the primary spec
+	Replicas []Spec `json:"replicas"`
+	// QueryTimeoutMs bounds every query whose context has no deadline, no timeout if 0
+	QueryTimeoutMs int `json:"query_timeout_ms"`
+	// TxTimeoutMs bounds every transaction whose context has no deadline, no timeout if 0
+	TxTimeoutMs int `json:"tx_timeout_ms"`
+	// ReadYourWritesMs pins reads of a connection to the primary for this time after its last write
+	ReadYourWritesMs int `json:"read_your_writes_ms"`
+	// LogLevel 1 logs the SQL of every query, 2 adds the redacted arguments
+	LogLevel int `json:"log_level"`
+	// SlowQueryMs is the duration of a query to be logged and counted as slow, off if 0
+	SlowQueryMs int `json:"slow_query_ms"`
+	// Params are added to the DSN as is, e.g. sslmode for pgx or _pragma for sqlite
+	Params map[string]string `json:"params"`
+	// ConnectAttempts is the amount of pings on start before the db is reported unavailable, 5 if 0
+	ConnectAttempts int `json:"connect_attempts"`
+	// ConnectBackoffMs is the delay before the second ping, it is doubled for every next one, 500 if 0
+	ConnectBackoffMs int `json:"connect_backoff_ms"`
+}
+
+// UnmarshalJSON fails on unknown keys, so a typo in the settings doesn't leave a field empty
+func (s *Spec) UnmarshalJSON(data []byte) error {
+	type spec Spec
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+
+	return dec.Decode((*spec)(s))
 }
 
 type Settings map[string]Spec
@@ -27,6 +72,70 @@ const (
 	MainAlias Alias = "main"
 )
 
+// Validate checks the specs. Shard aliases must go from shard_01 without gaps, as shard ids are their numbers.
+func (s Settings) Validate() error {
+	var errs []error
+
+	if _, ok := s[string(MainAlias)]; !ok {
+		errs = append(errs, errors.New("no main db"))
+	}
+
+	shards := 0
+	for alias, spec := range s {
+		if strings.HasPrefix(alias, shardDbAliasPrefix) {
+			shards++
+		}
+
+		if err := spec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("db %s: %w", alias, err))
+		}
+		for i := range spec.Replicas {
+			if err := spec.replicaSpec(i).validate(); err != nil {
+				errs = append(errs, fmt.Errorf("db %s replica %d: %w", alias, i, err))
+			}
+		}
+	}
+
+	for shardId := uint(1); shardId <= uint(shards); shardId++ {
+		if _, ok := s[getShardAlias(shardId)]; !ok {
+			errs = append(errs, fmt.Errorf("%d shard dbs must be named from %s to %s",
+				shards, getShardAlias(1), getShardAlias(uint(shards))))
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s Spec) validate() error {
+	switch s.driver() {
+	case DriverMySQL:
+		if len(s.Host) == 0 {
+			return errors.New("no host")
+		}
+		if _, err := s.mysqlConfig(); err != nil {
+			return fmt.Errorf("params: %w", err)
+		}
+	case DriverPostgres:
+		if len(s.Host) == 0 {
+			return errors.New("no host")
+		}
+	case DriverSQLite:
+	default:
+		return fmt.Errorf("unknown driver \"%s\"", s.Driver)
+	}
+
+	if len(s.Name) == 0 {
+		return errors.New("no name")
+	}
+
+	if s.ConnectAttempts < 0 || s.ConnectBackoffMs < 0 || s.QueryTimeoutMs < 0 || s.TxTimeoutMs < 0 {
+		return errors.New("negative connect attempts, backoff or timeout")
+	}
+
+	return nil
+}
+
 func (s Settings) getMainDbSpec() Spec {
 	return s[string(MainAlias)]
 }
@@ -35,6 +144,143 @@ func (s Settings) getDbSpecByAlias(alias string) Spec {
 	return s[alias]
 }
 
+// replicaSpec fills the empty fields of the replica spec from the primary one
+func (s Spec) replicaSpec(i int) Spec {
+	r := s.Replicas[i]
+	r.Replicas = nil
+
+	if len(r.Driver) == 0 {
+		r.Driver = s.Driver
+	}
+	if len(r.Host) == 0 {
+		r.Host = s.Host
+	}
+	if r.Port == 0 {
+		r.Port = s.Port
+	}
+	if len(r.Username) == 0 {
+		r.Username = s.Username
+		r.Password = s.Password
+	}
+	if len(r.Name) == 0 {
+		r.Name = s.Name
+	}
+	if r.MaxIdleCons == 0 {
+		r.MaxIdleCons = s.MaxIdleCons
+	}
+	if r.MaxOpenCons == 0 {
+		r.MaxOpenCons = s.MaxOpenCons
+	}
+	if r.ConnMaxLifetimeSec == 0 {
+		r.ConnMaxLifetimeSec = s.ConnMaxLifetimeSec
+	}
+	if r.ConnMaxIdleTimeSec == 0 {
+		r.ConnMaxIdleTimeSec = s.ConnMaxIdleTimeSec
+	}
+	if r.QueryTimeoutMs == 0 {
+		r.QueryTimeoutMs = s.QueryTimeoutMs
+	}
+	if r.LogLevel == 0 {
+		r.LogLevel = s.LogLevel
+	}
+	if r.SlowQueryMs == 0 {
+		r.SlowQueryMs = s.SlowQueryMs
+	}
+	if r.Params == nil {
+		r.Params = s.Params
+	}
+	if r.ConnectAttempts == 0 {
+		r.ConnectAttempts = s.ConnectAttempts
+	}
+	if r.ConnectBackoffMs == 0 {
+		r.ConnectBackoffMs = s.ConnectBackoffMs
+	}
+
+	return r
+}
+
+func (s Spec) driver() string {
+	if len(s.Driver) == 0 {
+		return DriverMySQL
+	}
+	return s.Driver
+}
+
+// ConnStr returns the DSN of the spec in the syntax of its driver
 func (s Spec) ConnStr() string {
-	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s", s.Username, s.Password, s.Host, s.Port, s.Name)
+	switch s.driver() {
+	case DriverPostgres:
+		return s.postgresConnStr()
+	case DriverSQLite:
+		return s.sqliteConnStr()
+	}
+	return s.mysqlConnStr()
+}
+
+func (s Spec) mysqlConnStr() string {
+	cfg, err := s.mysqlConfig()
+	if err != nil {
+		//NOTE: the params are checked by validate
+		panic("invalid mysql params: " + err.Error())
+	}
+	return cfg.FormatDSN()
+}
+
+// mysqlConfig parses the params by the driver, so the known ones are checked and set as options
+func (s Spec) mysqlConfig() (*mysql.Config, error) {
+	cfg, err := mysql.ParseDSN("/?" + s.encodeParams())
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.User = s.Username
+	cfg.Passwd = s.Password
+	cfg.Net = "tcp"
+	cfg.Addr = s.Host
+	if s.Port != 0 {
+		cfg.Addr = net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	}
+	cfg.DBName = s.Name
+
+	return cfg, nil
+}
+
+func (s Spec) postgresConnStr() string {
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(s.Username, s.Password),
+		Host:     s.Host,
+		Path:     "/" + s.Name,
+		RawQuery: s.encodeParams(),
+	}
+	if s.Port != 0 {
+		u.Host += ":" + strconv.Itoa(s.Port)
+	}
+	return u.String()
+}
+
+func (s Spec) sqliteConnStr() string {
+	dsn := "file:" + s.Name
+	if len(s.Params) > 0 {
+		dsn += "?" + s.encodeParams()
+	}
+	return dsn
+}
+
+// encodeParams encodes the params ordered by name, a value may hold several values split by ";",
+// e.g. "busy_timeout(5000);foreign_keys(1)" of the sqlite _pragma
+func (s Spec) encodeParams() string {
+	names := make([]string, 0, len(s.Params))
+	for name := range s.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := url.Values{}
+	for _, name := range names {
+		for _, value := range strings.Split(s.Params[name], ";") {
+			values.Add(name, value)
+		}
+	}
+	return values.Encode()
 }
@@ -1,6 +1,99 @@
 package db
 
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+const (
+	wkbPoint = 1
+	// pointSize is the size of a point in the MySQL internal geometry format: SRID, byte order, type, X and Y
+	pointSize = 4 + 1 + 4 + 8 + 8
+)
+
+var ErrInvalidGeometry = errors.New("invalid geometry value")
+
+// Point is a POINT column value with SRID 0, longitude is X and latitude is Y
 type Point struct {
 	Longitude float64 `db:"longitude"`
 	Latitude  float64 `db:"latitude"`
 }
+
+// Value encodes the point in the MySQL internal geometry format, which is SRID followed by WKB
+func (p Point) Value() (driver.Value, error) {
+	buf := make([]byte, pointSize)
+	binary.LittleEndian.PutUint32(buf[0:4], 0)
+	buf[4] = 1 // little endian WKB
+	binary.LittleEndian.PutUint32(buf[5:9], wkbPoint)
+	binary.LittleEndian.PutUint64(buf[9:17], math.Float64bits(p.Longitude))
+	binary.LittleEndian.PutUint64(buf[17:25], math.Float64bits(p.Latitude))
+	return buf, nil
+}
+
+// Scan decodes the point from the MySQL internal geometry format
+func (p *Point) Scan(src interface{}) error {
+	data, ok := src.([]byte)
+	if !ok {
+		return fmt.Errorf("%w: can't scan %T into Point", ErrInvalidGeometry, src)
+	}
+
+	if len(data) != pointSize {
+		return fmt.Errorf("%w: point of %d bytes", ErrInvalidGeometry, len(data))
+	}
+
+	//NOTE: the SRID is little endian regardless of the WKB byte order
+	if srid := binary.LittleEndian.Uint32(data[0:4]); srid != 0 {
+		return fmt.Errorf("%w: SRID %d, only 0 is supported", ErrInvalidGeometry, srid)
+	}
+
+	var order binary.ByteOrder
+	switch data[4] {
+	case 0:
+		order = binary.BigEndian
+	case 1:
+		order = binary.LittleEndian
+	default:
+		return fmt.Errorf("%w: unknown byte order %d", ErrInvalidGeometry, data[4])
+	}
+
+	if geometryType := order.Uint32(data[5:9]); geometryType != wkbPoint {
+		return fmt.Errorf("%w: geometry type %d is not a point", ErrInvalidGeometry, geometryType)
+	}
+
+	p.Longitude = math.Float64frombits(order.Uint64(data[9:17]))
+	p.Latitude = math.Float64frombits(order.Uint64(data[17:25]))
+
+	return nil
+}
+
+// WKT returns the point as "POINT(longitude latitude)"
+func (p Point) WKT() string {
+	return "POINT(" + formatCoord(p.Longitude) + " " + formatCoord(p.Latitude) + ")"
+}
+
+// Box is a rectangle between the corners with the min and max coordinates
+type Box struct {
+	Min Point
+	Max Point
+}
+
+// WKT returns the box as a closed POLYGON
+func (b Box) WKT() string {
+	minX, minY := formatCoord(b.Min.Longitude), formatCoord(b.Min.Latitude)
+	maxX, maxY := formatCoord(b.Max.Longitude), formatCoord(b.Max.Latitude)
+
+	return "POLYGON((" +
+		minX + " " + minY + ", " +
+		maxX + " " + minY + ", " +
+		maxX + " " + maxY + ", " +
+		minX + " " + maxY + ", " +
+		minX + " " + minY + "))"
+}
+
+func formatCoord(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestPointRoundTrip(t *testing.T) {
+	for _, want := range []Point{{}, {Longitude: 37.6173, Latitude: 55.7558}, {Longitude: -180, Latitude: -90}} {
+		value, err := want.Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got Point
+		if err := got.Scan(value); err != nil {
+			t.Fatalf("scan of %v err = %v", want, err)
+		}
+		if got != want {
+			t.Errorf("scanned %v, want %v", got, want)
+		}
+	}
+}
+
+func TestPointValue(t *testing.T) {
+	//NOTE: SELECT ST_GeomFromText('POINT(1 -1)') on MySQL
+	want := "00000000" + "01" + "01000000" + "000000000000f03f" + "000000000000f0bf"
+
+	value, err := Point{Longitude: 1, Latitude: -1}.Value()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(value.([]byte)); got != want {
+		t.Errorf("value = %s, want %s", got, want)
+	}
+}
+
+func TestPointScan(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want Point
+		err  bool
+	}{
+		{name: "little endian", data: "00000000" + "01" + "01000000" + "000000000000f03f" + "000000000000f0bf",
+			want: Point{Longitude: 1, Latitude: -1}},
+		{name: "big endian", data: "00000000" + "00" + "00000001" + "3ff0000000000000" + "bff0000000000000",
+			want: Point{Longitude: 1, Latitude: -1}},
+		{name: "srid 4326", data: "e6100000" + "01" + "01000000" + "000000000000f03f" + "000000000000f0bf", err: true},
+		{name: "unknown byte order", data: "00000000" + "02" + "01000000" + "000000000000f03f" + "000000000000f0bf",
+			err: true},
+		{name: "linestring", data: "00000000" + "01" + "02000000" + "000000000000f03f" + "000000000000f0bf", err: true},
+		{name: "short", data: "00000000" + "01" + "01000000" + "000000000000f03f", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := hex.DecodeString(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got Point
+			err = got.Scan(data)
+			if tt.err {
+				if !errors.Is(err, ErrInvalidGeometry) {
+					t.Errorf("err = %v, want %v", err, ErrInvalidGeometry)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("scanned %v, %v, want %v", got, err, tt.want)
+			}
+		})
+	}
+
+	var p Point
+	if err := p.Scan("POINT(1 -1)"); !errors.Is(err, ErrInvalidGeometry) {
+		t.Errorf("scan of text err = %v, want %v", err, ErrInvalidGeometry)
+	}
+}
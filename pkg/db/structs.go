@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// structField is a struct field mapped to a column by its db tag
+type structField struct {
+	column string
+	index  []int
+}
+
+var structFieldsCache sync.Map // reflect.Type -> []structField
+
+// structFields returns the fields of the struct type with a db tag in declaration order,
+// fields tagged db:"-" are skipped, tag options after a comma are ignored like sqlx does.
+// The fields of embedded structs without a db tag are flattened, an outer field hides the embedded one
+// of the same column like Go fields do.
+func structFields(t reflect.Type) []structField {
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.([]structField)
+	}
+
+	var fields []structField
+	positions := make(map[string]int)
+	for _, f := range collectFields(t, nil) {
+		if i, ok := positions[f.column]; ok {
+			if len(f.index) < len(fields[i].index) {
+				fields[i] = f
+			}
+			continue
+		}
+		positions[f.column] = len(fields)
+		fields = append(fields, f)
+	}
+
+	structFieldsCache.Store(t, fields)
+
+	return fields
+}
+
+func collectFields(t reflect.Type, parent []int) []structField {
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		index := append(slices.Clone(parent), i)
+		tag, tagged := f.Tag.Lookup("db")
+
+		if f.Anonymous && !tagged {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer && f.IsExported() {
+				embedded = embedded.Elem()
+			}
+			//NOTE: exported fields of an unexported embedded struct are promoted, unlike the ones of its pointer
+			if embedded.Kind() == reflect.Struct {
+				fields = append(fields, collectFields(embedded, index)...)
+				continue
+			}
+		}
+
+		if !f.IsExported() || !tagged {
+			continue
+		}
+
+		column, _, _ := strings.Cut(tag, ",")
+		if column == "" || column == "-" {
+			continue
+		}
+
+		fields = append(fields, structField{column: column, index: index})
+	}
+	return fields
+}
+
+// fieldValue returns the value of the field, nil if it is in a nil embedded struct pointer
+func fieldValue(v reflect.Value, f structField) interface{} {
+	field, err := v.FieldByIndexErr(f.index)
+	if err != nil {
+		return nil
+	}
+	return field.Interface()
+}
+
+// structValue dereferences the pointer to a struct
+func structValue(value interface{}) reflect.Value {
+	v := reflect.Indirect(reflect.ValueOf(value))
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("struct or pointer to struct expected, got %T", value))
+	}
+	return v
+}
+
+// StructColumns returns the columns of the struct by its db tags
+func StructColumns(value interface{}) []string {
+	fields := structFields(structValue(value).Type())
+
+	columns := make([]string, len(fields))
+	for i, f := range fields {
+		columns[i] = f.column
+	}
+	return columns
+}
+
+// structValues returns the values of the columns, all tagged columns if none passed
+func structValues(v reflect.Value, columns []string) []interface{} {
+	fields := structFields(v.Type())
+
+	if len(columns) == 0 {
+		values := make([]interface{}, len(fields))
+		for i, f := range fields {
+			values[i] = fieldValue(v, f)
+		}
+		return values
+	}
+
+	values := make([]interface{}, len(columns))
+	for i, column := range columns {
+		found := false
+		for _, f := range fields {
+			if f.column == column {
+				values[i] = fieldValue(v, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			panic(fmt.Sprintf("%s has no field tagged db:\"%s\"", v.Type(), column))
+		}
+	}
+	return values
+}
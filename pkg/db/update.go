@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"github.com/huandu/go-sqlbuilder"
 )
@@ -12,17 +13,9 @@ type UpdateBuilder struct {
 	args   []interface{}
 }
 
-func (b *UpdateBuilder) Exec() (sql.Result, error) {
+func (b *UpdateBuilder) Exec(ctx context.Context) (sql.Result, error) {
 	sql, args := b.origin.Build()
-
-	if len(args) == 0 {
-		args = b.args
-	} else if len(b.args) != 0 {
-		args = append(b.args, args...)
-	}
-
-	runner := b.dbConn.getExecRunner()
-	return runner.NamedExec(sql, args)
+	return b.dbConn.exec(ctx, sql, mergeArgs(b.args, args))
 }
 
 func (b *UpdateBuilder) Set(value ...string) *UpdateBuilder {
@@ -44,6 +37,25 @@ func (b *UpdateBuilder) Assign(field string, value interface{}) string {
 	return b.origin.Assign(field, value)
 }
 
+func (b *UpdateBuilder) LessThan(field string, value interface{}) string {
+	return b.origin.LessThan(field, value)
+}
+
 func (b *UpdateBuilder) Equal(field string, value interface{}) string {
 	return b.origin.Equal(field, value)
 }
+
+// SetStruct assigns the columns to the values of the struct fields by their db tags,
+// all tagged columns if none passed
+func (b *UpdateBuilder) SetStruct(value interface{}, col ...string) *UpdateBuilder {
+	if len(col) == 0 {
+		col = StructColumns(value)
+	}
+
+	values := structValues(structValue(value), col)
+	assignments := make([]string, len(col))
+	for i, c := range col {
+		assignments[i] = b.Assign(c, values[i])
+	}
+	return b.Set(assignments...)
+}
@@ -0,0 +1,151 @@
+package idgen
+
+import (
+	"errors"
+	"fmt"
+	"pkg/rd"
+	"sync"
+	"time"
+)
+
+// An id is laid out as
+//
+//	0 | 41 bits of milliseconds since Epoch | 8 bits of shard | 5 bits of node | 9 bits of sequence
+//
+// so ids are unique across nodes, roughly ordered by time and carry the shard they were allocated on.
+const (
+	timeBits     = 41
+	shardBits    = 8
+	nodeBits     = 5
+	sequenceBits = 9
+
+	MaxShardId = 1<<shardBits - 1
+	MaxNodeId  = 1<<nodeBits - 1
+
+	maxSequence = 1<<sequenceBits - 1
+	maxTime     = 1<<timeBits - 1
+
+	nodeShift  = sequenceBits
+	shardShift = sequenceBits + nodeBits
+	timeShift  = sequenceBits + nodeBits + shardBits
+
+	// clock drift we are ready to wait out instead of failing
+	maxBackwardDrift = 10 * time.Millisecond
+)
+
+// Epoch is 2024-01-01T00:00:00Z
+var Epoch = time.UnixMilli(1704067200000)
+
+var (
+	ErrInvalidShard  = errors.New("shard id is out of range")
+	ErrInvalidNode   = errors.New("node id is out of range")
+	ErrClockBackward = errors.New("clock moved backwards")
+	ErrTimeOverflow  = errors.New("time is out of the id range")
+)
+
+// Settings: node id must be unique for every running instance, Lease makes sure of it
+type Settings struct {
+	// NodeId is the node id leased by the instance, any free one is leased if it is negative
+	NodeId int `json:"node_id"`
+	// LeaseTtlSec is how long the node id stays leased by an instance which died without releasing it, 30 if 0
+	LeaseTtlSec int `json:"lease_ttl_sec"`
+}
+
+type Generator struct {
+	mu       sync.Mutex
+	nodeId   uint64
+	lastTime int64
+	sequence uint64
+	lease    *rd.Lock
+	now      func() time.Time
+}
+
+func New(s Settings) (*Generator, error) {
+	if s.NodeId < 0 || s.NodeId > MaxNodeId {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidNode, s.NodeId)
+	}
+
+	return &Generator{nodeId: uint64(s.NodeId), now: time.Now}, nil
+}
+
+// Next allocates a new id on the shard
+func (g *Generator) Next(shardId uint32) (uint64, error) {
+	if shardId > MaxShardId {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidShard, shardId)
+	}
+
+	if err := g.checkLease(); err != nil {
+		return 0, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	ms, err := g.tick()
+	if err != nil {
+		return 0, err
+	}
+
+	if ms == g.lastTime {
+		g.sequence = (g.sequence + 1) & maxSequence
+		if g.sequence == 0 {
+			//NOTE: sequence is exhausted for this millisecond, waiting for the next one
+			for ms <= g.lastTime {
+				time.Sleep(100 * time.Microsecond)
+				ms = g.elapsed()
+			}
+		}
+	} else {
+		g.sequence = 0
+	}
+
+	g.lastTime = ms
+
+	return uint64(ms)<<timeShift | uint64(shardId)<<shardShift | g.nodeId<<nodeShift | g.sequence, nil
+}
+
+func (g *Generator) tick() (int64, error) {
+	ms := g.elapsed()
+
+	if ms < g.lastTime {
+		drift := time.Duration(g.lastTime-ms) * time.Millisecond
+		if drift > maxBackwardDrift {
+			return 0, fmt.Errorf("%w by %v", ErrClockBackward, drift)
+		}
+		time.Sleep(drift)
+		ms = g.elapsed()
+		if ms < g.lastTime {
+			return 0, fmt.Errorf("%w by %v", ErrClockBackward, drift)
+		}
+	}
+
+	if ms > maxTime {
+		return 0, ErrTimeOverflow
+	}
+
+	return ms, nil
+}
+
+func (g *Generator) elapsed() int64 {
+	return g.now().Sub(Epoch).Milliseconds()
+}
+
+// NodeId is the node of the ids allocated by the generator
+func (g *Generator) NodeId() int {
+	return int(g.nodeId)
+}
+
+// ShardOf returns the shard the id was allocated on
+func ShardOf(id uint64) uint32 {
+	return uint32(id >> shardShift & MaxShardId)
+}
+
+// NodeOf returns the node which allocated the id
+func NodeOf(id uint64) int {
+	return int(id >> nodeShift & MaxNodeId)
+}
+
+// TimeOf returns the allocation time of the id
+func TimeOf(id uint64) time.Time {
+	return Epoch.Add(time.Duration(id>>timeShift) * time.Millisecond)
+}
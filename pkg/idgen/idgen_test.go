@@ -0,0 +1,184 @@
+package idgen
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var testTime = Epoch.Add(1234567 * time.Millisecond)
+
+// fixedClock returns at for the first calls and then a millisecond later
+func fixedClock(at time.Time, calls int) func() time.Time {
+	n := 0
+	return func() time.Time {
+		n++
+		if n > calls {
+			return at.Add(time.Millisecond)
+		}
+		return at
+	}
+}
+
+func newTestGenerator(t *testing.T, nodeId int, now func() time.Time) *Generator {
+	t.Helper()
+
+	g, err := New(Settings{NodeId: nodeId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.now = now
+	return g
+}
+
+func TestLayout(t *testing.T) {
+	g := newTestGenerator(t, 21, fixedClock(testTime, 1000))
+
+	id, err := g.Next(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := uint64(1234567)<<22 | uint64(200)<<14 | uint64(21)<<9
+	if id != want {
+		t.Errorf("id = %064b, want %064b", id, want)
+	}
+	if id>>63 != 0 {
+		t.Error("sign bit is set")
+	}
+
+	if shardId := ShardOf(id); shardId != 200 {
+		t.Errorf("ShardOf = %d, want 200", shardId)
+	}
+	if nodeId := NodeOf(id); nodeId != 21 {
+		t.Errorf("NodeOf = %d, want 21", nodeId)
+	}
+	if at := TimeOf(id); !at.Equal(testTime) {
+		t.Errorf("TimeOf = %v, want %v", at, testTime)
+	}
+}
+
+func TestMaxFields(t *testing.T) {
+	g := newTestGenerator(t, MaxNodeId, fixedClock(Epoch.Add(maxTime*time.Millisecond), 1000))
+
+	id, err := g.Next(MaxShardId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 1<<63-1-maxSequence {
+		t.Errorf("id = %064b, want all bits but the sign and sequence", id)
+	}
+	if ShardOf(id) != MaxShardId || NodeOf(id) != MaxNodeId {
+		t.Errorf("shard %d, node %d, want %d, %d", ShardOf(id), NodeOf(id), MaxShardId, MaxNodeId)
+	}
+}
+
+func TestInvalidSettings(t *testing.T) {
+	if _, err := New(Settings{NodeId: MaxNodeId + 1}); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("node out of range err = %v, want %v", err, ErrInvalidNode)
+	}
+
+	g := newTestGenerator(t, 0, fixedClock(testTime, 1000))
+	if _, err := g.Next(MaxShardId + 1); !errors.Is(err, ErrInvalidShard) {
+		t.Errorf("shard out of range err = %v, want %v", err, ErrInvalidShard)
+	}
+}
+
+func TestSequenceOverflow(t *testing.T) {
+	//NOTE: the clock stands still for all ids of the sequence and the first id over it
+	g := newTestGenerator(t, 1, fixedClock(testTime, maxSequence+2))
+
+	var last uint64
+	for i := 0; i <= maxSequence; i++ {
+		id, err := g.Next(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && id <= last {
+			t.Fatalf("id %d is not greater than the previous one", i)
+		}
+		if seq := id & maxSequence; seq != uint64(i) {
+			t.Fatalf("sequence of id %d = %d", i, seq)
+		}
+		last = id
+	}
+
+	id, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= last {
+		t.Error("id over the sequence is not greater than the previous one")
+	}
+	if at := TimeOf(id); !at.Equal(testTime.Add(time.Millisecond)) {
+		t.Errorf("id over the sequence is of %v, want the next millisecond", at)
+	}
+	if seq := id & maxSequence; seq != 0 {
+		t.Errorf("sequence = %d, want 0", seq)
+	}
+}
+
+func TestClockBackward(t *testing.T) {
+	now := testTime
+	g := newTestGenerator(t, 1, func() time.Time { return now })
+
+	first, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now = testTime.Add(-maxBackwardDrift - time.Millisecond)
+	if _, err := g.Next(1); !errors.Is(err, ErrClockBackward) {
+		t.Errorf("err = %v, want %v", err, ErrClockBackward)
+	}
+
+	//NOTE: the clock doesn't catch up while the drift is waited out
+	now = testTime.Add(-time.Millisecond)
+	if _, err := g.Next(1); !errors.Is(err, ErrClockBackward) {
+		t.Errorf("err of a small drift = %v, want %v", err, ErrClockBackward)
+	}
+
+	now = testTime
+	id, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= first {
+		t.Error("id after the clock is back is not greater than the previous one")
+	}
+}
+
+func TestSmallBackwardDriftIsWaitedOut(t *testing.T) {
+	calls := 0
+	g := newTestGenerator(t, 1, func() time.Time {
+		calls++
+		switch calls {
+		case 1:
+			return testTime
+		case 2:
+			return testTime.Add(-time.Millisecond)
+		}
+		return testTime.Add(time.Millisecond)
+	})
+
+	first, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id <= first {
+		t.Error("id after the drift is not greater than the previous one")
+	}
+}
+
+func TestTimeOverflow(t *testing.T) {
+	g := newTestGenerator(t, 1, fixedClock(Epoch.Add((maxTime+1)*time.Millisecond), 1000))
+
+	if _, err := g.Next(1); !errors.Is(err, ErrTimeOverflow) {
+		t.Errorf("err = %v, want %v", err, ErrTimeOverflow)
+	}
+}
@@ -0,0 +1,74 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"pkg/rd"
+	"time"
+)
+
+const defaultLeaseTtlSec = 30
+
+var (
+	ErrNoFreeNode = errors.New("no free node id to lease")
+	ErrLeaseLost  = errors.New("node id lease is lost")
+)
+
+// Lease leases the node id of the settings in redis for the generator, any free node id if it is negative.
+// Instances leasing the same node id fail, so no two running instances generate ids of the same node.
+// The lease is extended until the generator is closed, the generator fails once the lease is lost.
+func Lease(pool *rd.Pool, prefix string, s Settings) (*Generator, error) {
+	if s.NodeId > MaxNodeId {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidNode, s.NodeId)
+	}
+	if s.LeaseTtlSec == 0 {
+		s.LeaseTtlSec = defaultLeaseTtlSec
+	}
+	opts := rd.LockOptions{Ttl: time.Duration(s.LeaseTtlSec) * time.Second}
+
+	nodeIds := []int{s.NodeId}
+	if s.NodeId < 0 {
+		nodeIds = make([]int, MaxNodeId+1)
+		for i := range nodeIds {
+			nodeIds[i] = i
+		}
+	}
+
+	for _, nodeId := range nodeIds {
+		lease, err := rd.TryLock(context.Background(), pool, fmt.Sprintf("%s%d", prefix, nodeId), opts)
+		if errors.Is(err, rd.ErrLockNotAcquired) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return &Generator{nodeId: uint64(nodeId), lease: lease, now: time.Now}, nil
+	}
+
+	if s.NodeId >= 0 {
+		return nil, fmt.Errorf("%w: node id %d is leased by another instance", ErrNoFreeNode, s.NodeId)
+	}
+	return nil, ErrNoFreeNode
+}
+
+// checkLease fails once the lease is lost or released, another instance may lease the node id then
+func (g *Generator) checkLease() error {
+	if g.lease == nil || g.lease.Context().Err() == nil {
+		return nil
+	}
+
+	if err := g.lease.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrLeaseLost, err)
+	}
+	return ErrLeaseLost
+}
+
+// Close releases the lease of the node id
+func (g *Generator) Close() error {
+	if g.lease == nil {
+		return nil
+	}
+	return g.lease.Release()
+}
@@ -0,0 +1,108 @@
+package idgen
+
+import (
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"pkg/rd"
+	"testing"
+	"time"
+)
+
+const testLeasePrefix = "test:id_node:"
+
+func newTestLeasePool(t *testing.T) (*rd.Pool, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	pool := rd.OpenPool(rd.Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, logr.Discard())
+	t.Cleanup(pool.Close)
+
+	return pool, mr
+}
+
+func lease(t *testing.T, pool *rd.Pool, s Settings) *Generator {
+	t.Helper()
+
+	g, err := Lease(pool, testLeasePrefix, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { g.Close() })
+	return g
+}
+
+func TestLeaseFreeNodeIds(t *testing.T) {
+	pool, _ := newTestLeasePool(t)
+
+	leased := make(map[int]bool)
+	for i := 0; i <= MaxNodeId; i++ {
+		g := lease(t, pool, Settings{NodeId: -1})
+		if leased[g.NodeId()] {
+			t.Fatalf("node id %d is leased twice", g.NodeId())
+		}
+		leased[g.NodeId()] = true
+	}
+
+	if _, err := Lease(pool, testLeasePrefix, Settings{NodeId: -1}); !errors.Is(err, ErrNoFreeNode) {
+		t.Errorf("lease of all node ids leased err = %v, want %v", err, ErrNoFreeNode)
+	}
+}
+
+func TestLeasePinnedNodeId(t *testing.T) {
+	pool, _ := newTestLeasePool(t)
+
+	g := lease(t, pool, Settings{NodeId: 3})
+	id, err := g.Next(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeId := NodeOf(id); nodeId != 3 {
+		t.Errorf("NodeOf = %d, want 3", nodeId)
+	}
+
+	//NOTE: a second instance started with the same node id must not start
+	if _, err := Lease(pool, testLeasePrefix, Settings{NodeId: 3}); !errors.Is(err, ErrNoFreeNode) {
+		t.Errorf("lease of a leased node id err = %v, want %v", err, ErrNoFreeNode)
+	}
+	if _, err := Lease(pool, testLeasePrefix, Settings{NodeId: MaxNodeId + 1}); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("lease of an out of range node id err = %v, want %v", err, ErrInvalidNode)
+	}
+
+	if err := g.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Next(1); !errors.Is(err, ErrLeaseLost) {
+		t.Errorf("Next after close err = %v, want %v", err, ErrLeaseLost)
+	}
+
+	other := lease(t, pool, Settings{NodeId: 3})
+	if other.NodeId() != 3 {
+		t.Errorf("released node id leased as %d, want 3", other.NodeId())
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	pool, mr := newTestLeasePool(t)
+
+	g := lease(t, pool, Settings{NodeId: 5, LeaseTtlSec: 1})
+	if _, err := g.Next(1); err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: the lease expired while the instance was paused and was taken by another instance
+	mr.Del(testLeasePrefix + "5")
+	lease(t, pool, Settings{NodeId: 5})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, err := g.Next(1)
+		if errors.Is(err, ErrLeaseLost) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Next with the lost lease err = %v, want %v", err, ErrLeaseLost)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package lru
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetAdd(t *testing.T) {
+	c := New[int, string](2)
+
+	if _, ok := c.Get(1); ok {
+		t.Fatal("empty cache has a value")
+	}
+
+	c.Add(1, "a", 0)
+	c.Add(1, "b", 0)
+	if v, ok := c.Get(1); !ok || v != "b" {
+		t.Errorf("value = %q, %v, want the updated one", v, ok)
+	}
+	if c.Len() != 1 {
+		t.Errorf("len = %d, want 1", c.Len())
+	}
+}
+
+func TestEviction(t *testing.T) {
+	c := New[int, string](2)
+
+	c.Add(1, "a", 0)
+	c.Add(2, "b", 0)
+	//NOTE: the read makes 1 recently used, so 2 is evicted
+	c.Get(1)
+	c.Add(3, "c", 0)
+
+	if _, ok := c.Get(2); ok {
+		t.Error("least recently used value is not evicted")
+	}
+	for _, key := range []int{1, 3} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("value %d is evicted", key)
+		}
+	}
+
+	//NOTE: an update makes 1 recently used too
+	c.Add(1, "a", 0)
+	c.Add(4, "d", 0)
+	if _, ok := c.Get(3); ok {
+		t.Error("value not updated is not evicted")
+	}
+	if c.Len() != 2 {
+		t.Errorf("len = %d, want 2", c.Len())
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	c := New[int, string](2)
+
+	c.Add(1, "a", time.Millisecond)
+	c.Add(2, "b", 0)
+	time.Sleep(5 * time.Millisecond)
+
+	if _, ok := c.Get(1); ok {
+		t.Error("expired value is returned")
+	}
+	if _, ok := c.Get(2); !ok {
+		t.Error("value without ttl expired")
+	}
+	if c.Len() != 1 {
+		t.Errorf("len = %d, want the expired value dropped", c.Len())
+	}
+}
+
+func TestRemovePurge(t *testing.T) {
+	c := New[int, string](0)
+
+	c.Add(1, "a", 0)
+	c.Add(2, "b", 0)
+	if c.Len() != 1 {
+		t.Fatalf("len = %d, want size 1 for a non positive size", c.Len())
+	}
+
+	c.Remove(2)
+	c.Remove(3)
+	if c.Len() != 0 {
+		t.Errorf("len after remove = %d, want 0", c.Len())
+	}
+
+	c.Add(1, "a", 0)
+	c.Purge()
+	if _, ok := c.Get(1); ok || c.Len() != 0 {
+		t.Error("value is kept after purge")
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"github.com/segmentio/kafka-go"
 )
 
-type Consumer struct {
+// KafkaConsumer reads the messages of the consumer group from the kafka brokers
+type KafkaConsumer struct {
 	ctx            context.Context
 	brokers        []string
 	settings       ConsumerSpec
@@ -18,12 +19,10 @@ type Consumer struct {
 	messages       chan *kafka.Message
 }
 
-type MessageHandler interface {
-	Handle(logger logr.Logger, m *kafka.Message) error
-}
+func NewKafkaConsumer(ctx context.Context, settings Settings, logger logr.Logger,
+	messageHandler MessageHandler) *KafkaConsumer {
 
-func NewConsumer(ctx context.Context, settings Settings, logger logr.Logger, messageHandler MessageHandler) *Consumer {
-	c := &Consumer{
+	c := &KafkaConsumer{
 		ctx:            ctx,
 		settings:       settings.Consumer,
 		brokers:        settings.Brokers,
@@ -39,7 +38,7 @@ func NewConsumer(ctx context.Context, settings Settings, logger logr.Logger, mes
 	return c
 }
 
-func (c *Consumer) setupReader() {
+func (c *KafkaConsumer) setupReader() {
 	config := kafka.ReaderConfig{
 		Brokers:     c.brokers,
 		GroupID:     c.settings.GroupId,
@@ -49,7 +48,7 @@ func (c *Consumer) setupReader() {
 	c.reader = kafka.NewReader(config)
 }
 
-func (c *Consumer) read() {
+func (c *KafkaConsumer) read() {
 	defer close(c.messages)
 	for {
 		select {
@@ -67,17 +66,17 @@ func (c *Consumer) read() {
 	}
 }
 
-func (c *Consumer) Close() {
+func (c *KafkaConsumer) Close() {
 	close(c.stop)
 }
 
-func (c *Consumer) createWorkers() {
+func (c *KafkaConsumer) createWorkers() {
 	for i := 0; i < c.settings.WorkersAmount; i++ {
 		go c.handle()
 	}
 }
 
-func (c *Consumer) handle() {
+func (c *KafkaConsumer) handle() {
 	for {
 		select {
 		case <-c.stop:
@@ -93,7 +92,7 @@ func (c *Consumer) handle() {
 	}
 }
 
-func (c *Consumer) handleMessage(m *kafka.Message) {
+func (c *KafkaConsumer) handleMessage(m *kafka.Message) {
 	err := c.messageHandler.Handle(c.logger, m)
 	if err != nil {
 		c.logger.Error(err, fmt.Sprintf("error of handling message: \"%v\".", *m))
@@ -8,17 +8,18 @@ import (
 	"time"
 )
 
-type Producer struct {
+// KafkaProducer writes the messages to the kafka brokers
+type KafkaProducer struct {
 	brokers  []string
 	settings ProducerSpec
 }
 
-func NewProducer(settings Settings) *Producer {
-	pool := &Producer{settings: settings.Producer, brokers: settings.Brokers}
+func NewKafkaProducer(settings Settings) *KafkaProducer {
+	pool := &KafkaProducer{settings: settings.Producer, brokers: settings.Brokers}
 	return pool
 }
 
-func (p *Producer) SendMessage(ctx context.Context, topic string, key string, value interface{}) error {
+func (p *KafkaProducer) SendMessage(ctx context.Context, topic string, key string, value interface{}) error {
 	writer := p.createWriter()
 	defer writer.Close()
 
@@ -36,7 +37,7 @@ func (p *Producer) SendMessage(ctx context.Context, topic string, key string, va
 	return writeMessage(ctx, writer, time.Duration(p.settings.ConnMaxLifetimeSec)*time.Second, msg)
 }
 
-func (p *Producer) SendMessages(ctx context.Context, topics []string, key string, value interface{}) error {
+func (p *KafkaProducer) SendMessages(ctx context.Context, topics []string, key string, value interface{}) error {
 	writer := p.createWriter()
 	defer writer.Close()
 
@@ -58,7 +59,10 @@ func (p *Producer) SendMessages(ctx context.Context, topics []string, key string
 	return writeMessage(ctx, writer, time.Duration(p.settings.ConnMaxLifetimeSec)*time.Second, msgs...)
 }
 
-func (p *Producer) createWriter() *kafka.Writer {
+// Close does nothing, a writer is created for every send
+func (p *KafkaProducer) Close() {}
+
+func (p *KafkaProducer) createWriter() *kafka.Writer {
 	w := kafka.Writer{
 		Addr:     kafka.TCP(p.brokers...),
 		Balancer: &kafka.LeastBytes{},
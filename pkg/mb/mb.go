@@ -0,0 +1,52 @@
+package mb
+
+import (
+	"context"
+	"github.com/go-logr/logr"
+	"github.com/segmentio/kafka-go"
+)
+
+const (
+	BackendKafka = "kafka"
+	BackendRedis = "redis"
+)
+
+// Producer sends the values encoded to JSON to the topics
+type Producer interface {
+	SendMessage(ctx context.Context, topic string, key string, value interface{}) error
+	SendMessages(ctx context.Context, topics []string, key string, value interface{}) error
+	Close()
+}
+
+// Consumer passes the messages of the topics to the handler and acknowledges the handled ones,
+// the failed ones are delivered again
+type Consumer interface {
+	Close()
+}
+
+// MessageHandler handles the messages of all backends as kafka messages
+type MessageHandler interface {
+	Handle(logger logr.Logger, m *kafka.Message) error
+}
+
+// NewProducer creates the producer of the backend of the settings, kafka by default
+func NewProducer(settings Settings, logger logr.Logger) Producer {
+	switch settings.Backend {
+	case "", BackendKafka:
+		return NewKafkaProducer(settings)
+	case BackendRedis:
+		return NewRedisProducer(settings, logger)
+	}
+	panic("unknown message broker backend: " + settings.Backend)
+}
+
+// NewConsumer creates the consumer of the backend of the settings, kafka by default
+func NewConsumer(ctx context.Context, settings Settings, logger logr.Logger, messageHandler MessageHandler) Consumer {
+	switch settings.Backend {
+	case "", BackendKafka:
+		return NewKafkaConsumer(ctx, settings, logger, messageHandler)
+	case BackendRedis:
+		return NewRedisConsumer(ctx, settings, logger, messageHandler)
+	}
+	panic("unknown message broker backend: " + settings.Backend)
+}
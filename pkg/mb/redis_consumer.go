@@ -0,0 +1,424 @@
+package mb
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+	"os"
+	"pkg/rd"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	streamFieldKey   = "key"
+	streamFieldValue = "value"
+	// streamFieldId and streamFieldDeliveries tell the origin of a dead letter
+	streamFieldId         = "id"
+	streamFieldDeliveries = "deliveries"
+
+	streamRetryDelay = time.Second
+)
+
+// RedisConsumer reads the redis streams of the topics as a member of the stream group.
+// Handled messages are acknowledged, failed ones stay pending and are reclaimed by any member
+// of the group after ReclaimIdleSec, so they are delivered again like uncommitted kafka messages.
+// Messages failed MaxDeliveries times are moved to the dead letter stream of the topic.
+type RedisConsumer struct {
+	ctx            context.Context
+	spec           RedisSpec
+	settings       ConsumerSpec
+	logger         logr.Logger
+	messageHandler MessageHandler
+	pool           *rd.Pool
+	name           string
+	stop           chan struct{}
+	messages       chan *streamMessage
+	wg             sync.WaitGroup
+}
+
+type streamMessage struct {
+	id      string
+	stream  string
+	message *kafka.Message
+}
+
+func NewRedisConsumer(ctx context.Context, settings Settings, logger logr.Logger,
+	messageHandler MessageHandler) *RedisConsumer {
+
+	c := &RedisConsumer{
+		ctx:            ctx,
+		spec:           settings.Redis.withDefaults(),
+		settings:       settings.Consumer,
+		logger:         logger.WithName("[message broker][consumer]"),
+		messageHandler: messageHandler,
+		name:           consumerName(),
+		stop:           make(chan struct{}),
+		messages:       make(chan *streamMessage, settings.Consumer.WorkersAmount),
+	}
+	c.pool = rd.OpenPool(c.spec.server("consumer"), c.logger)
+
+	if err := c.createGroups(); err != nil {
+		//NOTE: the groups are created again when reading fails without them
+		c.logger.Error(err, "Can't create stream groups")
+	}
+
+	c.createWorkers()
+	//NOTE: one XREADGROUP can't read streams of several slots in a redis cluster
+	for _, streams := range c.pool.SlotGroups(c.streams()) {
+		c.run(func() { c.read(streams) })
+	}
+	c.run(c.reclaim)
+
+	return c
+}
+
+// consumerName tells the members of a group apart in XINFO CONSUMERS
+func consumerName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// Close stops reading and waits for the handled messages, a blocked read ends in BlockMs
+func (c *RedisConsumer) Close() {
+	close(c.stop)
+	c.wg.Wait()
+	c.pool.Close()
+}
+
+func (c *RedisConsumer) streams() []string {
+	streams := make([]string, len(c.settings.Topics))
+	for i, topic := range c.settings.Topics {
+		streams[i] = c.spec.stream(topic)
+	}
+	return streams
+}
+
+func (c *RedisConsumer) createGroups() error {
+	for _, topic := range c.settings.Topics {
+		//NOTE: a new group gets the messages added after it is created
+		_, err := c.pool.Do("XGROUP", "CREATE", c.spec.stream(topic), c.settings.GroupId, "$", "MKSTREAM")
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return errors.Wrapf(err, "can't create group of topic %s", topic)
+		}
+	}
+	return nil
+}
+
+func (c *RedisConsumer) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	case <-c.ctx.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps for the delay, false if the consumer is stopped meanwhile
+func (c *RedisConsumer) wait(delay time.Duration) bool {
+	select {
+	case <-c.stop:
+		return false
+	case <-c.ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+func (c *RedisConsumer) push(messages []*streamMessage) bool {
+	for _, m := range messages {
+		select {
+		case <-c.stop:
+			return false
+		case <-c.ctx.Done():
+			return false
+		case c.messages <- m:
+		}
+	}
+	return true
+}
+
+func (c *RedisConsumer) read(streams []string) {
+	for !c.stopped() {
+		messages, err := c.readNew(streams)
+		if err != nil {
+			c.logger.Error(err, "Can't read streams")
+			if strings.HasPrefix(errors.Cause(err).Error(), "NOGROUP") {
+				if err := c.createGroups(); err != nil {
+					c.logger.Error(err, "Can't create stream groups")
+				}
+			}
+			if !c.wait(streamRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		if !c.push(messages) {
+			return
+		}
+	}
+}
+
+// readNew waits up to BlockMs for the messages of the streams never delivered to the group,
+// the streams must be in one slot in a redis cluster
+func (c *RedisConsumer) readNew(streams []string) ([]*streamMessage, error) {
+	args := []interface{}{"GROUP", c.settings.GroupId, c.name, "COUNT", c.spec.BatchSize, "BLOCK", c.spec.BlockMs,
+		"STREAMS"}
+	for _, stream := range streams {
+		args = append(args, stream)
+	}
+	for range streams {
+		args = append(args, ">")
+	}
+
+	conn, err := c.pool.GetContext(c.ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	//NOTE: the read timeout of the server is counted from the end of the blocking
+	timeout := time.Duration(0)
+	if c.spec.Server.ReadTimeoutMs > 0 {
+		timeout = time.Duration(c.spec.BlockMs+c.spec.Server.ReadTimeoutMs) * time.Millisecond
+	}
+
+	reply, err := redis.DoWithTimeout(conn, timeout, "XREADGROUP", args...)
+	if err == redis.ErrNil || (err == nil && reply == nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	replies, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var messages []*streamMessage
+	for _, s := range replies {
+		// [stream, [entry...]]
+		fields, err := redis.Values(s, nil)
+		if err != nil || len(fields) != 2 {
+			return nil, errors.Errorf("unexpected XREADGROUP reply %v", s)
+		}
+		stream, _ := redis.String(fields[0], nil)
+
+		entries, err := c.parseEntries(stream, fields[1])
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, entries...)
+	}
+
+	return messages, nil
+}
+
+func (c *RedisConsumer) reclaim() {
+	interval := time.Duration(c.spec.ReclaimIntervalSec) * time.Second
+	for c.wait(interval) {
+		for _, topic := range c.settings.Topics {
+			if err := c.reclaimStream(c.spec.stream(topic)); err != nil {
+				c.logger.Error(err, "Can't reclaim pending messages", "topic", topic)
+			}
+		}
+	}
+}
+
+// reclaimStream takes over the messages pending longer than ReclaimIdleSec, e.g. failed ones
+// or the ones of a consumer which died
+func (c *RedisConsumer) reclaimStream(stream string) error {
+	minIdleMs := c.spec.ReclaimIdleSec * 1000
+
+	for start := "0-0"; !c.stopped(); {
+		// [next start, [entry...], [deleted id...]]
+		reply, err := redis.Values(c.pool.Do("XAUTOCLAIM", stream, c.settings.GroupId, c.name, minIdleMs, start,
+			"COUNT", c.spec.BatchSize))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(reply) < 2 {
+			return errors.Errorf("unexpected XAUTOCLAIM reply %v", reply)
+		}
+
+		messages, err := c.parseEntries(stream, reply[1])
+		if err != nil {
+			return err
+		}
+		if messages, err = c.dropDeadLetters(stream, messages); err != nil {
+			return err
+		}
+		if len(messages) > 0 {
+			c.logger.Info("Reclaimed pending messages", "stream", stream, "amount", len(messages))
+		}
+		if !c.push(messages) {
+			return nil
+		}
+
+		if start, _ = redis.String(reply[0], nil); start == "0-0" {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// dropDeadLetters moves the claimed messages delivered more than MaxDeliveries times to the dead letter stream
+// and returns the other ones
+func (c *RedisConsumer) dropDeadLetters(stream string, messages []*streamMessage) ([]*streamMessage, error) {
+	if len(messages) == 0 {
+		return messages, nil
+	}
+
+	deliveries, err := c.deliveries(stream, messages[0].id, messages[len(messages)-1].id)
+	if err != nil {
+		return nil, err
+	}
+
+	alive := messages[:0]
+	for _, m := range messages {
+		if deliveries[m.id] <= c.spec.MaxDeliveries {
+			alive = append(alive, m)
+			continue
+		}
+
+		deadStream := stream + c.spec.DeadLetterSuffix
+		_, err := c.pool.Do("XADD", deadStream, "MAXLEN", "~", c.spec.MaxLen, "*",
+			streamFieldKey, m.message.Key, streamFieldValue, m.message.Value,
+			streamFieldId, m.id, streamFieldDeliveries, deliveries[m.id])
+		if err != nil {
+			//NOTE: the message stays pending and is moved by the next reclaim
+			c.logger.Error(err, "Can't move message to dead letter stream", "stream", stream, "id", m.id)
+			continue
+		}
+
+		c.logger.Info("Moved message to dead letter stream", "stream", stream, "id", m.id,
+			"dead_stream", deadStream, "deliveries", deliveries[m.id])
+		c.ack(stream, m.id)
+	}
+
+	return alive, nil
+}
+
+// deliveries returns the delivery counts of the messages pending on the consumer by id in the id range.
+// The messages missing in a crowded range are handled again and counted by the next reclaim.
+func (c *RedisConsumer) deliveries(stream, start, end string) (map[string]int64, error) {
+	// [[id, consumer, idle ms, deliveries]...]
+	reply, err := redis.Values(c.pool.Do("XPENDING", stream, c.settings.GroupId, start, end, c.spec.BatchSize,
+		c.name))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	deliveries := make(map[string]int64, len(reply))
+	for _, p := range reply {
+		fields, err := redis.Values(p, nil)
+		if err != nil || len(fields) != 4 {
+			return nil, errors.Errorf("unexpected XPENDING entry %v", p)
+		}
+		id, _ := redis.String(fields[0], nil)
+		deliveries[id], _ = redis.Int64(fields[3], nil)
+	}
+
+	return deliveries, nil
+}
+
+// parseEntries converts the stream entries [id, [field, value...]] to messages. The entries trimmed
+// from the stream while pending have no fields, they are acknowledged to drop them from the pending ones.
+func (c *RedisConsumer) parseEntries(stream string, reply interface{}) ([]*streamMessage, error) {
+	entries, err := redis.Values(reply, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	messages := make([]*streamMessage, 0, len(entries))
+	for _, e := range entries {
+		entry, err := redis.Values(e, nil)
+		if err != nil || len(entry) != 2 {
+			return nil, errors.Errorf("unexpected stream entry %v", e)
+		}
+		id, _ := redis.String(entry[0], nil)
+
+		fields, _ := redis.StringMap(entry[1], nil)
+		if fields == nil {
+			c.ack(stream, id)
+			continue
+		}
+
+		messages = append(messages, &streamMessage{
+			id:     id,
+			stream: stream,
+			message: &kafka.Message{
+				Topic: strings.TrimPrefix(stream, c.spec.StreamPrefix),
+				Key:   []byte(fields[streamFieldKey]),
+				Value: []byte(fields[streamFieldValue]),
+				Time:  entryTime(id),
+			},
+		})
+	}
+
+	return messages, nil
+}
+
+// entryTime is the time of adding the entry, the ids are <unix ms>-<seq>
+func entryTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	n, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(n)
+}
+
+func (c *RedisConsumer) run(f func()) {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+}
+
+func (c *RedisConsumer) createWorkers() {
+	for i := 0; i < c.settings.WorkersAmount; i++ {
+		c.run(c.handle)
+	}
+}
+
+func (c *RedisConsumer) handle() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.ctx.Done():
+			return
+		case m := <-c.messages:
+			c.handleMessage(m)
+		}
+	}
+}
+
+func (c *RedisConsumer) handleMessage(m *streamMessage) {
+	err := c.messageHandler.Handle(c.logger, m.message)
+	if err != nil {
+		c.logger.Error(err, fmt.Sprintf("error of handling message: \"%v\".", *m.message), "id", m.id)
+		return
+	}
+
+	c.ack(m.stream, m.id)
+}
+
+func (c *RedisConsumer) ack(stream, id string) {
+	if _, err := c.pool.Do("XACK", stream, c.settings.GroupId, id); err != nil {
+		c.logger.Error(err, "failed to ack message", "stream", stream, "id", id)
+	}
+}
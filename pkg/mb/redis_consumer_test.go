@@ -0,0 +1,112 @@
+package mb
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"pkg/rd"
+	"testing"
+)
+
+const (
+	testTopic = "photos"
+	testGroup = "advertd"
+)
+
+// newTestRedisConsumer reclaims the messages of the topic at once, no workers handle them
+func newTestRedisConsumer(t *testing.T) (*RedisConsumer, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	spec := RedisSpec{Server: rd.Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, StreamPrefix: "mb:"}.
+		withDefaults()
+	spec.ReclaimIdleSec = 0
+	spec.MaxDeliveries = 2
+
+	c := &RedisConsumer{
+		ctx:      context.Background(),
+		spec:     spec,
+		settings: ConsumerSpec{GroupId: testGroup, Topics: []string{testTopic}},
+		logger:   logr.Discard(),
+		name:     "test",
+		stop:     make(chan struct{}),
+		messages: make(chan *streamMessage, 10),
+	}
+	c.pool = rd.OpenPool(spec.server("consumer"), logr.Discard())
+	t.Cleanup(c.pool.Close)
+
+	if err := c.createGroups(); err != nil {
+		t.Fatal(err)
+	}
+
+	return c, mr
+}
+
+func TestReclaimMovesPoisonMessageToDeadLetters(t *testing.T) {
+	c, _ := newTestRedisConsumer(t)
+	stream := c.spec.stream(testTopic)
+
+	id, err := redis.String(c.pool.Do("XADD", stream, "*", streamFieldKey, "7", streamFieldValue, `{"advert_id":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages, err := c.readNew(c.streams())
+	if err != nil || len(messages) != 1 {
+		t.Fatalf("read %d messages, err %v, want 1", len(messages), err)
+	}
+
+	//NOTE: the handler keeps failing, the message is delivered again till MaxDeliveries
+	if err := c.reclaimStream(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.messages) != 1 {
+		t.Fatalf("reclaimed %d messages, want 1", len(c.messages))
+	}
+	<-c.messages
+
+	if err := c.reclaimStream(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.messages) != 0 {
+		t.Errorf("reclaimed %d messages over max deliveries, want 0", len(c.messages))
+	}
+
+	pending, err := redis.Values(c.pool.Do("XPENDING", stream, testGroup, "-", "+", 10))
+	//NOTE: miniredis replies nil instead of an empty list
+	if (err != nil && err != redis.ErrNil) || len(pending) != 0 {
+		t.Errorf("pending %v, err %v, want the dead letter acknowledged", pending, err)
+	}
+
+	dead, err := redis.Values(c.pool.Do("XRANGE", stream+c.spec.DeadLetterSuffix, "-", "+"))
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("dead letters %d, err %v, want 1", len(dead), err)
+	}
+	entry, _ := redis.Values(dead[0], nil)
+	fields, _ := redis.StringMap(entry[1], nil)
+	if fields[streamFieldId] != id || fields[streamFieldKey] != "7" || fields[streamFieldDeliveries] != "3" {
+		t.Errorf("dead letter fields = %v, want the message %s delivered 3 times", fields, id)
+	}
+}
+
+func TestReclaimKeepsMessagesUnderMaxDeliveries(t *testing.T) {
+	c, _ := newTestRedisConsumer(t)
+	stream := c.spec.stream(testTopic)
+
+	for i := 0; i < 3; i++ {
+		if _, err := c.pool.Do("XADD", stream, "*", streamFieldKey, "7", streamFieldValue, "{}"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.readNew(c.streams()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.reclaimStream(stream); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.messages) != 3 {
+		t.Errorf("reclaimed %d messages, want 3", len(c.messages))
+	}
+}
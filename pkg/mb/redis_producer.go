@@ -0,0 +1,106 @@
+package mb
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/pkg/errors"
+	"pkg/rd"
+)
+
+const (
+	defaultStreamMaxLen       = 100000
+	defaultStreamBatchSize    = 10
+	defaultStreamBlockMs      = 2000
+	defaultReclaimIdleSec     = 60
+	defaultReclaimIntervalSec = 30
+	defaultMaxDeliveries      = 5
+	defaultDeadLetterSuffix   = ":dead"
+)
+
+// RedisProducer adds the messages to the redis streams of the topics
+type RedisProducer struct {
+	spec RedisSpec
+	pool *rd.Pool
+}
+
+func NewRedisProducer(settings Settings, logger logr.Logger) *RedisProducer {
+	spec := settings.Redis.withDefaults()
+	return &RedisProducer{
+		spec: spec,
+		pool: rd.OpenPool(spec.server("producer"), logger.WithName("[message broker][producer]")),
+	}
+}
+
+func (p *RedisProducer) SendMessage(ctx context.Context, topic string, key string, value interface{}) error {
+	return p.SendMessages(ctx, []string{topic}, key, value)
+}
+
+func (p *RedisProducer) SendMessages(ctx context.Context, topics []string, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	conn, err := p.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, topic := range topics {
+		conn.Send("XADD", p.spec.stream(topic), "MAXLEN", "~", p.spec.MaxLen, "*",
+			streamFieldKey, key, streamFieldValue, data)
+	}
+	if err := rd.Flush(conn); err != nil {
+		return err
+	}
+
+	for _, topic := range topics {
+		if _, err := conn.Receive(); err != nil {
+			return errors.Wrapf(err, "can't add message to stream of topic %s", topic)
+		}
+	}
+
+	return nil
+}
+
+func (p *RedisProducer) Close() {
+	p.pool.Close()
+}
+
+func (s RedisSpec) withDefaults() RedisSpec {
+	if s.MaxLen == 0 {
+		s.MaxLen = defaultStreamMaxLen
+	}
+	if s.BatchSize == 0 {
+		s.BatchSize = defaultStreamBatchSize
+	}
+	if s.BlockMs == 0 {
+		s.BlockMs = defaultStreamBlockMs
+	}
+	if s.ReclaimIdleSec == 0 {
+		s.ReclaimIdleSec = defaultReclaimIdleSec
+	}
+	if s.ReclaimIntervalSec == 0 {
+		s.ReclaimIntervalSec = defaultReclaimIntervalSec
+	}
+	if s.MaxDeliveries == 0 {
+		s.MaxDeliveries = defaultMaxDeliveries
+	}
+	if len(s.DeadLetterSuffix) == 0 {
+		s.DeadLetterSuffix = defaultDeadLetterSuffix
+	}
+	return s
+}
+
+// server tells the pools of the producer and consumer apart in the logs and metrics
+func (s RedisSpec) server(role string) rd.Spec {
+	server := s.Server
+	server.Prefix += "_" + role
+	return server
+}
+
+func (s RedisSpec) stream(topic string) string {
+	return s.StreamPrefix + topic
+}
@@ -1,5 +1,7 @@
 package mb
 
+import "pkg/rd"
+
 type ProducerSpec struct {
 	SendRetries        int      `json:"send_retries"`
 	ConnMaxLifetimeSec int      `json:"conn_max_lifetime_sec"`
@@ -18,8 +20,33 @@ type ConsumerSpec struct {
 	Topics             []string `json:"topics"`
 }
 
+// RedisSpec configures the redis streams backend, a topic is a stream and a consumer group is a stream group
+type RedisSpec struct {
+	Server rd.Spec `json:"server"`
+	// StreamPrefix is prepended to the topics
+	StreamPrefix string `json:"stream_prefix"`
+	// MaxLen trims the streams approximately to the last messages, 100000 if 0
+	MaxLen int64 `json:"max_len"`
+	// BatchSize is the max amount of messages read at once, 10 if 0
+	BatchSize int `json:"batch_size"`
+	// BlockMs is how long a read waits for new messages, 2000 if 0
+	BlockMs int `json:"block_ms"`
+	// ReclaimIdleSec is how long a message stays unacknowledged before other consumers take it over, 60 if 0
+	ReclaimIdleSec int `json:"reclaim_idle_sec"`
+	// ReclaimIntervalSec is the period of looking for the unacknowledged messages, 30 if 0
+	ReclaimIntervalSec int `json:"reclaim_interval_sec"`
+	// MaxDeliveries is how many times a message is delivered before it is moved to the dead letter stream
+	// of its topic, 5 if 0
+	MaxDeliveries int64 `json:"max_deliveries"`
+	// DeadLetterSuffix is appended to the stream of the topic to name its dead letter stream, ":dead" if empty
+	DeadLetterSuffix string `json:"dead_letter_suffix"`
+}
+
 type Settings struct {
+	// Backend is kafka or redis, kafka if empty
+	Backend  string       `json:"backend"`
 	Brokers  []string     `json:"brokers"`
+	Redis    RedisSpec    `json:"redis"`
 	Producer ProducerSpec `json:"producer"`
 	Consumer ConsumerSpec `json:"consumer"`
 }
@@ -0,0 +1,410 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-logr/logr"
+	"pkg/db"
+	"time"
+)
+
+const (
+	table     = "schema_migrations"
+	lockTable = "schema_migrations_lock"
+
+	defaultLockTtl = time.Hour
+)
+
+var (
+	ErrChecksumMismatch  = errors.New("applied migration was changed")
+	ErrUnknownVersion    = errors.New("applied migration has no file")
+	ErrNoDown            = errors.New("migration has no down file")
+	ErrLocked            = errors.New("migrations are locked by another migrator")
+	ErrUnsupportedDriver = errors.New("migrations are not supported by driver")
+)
+
+// genericTables are the tables of the drivers taking the standard types
+var genericTables = []string{
+	"CREATE TABLE IF NOT EXISTS " + table + " (" +
+		"version bigint NOT NULL PRIMARY KEY, " +
+		"name varchar(255) NOT NULL, " +
+		"checksum char(64) NOT NULL, " +
+		"applied_at bigint NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS " + lockTable + " (" +
+		"id smallint NOT NULL PRIMARY KEY, " +
+		"owner varchar(32) NOT NULL, " +
+		"locked_until bigint NOT NULL)",
+}
+
+// tablesByDriver creates the migrations and the lock tables
+var tablesByDriver = map[string][]string{
+	db.DriverMySQL: {
+		"CREATE TABLE IF NOT EXISTS `" + table + "` (" +
+			"`version` int(10) unsigned NOT NULL, " +
+			"`name` varchar(255) NOT NULL, " +
+			"`checksum` char(64) NOT NULL, " +
+			"`applied_at` int(10) unsigned NOT NULL, " +
+			"PRIMARY KEY (`version`)" +
+			") CHARACTER SET utf8 COLLATE utf8_general_ci ENGINE=InnoDB",
+		"CREATE TABLE IF NOT EXISTS `" + lockTable + "` (" +
+			"`id` tinyint(3) unsigned NOT NULL, " +
+			"`owner` varchar(32) NOT NULL, " +
+			"`locked_until` int(10) unsigned NOT NULL, " +
+			"PRIMARY KEY (`id`)" +
+			") CHARACTER SET utf8 COLLATE utf8_general_ci ENGINE=InnoDB",
+	},
+	db.DriverPostgres: genericTables,
+	db.DriverSQLite:   genericTables,
+}
+
+// tableExistsByDriver counts the tables of the current database by name
+var tableExistsByDriver = map[string]string{
+	db.DriverMySQL: "SELECT COUNT(*) FROM information_schema.tables " +
+		"WHERE table_schema = DATABASE() AND table_name = ?",
+	db.DriverPostgres: "SELECT COUNT(*) FROM information_schema.tables " +
+		"WHERE table_schema = current_schema() AND table_name = ?",
+	db.DriverSQLite: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
+}
+
+// Applied is a row of the migrations table
+type Applied struct {
+	Version   uint32 `db:"version"`
+	Name      string `db:"name"`
+	Checksum  string `db:"checksum"`
+	AppliedAt uint32 `db:"applied_at"`
+}
+
+// Status is a migration with its applied row, nil if pending
+type Status struct {
+	Migration *Migration
+	Applied   *Applied
+}
+
+type Options struct {
+	// DryRun logs the statements instead of running them
+	DryRun bool
+	// LockTtl is how long the migrations stay locked by a migrator which died, 1 hour if 0.
+	// The lock is extended after every migration, so one migration must run shorter.
+	LockTtl time.Duration
+}
+
+// Migrator applies migrations to one database, the applied versions are kept in the schema_migrations table.
+// Migrators changing the database take the lock row of the schema_migrations_lock table, so they run one by one.
+// MySQL commits DDL implicitly, so a failed migration is not rolled back and must be fixed by hand.
+type Migrator struct {
+	conn   *db.Conn
+	logger logr.Logger
+	opts   Options
+	owner  string
+}
+
+func New(conn *db.Conn, logger logr.Logger, opts Options) *Migrator {
+	if opts.LockTtl == 0 {
+		opts.LockTtl = defaultLockTtl
+	}
+
+	owner := make([]byte, 16)
+	rand.Read(owner)
+
+	return &Migrator{conn: conn, logger: logger, opts: opts, owner: hex.EncodeToString(owner)}
+}
+
+// Status checks the applied migrations against the files and returns the state of every migration
+func (m *Migrator) Status(ctx context.Context, migrations []*Migration) ([]*Status, error) {
+	applied, err := m.loadApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]*Status, 0, len(migrations))
+	for _, migration := range migrations {
+		row, ok := applied[migration.Version]
+		if ok {
+			if row.Checksum != migration.Checksum {
+				return nil, fmt.Errorf("%w: %s", ErrChecksumMismatch, migration)
+			}
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, &Status{Migration: migration, Applied: row})
+	}
+
+	for version, row := range applied {
+		return nil, fmt.Errorf("%w: %03d_%s", ErrUnknownVersion, version, row.Name)
+	}
+
+	return statuses, nil
+}
+
+// Up applies the pending migrations in version order and returns them
+func (m *Migrator) Up(ctx context.Context, migrations []*Migration) ([]*Migration, error) {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	statuses, err := m.Status(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+	for _, status := range statuses {
+		if status.Applied != nil {
+			continue
+		}
+
+		if err := m.run(ctx, status.Migration, status.Migration.Up); err != nil {
+			return done, err
+		}
+
+		if err := m.markApplied(ctx, status.Migration); err != nil {
+			return done, err
+		}
+
+		done = append(done, status.Migration)
+
+		if err := m.extendLock(ctx); err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+// Down reverts the last steps applied migrations and returns them
+func (m *Migrator) Down(ctx context.Context, migrations []*Migration, steps int) ([]*Migration, error) {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	statuses, err := m.Status(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+	for i := len(statuses) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := statuses[i].Migration
+		if statuses[i].Applied == nil {
+			continue
+		}
+
+		if !migration.HasDown() {
+			return done, fmt.Errorf("%w: %s", ErrNoDown, migration)
+		}
+
+		if err := m.run(ctx, migration, migration.Down); err != nil {
+			return done, err
+		}
+
+		if err := m.markReverted(ctx, migration); err != nil {
+			return done, err
+		}
+
+		done = append(done, migration)
+
+		if err := m.extendLock(ctx); err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+// Baseline marks the migrations up to the version as applied without running them,
+// for databases created before the migrations were tracked
+func (m *Migrator) Baseline(ctx context.Context, migrations []*Migration, version uint32) ([]*Migration, error) {
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	statuses, err := m.Status(ctx, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []*Migration
+	for _, status := range statuses {
+		if status.Migration.Version > version {
+			break
+		}
+		if status.Applied != nil {
+			continue
+		}
+
+		if err := m.markApplied(ctx, status.Migration); err != nil {
+			return done, err
+		}
+
+		done = append(done, status.Migration)
+	}
+
+	return done, nil
+}
+
+func (m *Migrator) run(ctx context.Context, migration *Migration, script string) error {
+	statements := splitStatements(script)
+
+	for i, statement := range statements {
+		if m.opts.DryRun {
+			m.logger.Info("Dry run", "migration", migration.String(), "statement", statement)
+			continue
+		}
+
+		if _, err := m.conn.ExecBySQL(ctx, statement); err != nil {
+			return fmt.Errorf("migration %s failed on statement %d of %d: %w", migration, i+1, len(statements), err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) checkDriver() error {
+	if _, ok := tablesByDriver[m.conn.Driver()]; !ok {
+		return fmt.Errorf("%w \"%s\"", ErrUnsupportedDriver, m.conn.Driver())
+	}
+	return nil
+}
+
+func (m *Migrator) ensureTable(ctx context.Context) error {
+	if err := m.checkDriver(); err != nil {
+		return err
+	}
+	if m.opts.DryRun {
+		return nil
+	}
+
+	for _, statement := range tablesByDriver[m.conn.Driver()] {
+		if _, err := m.conn.ExecBySQL(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *Migrator) loadApplied(ctx context.Context) (map[uint32]*Applied, error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	var rows []*Applied
+	if !m.opts.DryRun || m.tableExists(ctx) {
+		_, err := m.conn.Select("version", "name", "checksum", "applied_at").From(table).Primary().
+			LoadStructs(ctx, &rows)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applied := make(map[uint32]*Applied, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+
+	return applied, nil
+}
+
+func (m *Migrator) tableExists(ctx context.Context) bool {
+	var exists int
+	err := m.conn.SelectBySQL(tableExistsByDriver[m.conn.Driver()], table).Primary().LoadValue(ctx, &exists)
+	return err == nil && exists > 0
+}
+
+// lock takes the lock row unless it is held by another migrator, dry runs don't lock
+func (m *Migrator) lock(ctx context.Context) (unlock func(), err error) {
+	if err := m.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+	if m.opts.DryRun {
+		return func() {}, nil
+	}
+
+	_, err = m.conn.InsertIgnoreInto(lockTable).Cols("id", "owner", "locked_until").Values(1, "", 0).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	ub := m.conn.Update(lockTable)
+	res, err := ub.Set(ub.Assign("owner", m.owner), ub.Assign("locked_until", now+m.lockTtlSec())).
+		Where(ub.Equal("id", 1), ub.LessThan("locked_until", now)).
+		Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		return nil, errors.Join(ErrLocked, err)
+	}
+
+	return func() {
+		//NOTE: the lock is released even if ctx is done
+		ub := m.conn.Update(lockTable)
+		_, err := ub.Set(ub.Assign("locked_until", 0)).
+			Where(ub.Equal("id", 1), ub.Equal("owner", m.owner)).
+			Exec(context.WithoutCancel(ctx))
+		if err != nil {
+			m.logger.Error(err, "Can't unlock migrations, they are locked till the lock expires")
+		}
+	}, nil
+}
+
+// extendLock extends the lock held by the migrator, it fails if the lock expired and was taken by another one
+func (m *Migrator) extendLock(ctx context.Context) error {
+	if m.opts.DryRun {
+		return nil
+	}
+
+	var owner string
+	sb := m.conn.Select("owner")
+	err := sb.From(lockTable).Where(sb.Equal("id", 1)).Primary().LoadValue(ctx, &owner)
+	if err != nil {
+		return err
+	}
+	if owner != m.owner {
+		return fmt.Errorf("%w: the lock expired while migrating", ErrLocked)
+	}
+
+	ub := m.conn.Update(lockTable)
+	_, err = ub.Set(ub.Assign("locked_until", time.Now().Unix()+m.lockTtlSec())).
+		Where(ub.Equal("id", 1), ub.Equal("owner", m.owner)).
+		Exec(ctx)
+
+	return err
+}
+
+func (m *Migrator) lockTtlSec() int64 {
+	return int64(m.opts.LockTtl / time.Second)
+}
+
+func (m *Migrator) markApplied(ctx context.Context, migration *Migration) error {
+	if m.opts.DryRun {
+		return nil
+	}
+
+	_, err := m.conn.InsertInto(table).
+		Cols("version", "name", "checksum", "applied_at").
+		Values(migration.Version, migration.Name, migration.Checksum, uint32(time.Now().Unix())).
+		Exec(ctx)
+
+	return err
+}
+
+func (m *Migrator) markReverted(ctx context.Context, migration *Migration) error {
+	if m.opts.DryRun {
+		return nil
+	}
+
+	db := m.conn.DeleteFrom(table)
+	_, err := db.Where(db.Equal("version", migration.Version)).Exec(ctx)
+
+	return err
+}
@@ -0,0 +1,175 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"github.com/go-logr/logr"
+	"os"
+	"path/filepath"
+	"pkg/db"
+	"reflect"
+	"testing"
+)
+
+func newTestConn(t *testing.T) *db.Conn {
+	t.Helper()
+
+	d := db.New(db.Settings{string(db.MainAlias): db.Spec{
+		Driver: db.DriverSQLite,
+		Name:   filepath.Join(t.TempDir(), "main.db"),
+		Params: map[string]string{"_pragma": "busy_timeout(5000)"},
+	}}, logr.Discard())
+	t.Cleanup(d.Dispose)
+
+	return db.NewDbConn(d.MainPool(), logr.Discard())
+}
+
+// writeMigrations writes the files by name and loads them
+func writeMigrations(t *testing.T, dir string, files map[string]string) []*Migration {
+	t.Helper()
+
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	migrations, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrations
+}
+
+var testFiles = map[string]string{
+	"001_create_item.sql":      "CREATE TABLE item (id INTEGER PRIMARY KEY);",
+	"001_create_item.down.sql": "DROP TABLE item;",
+	"002_add_name.sql":         "ALTER TABLE item ADD COLUMN name TEXT; INSERT INTO item (id, name) VALUES (1, 'a;b');",
+	"002_add_name.down.sql":    "ALTER TABLE item DROP COLUMN name;",
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := "CREATE TABLE `a;b` (id int); -- comment;\n" +
+		"INSERT INTO t VALUES ('x;y', \"q\\\";\"); # other;\n" +
+		"/* block; */ UPDATE t SET v = 1;\n\n;"
+
+	want := []string{
+		"CREATE TABLE `a;b` (id int)",
+		"INSERT INTO t VALUES ('x;y', \"q\\\";\")",
+		"UPDATE t SET v = 1",
+	}
+	if got := splitStatements(script); !reflect.DeepEqual(got, want) {
+		t.Errorf("statements = %q, want %q", got, want)
+	}
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	conn := newTestConn(t)
+	migrations := writeMigrations(t, t.TempDir(), testFiles)
+	m := New(conn, logr.Discard(), Options{})
+
+	done, err := m.Up(ctx, migrations)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("up done %d, err %v, want 2", len(done), err)
+	}
+
+	var name string
+	if err := conn.SelectBySQL("SELECT name FROM item WHERE id = 1").LoadValue(ctx, &name); err != nil || name != "a;b" {
+		t.Errorf("name = %q, %v, want a;b", name, err)
+	}
+
+	if done, err := m.Up(ctx, migrations); err != nil || len(done) != 0 {
+		t.Errorf("up again done %d, err %v, want nothing", len(done), err)
+	}
+
+	if done, err := m.Down(ctx, migrations, 1); err != nil || len(done) != 1 || done[0].Version != 2 {
+		t.Fatalf("down done %v, err %v, want version 2", done, err)
+	}
+
+	statuses, err := m.Status(ctx, migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[0].Applied == nil || statuses[1].Applied != nil {
+		t.Errorf("applied %v, %v, want only version 1", statuses[0].Applied, statuses[1].Applied)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	conn := newTestConn(t)
+	dir := t.TempDir()
+
+	if _, err := New(conn, logr.Discard(), Options{}).Up(ctx, writeMigrations(t, dir, testFiles)); err != nil {
+		t.Fatal(err)
+	}
+
+	changed := writeMigrations(t, dir, map[string]string{"002_add_name.sql": "ALTER TABLE item ADD COLUMN title TEXT;"})
+	if _, err := New(conn, logr.Discard(), Options{}).Up(ctx, changed); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("err = %v, want %v", err, ErrChecksumMismatch)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "002_add_name.sql")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(dir, "002_add_name.down.sql")); err != nil {
+		t.Fatal(err)
+	}
+	removed := writeMigrations(t, dir, nil)
+	if _, err := New(conn, logr.Discard(), Options{}).Status(ctx, removed); !errors.Is(err, ErrUnknownVersion) {
+		t.Errorf("err = %v, want %v", err, ErrUnknownVersion)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	conn := newTestConn(t)
+	migrations := writeMigrations(t, t.TempDir(), testFiles)
+
+	holder := New(conn, logr.Discard(), Options{})
+	unlock, err := holder.lock(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := New(conn, logr.Discard(), Options{})
+	if _, err := other.Up(ctx, migrations); !errors.Is(err, ErrLocked) {
+		t.Fatalf("err = %v, want %v", err, ErrLocked)
+	}
+	if statuses, err := other.Status(ctx, migrations); err != nil || statuses[0].Applied != nil {
+		t.Errorf("migrations applied while locked, err %v", err)
+	}
+
+	//NOTE: the holder lost the lock
+	if _, err := conn.ExecBySQL(ctx, "UPDATE "+lockTable+" SET owner = 'other'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.extendLock(ctx); !errors.Is(err, ErrLocked) {
+		t.Errorf("extend of a lost lock err = %v, want %v", err, ErrLocked)
+	}
+	if _, err := conn.ExecBySQL(ctx, "UPDATE "+lockTable+" SET owner = ?", holder.owner); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock()
+	if done, err := other.Up(ctx, migrations); err != nil || len(done) != 2 {
+		t.Errorf("up after unlock done %d, err %v, want 2", len(done), err)
+	}
+}
+
+func TestDryRunDoesNotChange(t *testing.T) {
+	ctx := context.Background()
+	conn := newTestConn(t)
+	migrations := writeMigrations(t, t.TempDir(), testFiles)
+
+	done, err := New(conn, logr.Discard(), Options{DryRun: true}).Up(ctx, migrations)
+	if err != nil || len(done) != 2 {
+		t.Fatalf("dry run done %d, err %v, want 2", len(done), err)
+	}
+
+	m := New(conn, logr.Discard(), Options{})
+	if m.tableExists(ctx) {
+		t.Error("dry run created the migrations table")
+	}
+}
@@ -0,0 +1,264 @@
+package rd
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vmihailenco/msgpack/v5"
+	"golang.org/x/sync/singleflight"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	defaultCacheTtl         = time.Hour
+	defaultCacheJitter      = 0.1
+	defaultCacheLoadTimeout = 10 * time.Second
+
+	cacheTagKeyPrefix = "cache_tag:"
+)
+
+var cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "rd_cache_requests_total",
+	Help: "Reads of redis caches by result: hit, miss or error.",
+}, []string{"cache", "result"})
+
+// Codec encodes the cached values
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSON    Codec = jsonCodec{}
+	Msgpack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Marshal(v any) ([]byte, error)      { return msgpack.Marshal(v) }
+func (msgpackCodec) Unmarshal(data []byte, v any) error { return msgpack.Unmarshal(data, v) }
+
+type CacheOptions struct {
+	// Name labels the metrics of the cache
+	Name string
+	// Prefix is prepended to the keys
+	Prefix string
+	// Ttl of the values, 1h if 0
+	Ttl time.Duration
+	// Jitter is the max fraction of Ttl randomly added to it, so the values cached at once don't expire at once,
+	// 0.1 if 0, negative disables it
+	Jitter float64
+	// Codec encodes the values, JSON if nil
+	Codec Codec
+	// TagPrefix is prepended to the keys of the tag sets, e.g. the app prefix.
+	// Caches dropping the values of each other by tags must have the same one.
+	TagPrefix string
+	// LoadTimeout bounds the loads of Fetch, 10s if 0
+	LoadTimeout time.Duration
+}
+
+// Cache is a typed cache of values in redis. The values may be tagged, e.g. by the advert and its owner,
+// to drop all of them by InvalidateTags. The tags are shared by all caches with the same TagPrefix.
+type Cache[V any] struct {
+	pool   *Pool
+	logger logr.Logger
+	opts   CacheOptions
+	group  singleflight.Group
+}
+
+func NewCache[V any](pool *Pool, logger logr.Logger, opts CacheOptions) *Cache[V] {
+	if opts.Ttl == 0 {
+		opts.Ttl = defaultCacheTtl
+	}
+	if opts.Jitter == 0 {
+		opts.Jitter = defaultCacheJitter
+	}
+	if opts.Codec == nil {
+		opts.Codec = JSON
+	}
+	if opts.LoadTimeout == 0 {
+		opts.LoadTimeout = defaultCacheLoadTimeout
+	}
+
+	return &Cache[V]{
+		pool:   pool,
+		logger: logger.WithName("[cache]").WithValues("cache", opts.Name),
+		opts:   opts,
+	}
+}
+
+// Get returns the cached value, false on a miss
+func (c *Cache[V]) Get(key string) (V, bool, error) {
+	var value V
+
+	data, err := redis.Bytes(c.pool.Do("GET", c.key(key)))
+	if err == redis.ErrNil {
+		cacheRequests.WithLabelValues(c.opts.Name, "miss").Inc()
+		return value, false, nil
+	}
+	if err != nil {
+		cacheRequests.WithLabelValues(c.opts.Name, "error").Inc()
+		return value, false, errors.WithStack(err)
+	}
+
+	if err := c.opts.Codec.Unmarshal(data, &value); err != nil {
+		//NOTE: the value of an outdated type is dropped and loaded again
+		cacheRequests.WithLabelValues(c.opts.Name, "error").Inc()
+		c.pool.Do("DEL", c.key(key))
+		return value, false, errors.Wrapf(err, "can't decode cached %s", key)
+	}
+
+	cacheRequests.WithLabelValues(c.opts.Name, "hit").Inc()
+	return value, true, nil
+}
+
+// Set caches the value for the ttl with jitter and adds its key to the tags
+func (c *Cache[V]) Set(key string, value V, tags ...string) error {
+	data, err := c.opts.Codec.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "can't encode %s", key)
+	}
+
+	ttlSec := int64(c.ttl().Seconds())
+	rdKey := c.key(key)
+
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", rdKey, data, "EX", ttlSec); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, tag := range tags {
+		//NOTE: a tag set lives as long as its longest living key
+		if _, err := tagScript.Do(conn, tagKey(c.opts.TagPrefix, tag), ttlSec, rdKey); err != nil {
+			return errors.Wrapf(err, "can't tag %s by %s", key, tag)
+		}
+	}
+
+	return nil
+}
+
+// Fetch returns the cached value or loads it by load and caches it with the returned tags.
+// Concurrent fetches of the same key in the process wait for one load, it runs with the values of the ctx
+// of the first one but isn't cancelled with it, it is bounded by LoadTimeout instead.
+// Redis failures don't fail the fetch, the value is loaded instead.
+func (c *Cache[V]) Fetch(ctx context.Context, key string,
+	load func(ctx context.Context) (V, []string, error)) (V, error) {
+
+	value, ok, err := c.Get(key)
+	if err != nil {
+		c.logger.Error(err, "Can't get cached value", "key", key)
+	}
+	if ok {
+		return value, nil
+	}
+
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		//NOTE: the load is shared, so a cancelled fetch must not fail the others
+		loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), c.opts.LoadTimeout)
+		defer cancel()
+
+		value, tags, err := load(loadCtx)
+		if err != nil {
+			return value, err
+		}
+
+		if err := c.Set(key, value, tags...); err != nil {
+			c.logger.Error(err, "Can't cache value", "key", key)
+		}
+		return value, nil
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return value, res.Err
+		}
+		value, _ = res.Val.(V)
+		return value, nil
+	case <-ctx.Done():
+		return value, errors.WithStack(ctx.Err())
+	}
+}
+
+// Delete drops the values of the keys
+func (c *Cache[V]) Delete(keys ...string) error {
+	conn := c.pool.Get()
+	defer conn.Close()
+
+	//NOTE: deleted one by one, as keys of a redis cluster may be in different slots
+	for _, key := range keys {
+		conn.Send("DEL", c.key(key))
+	}
+	if _, err := conn.Do(""); err != nil {
+		return errors.WithStack(err)
+	}
+
+	return nil
+}
+
+func (c *Cache[V]) key(key string) string {
+	return c.opts.Prefix + key
+}
+
+func (c *Cache[V]) ttl() time.Duration {
+	ttl := c.opts.Ttl
+	if c.opts.Jitter > 0 {
+		ttl += time.Duration(rand.Float64() * c.opts.Jitter * float64(ttl))
+	}
+	return max(ttl, time.Second)
+}
+
+// tagScript adds the key to the tag set extending the ttl of the set if the key lives longer
+var tagScript = redis.NewScript(1, `
+redis.call('SADD', KEYS[1], ARGV[2])
+local ttl = redis.call('TTL', KEYS[1])
+if ttl < tonumber(ARGV[1]) then
+	redis.call('EXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// InvalidateTags drops the values of all caches of the pool with the tag prefix tagged by any of the tags.
+// A load running at the same time may cache the old value again, so it is called after the change is committed.
+func InvalidateTags(pool *Pool, tagPrefix string, tags ...string) error {
+	conn := pool.Get()
+	defer conn.Close()
+
+	for _, tag := range tags {
+		keys, err := redis.Strings(conn.Do("SMEMBERS", tagKey(tagPrefix, tag)))
+		if err != nil {
+			return errors.Wrapf(err, "can't get keys of tag %s", tag)
+		}
+
+		for _, key := range keys {
+			conn.Send("DEL", key)
+		}
+		conn.Send("DEL", tagKey(tagPrefix, tag))
+		if _, err := conn.Do(""); err != nil {
+			return errors.Wrapf(err, "can't invalidate tag %s", tag)
+		}
+	}
+
+	return nil
+}
+
+// InvalidateTags drops the values of all caches of the pool with its tag prefix tagged by any of the tags
+func (c *Cache[V]) InvalidateTags(tags ...string) error {
+	return InvalidateTags(c.pool, c.opts.TagPrefix, tags...)
+}
+
+func tagKey(tagPrefix, tag string) string {
+	return tagPrefix + cacheTagKeyPrefix + tag
+}
@@ -0,0 +1,194 @@
+package rd
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testAdvert struct {
+	Id    uint32 `json:"id" msgpack:"id"`
+	Title string `json:"title" msgpack:"title"`
+}
+
+func newTestPool(t *testing.T) (*Pool, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	pool := OpenPool(Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}, logr.Discard())
+	t.Cleanup(pool.Close)
+
+	return pool, mr
+}
+
+func TestCacheGetSet(t *testing.T) {
+	pool, mr := newTestPool(t)
+	cache := NewCache[testAdvert](pool, logr.Discard(), CacheOptions{Prefix: "advert:", Ttl: time.Minute})
+
+	if _, ok, err := cache.Get("1"); ok || err != nil {
+		t.Fatalf("empty cache hit %v, err %v", ok, err)
+	}
+
+	want := testAdvert{Id: 1, Title: "cat"}
+	if err := cache.Set("1", want); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := cache.Get("1"); !ok || err != nil || got != want {
+		t.Errorf("cached %+v, %v, %v, want %+v", got, ok, err, want)
+	}
+	if ttl := mr.TTL("advert:1"); ttl < time.Minute {
+		t.Errorf("ttl = %v, want at least a minute", ttl)
+	}
+
+	if err := cache.Delete("1", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := cache.Get("1"); ok {
+		t.Error("deleted value is cached")
+	}
+}
+
+func TestCacheTtlJitter(t *testing.T) {
+	pool, _ := newTestPool(t)
+
+	jittered := NewCache[int](pool, logr.Discard(), CacheOptions{Ttl: 100 * time.Second, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		if ttl := jittered.ttl(); ttl < 100*time.Second || ttl > 150*time.Second {
+			t.Fatalf("ttl = %v, want within [100s, 150s]", ttl)
+		}
+	}
+
+	exact := NewCache[int](pool, logr.Discard(), CacheOptions{Ttl: 100 * time.Second, Jitter: -1})
+	if ttl := exact.ttl(); ttl != 100*time.Second {
+		t.Errorf("ttl without jitter = %v, want 100s", ttl)
+	}
+
+	short := NewCache[int](pool, logr.Discard(), CacheOptions{Ttl: time.Millisecond, Jitter: -1})
+	if ttl := short.ttl(); ttl != time.Second {
+		t.Errorf("short ttl = %v, want the 1s minimum", ttl)
+	}
+}
+
+func TestCacheCodecMismatch(t *testing.T) {
+	pool, mr := newTestPool(t)
+	opts := CacheOptions{Prefix: "advert:"}
+	if err := NewCache[testAdvert](pool, logr.Discard(), opts).Set("1", testAdvert{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts.Codec = Msgpack
+	cache := NewCache[testAdvert](pool, logr.Discard(), opts)
+	if _, ok, err := cache.Get("1"); ok || err == nil {
+		t.Fatalf("value of another codec hit %v, err %v, want an error", ok, err)
+	}
+	if mr.Exists("advert:1") {
+		t.Error("undecodable value is kept")
+	}
+
+	if err := cache.Set("1", testAdvert{Id: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok, err := cache.Get("1"); !ok || err != nil || got.Id != 2 {
+		t.Errorf("cached %+v, %v, %v, want id 2", got, ok, err)
+	}
+}
+
+func TestCacheInvalidateTags(t *testing.T) {
+	pool, mr := newTestPool(t)
+	adverts := NewCache[testAdvert](pool, logr.Discard(), CacheOptions{Prefix: "advert:", TagPrefix: "app:"})
+	counts := NewCache[int](pool, logr.Discard(), CacheOptions{Prefix: "count:", TagPrefix: "app:"})
+	other := NewCache[int](pool, logr.Discard(), CacheOptions{Prefix: "other:", TagPrefix: "other:"})
+
+	adverts.Set("1", testAdvert{Id: 1}, "advert:1", "owner:7")
+	adverts.Set("2", testAdvert{Id: 2}, "advert:2", "owner:8")
+	counts.Set("7", 1, "owner:7")
+	other.Set("7", 1, "owner:7")
+
+	if !mr.Exists("app:cache_tag:owner:7") {
+		t.Fatal("tag set is not prefixed")
+	}
+
+	if err := counts.InvalidateTags("owner:7"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"advert:1", "count:7", "app:cache_tag:owner:7"} {
+		if mr.Exists(key) {
+			t.Errorf("%s is kept after the invalidation", key)
+		}
+	}
+	for _, key := range []string{"advert:2", "other:7", "other:cache_tag:owner:7"} {
+		if !mr.Exists(key) {
+			t.Errorf("%s of another tag is dropped", key)
+		}
+	}
+}
+
+func TestCacheFetch(t *testing.T) {
+	pool, _ := newTestPool(t)
+	cache := NewCache[testAdvert](pool, logr.Discard(), CacheOptions{Prefix: "advert:"})
+
+	loads := 0
+	load := func(ctx context.Context) (testAdvert, []string, error) {
+		loads++
+		return testAdvert{Id: 1}, nil, nil
+	}
+
+	for i := 0; i < 2; i++ {
+		if got, err := cache.Fetch(context.Background(), "1", load); err != nil || got.Id != 1 {
+			t.Fatalf("fetched %+v, %v", got, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loads = %d, want 1", loads)
+	}
+}
+
+func TestCacheFetchSharedLoadOutlivesFirstCaller(t *testing.T) {
+	pool, _ := newTestPool(t)
+	cache := NewCache[testAdvert](pool, logr.Discard(), CacheOptions{Prefix: "advert:"})
+
+	var once sync.Once
+	started := make(chan struct{})
+	release := make(chan struct{})
+	load := func(ctx context.Context) (testAdvert, []string, error) {
+		once.Do(func() { close(started) })
+		select {
+		case <-release:
+			return testAdvert{Id: 1}, nil, ctx.Err()
+		case <-ctx.Done():
+			return testAdvert{}, nil, ctx.Err()
+		}
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cache.Fetch(firstCtx, "1", load)
+	}()
+	<-started
+
+	secondErr := make(chan error, 1)
+	go func() {
+		got, err := cache.Fetch(context.Background(), "1", load)
+		if err == nil && got.Id != 1 {
+			t.Errorf("fetched %+v, want id 1", got)
+		}
+		secondErr <- err
+	}()
+
+	//NOTE: the first caller goes away while the second one waits for the shared load
+	time.Sleep(50 * time.Millisecond)
+	cancelFirst()
+	wg.Wait()
+	close(release)
+
+	if err := <-secondErr; err != nil {
+		t.Errorf("second fetch err = %v, want the shared load to finish", err)
+	}
+}
@@ -0,0 +1,489 @@
+package rd
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSlots        = 16384
+	clusterMaxRedirects = 5
+	clusterRetryDelay   = 100 * time.Millisecond
+)
+
+var ErrClusterSlots = errors.New("no redis cluster node serves the slot")
+
+// cluster keeps a pool for every master node and routes commands to them by the slots of the keys
+type cluster struct {
+	dialer *dialer
+	logger logr.Logger
+	limits poolLimits
+
+	mu    sync.RWMutex
+	slots [clusterSlots]string
+	nodes map[string]*redis.Pool
+}
+
+func newCluster(d *dialer, logger logr.Logger, limits poolLimits) *cluster {
+	c := &cluster{
+		dialer: d,
+		logger: logger,
+		limits: limits,
+		nodes:  make(map[string]*redis.Pool),
+	}
+
+	//NOTE: an unavailable cluster doesn't stop the app, slots are loaded again on the first command
+	if err := c.refresh(); err != nil {
+		logger.Error(err, "Failed to load redis cluster slots")
+	}
+
+	return c
+}
+
+// get borrows a connection to the node waiting up to the wait timeout in the wait mode
+func (c *cluster) get(addr string) (redis.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.limits.waitTimeout)
+	defer cancel()
+
+	conn, err := c.node(addr).GetContext(ctx)
+	return conn, errors.WithStack(err)
+}
+
+func (c *cluster) node(addr string) *redis.Pool {
+	c.mu.RLock()
+	pool, ok := c.nodes[addr]
+	c.mu.RUnlock()
+	if ok {
+		return pool
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pool, ok = c.nodes[addr]; !ok {
+		pool = c.limits.apply(&redis.Pool{
+			Dial: func() (redis.Conn, error) {
+				return c.dialer.dial(addr)
+			},
+			TestOnBorrow: func(conn redis.Conn, _ time.Time) error {
+				_, err := conn.Do("PING")
+				return err
+			},
+		})
+		c.nodes[addr] = pool
+	}
+	return pool
+}
+
+// refresh loads the slots of the masters by CLUSTER SLOTS from the known nodes and the seeds
+func (c *cluster) refresh() error {
+	c.mu.RLock()
+	addrs := make([]string, 0, len(c.nodes)+len(c.dialer.spec.Cluster.Addrs))
+	for addr := range c.nodes {
+		addrs = append(addrs, addr)
+	}
+	c.mu.RUnlock()
+	addrs = append(addrs, c.dialer.spec.Cluster.Addrs...)
+
+	lastErr := ErrClusterSlots
+	for _, addr := range addrs {
+		conn, err := c.get(addr)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "cluster node %s", addr)
+			continue
+		}
+		ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = errors.Wrapf(err, "cluster node %s", addr)
+			continue
+		}
+
+		var slots [clusterSlots]string
+		for _, r := range ranges {
+			// [start, end, [host, port, id], replicas...]
+			fields, err := redis.Values(r, nil)
+			if err != nil || len(fields) < 3 {
+				continue
+			}
+			start, _ := redis.Int64(fields[0], nil)
+			end, _ := redis.Int64(fields[1], nil)
+			master, err := redis.Values(fields[2], nil)
+			if err != nil || len(master) < 2 {
+				continue
+			}
+			host, _ := redis.String(master[0], nil)
+			port, _ := redis.Int64(master[1], nil)
+
+			for slot := start; slot <= end && slot < clusterSlots; slot++ {
+				slots[slot] = nodeAddr(host, port)
+			}
+		}
+
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+
+		return nil
+	}
+
+	return lastErr
+}
+
+// addr returns the master of the slot, any known node for commands without keys
+func (c *cluster) addr(slot int) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if slot >= 0 {
+		if addr := c.slots[slot]; len(addr) > 0 {
+			return addr, nil
+		}
+		return "", errors.Wrapf(ErrClusterSlots, "slot %d", slot)
+	}
+
+	for _, addr := range c.slots {
+		if len(addr) > 0 {
+			return addr, nil
+		}
+	}
+	if len(c.dialer.spec.Cluster.Addrs) > 0 {
+		return c.dialer.spec.Cluster.Addrs[0], nil
+	}
+	return "", ErrClusterSlots
+}
+
+func (c *cluster) setSlot(slot int, addr string) {
+	c.mu.Lock()
+	c.slots[slot] = addr
+	c.mu.Unlock()
+}
+
+// do runs the command on the master of its key slot following MOVED and ASK redirects
+func (c *cluster) do(cmd string, args ...interface{}) (interface{}, error) {
+	slot := commandSlot(cmd, args)
+
+	addr, err := c.addr(slot)
+	if err != nil {
+		if err := c.refresh(); err != nil {
+			return nil, err
+		}
+		if addr, err = c.addr(slot); err != nil {
+			return nil, err
+		}
+	}
+
+	asking := false
+	for redirect := 0; ; redirect++ {
+		conn, err := c.get(addr)
+		if err != nil {
+			return nil, err
+		}
+		if asking {
+			conn.Send("ASKING")
+		}
+		reply, err := conn.Do(cmd, args...)
+		conn.Close()
+
+		rdErr, ok := err.(redis.Error)
+		if !ok || redirect >= clusterMaxRedirects {
+			return reply, err
+		}
+
+		// MOVED <slot> <addr> or ASK <slot> <addr>
+		fields := strings.Fields(string(rdErr))
+		switch {
+		case len(fields) == 3 && fields[0] == "MOVED":
+			movedSlot, _ := strconv.Atoi(fields[1])
+			c.setSlot(movedSlot, fields[2])
+			//NOTE: a moved slot means resharding, the other slots may have moved as well
+			go c.refresh()
+			addr, asking = fields[2], false
+		case len(fields) == 3 && fields[0] == "ASK":
+			addr, asking = fields[2], true
+		case len(fields) > 0 && (fields[0] == "TRYAGAIN" || fields[0] == "CLUSTERDOWN"):
+			time.Sleep(clusterRetryDelay)
+		default:
+			return reply, err
+		}
+	}
+}
+
+func (c *cluster) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for addr, pool := range c.nodes {
+		pool.Close()
+		delete(c.nodes, addr)
+	}
+}
+
+// keylessCommands are routed to any node
+var keylessCommands = map[string]bool{
+	"PING": true, "ECHO": true, "INFO": true, "TIME": true, "PUBLISH": true, "SCRIPT": true,
+	"CLUSTER": true, "CLIENT": true, "COMMAND": true, "ROLE": true, "DBSIZE": true,
+}
+
+// commandSlot returns the slot of the first key of the command, -1 if the command has no key
+func commandSlot(cmd string, args []interface{}) int {
+	cmd = strings.ToUpper(cmd)
+	if keylessCommands[cmd] || len(args) == 0 {
+		return -1
+	}
+
+	key := args[0]
+	switch cmd {
+	case "EVAL", "EVALSHA", "EVAL_RO", "EVALSHA_RO", "FCALL", "FCALL_RO":
+		// script numkeys key...
+		if len(args) < 3 {
+			return -1
+		}
+		if numKeys, _ := strconv.Atoi(fmt.Sprint(args[1])); numKeys == 0 {
+			return -1
+		}
+		key = args[2]
+	case "XREAD", "XREADGROUP":
+		// [GROUP group consumer] [COUNT n] [BLOCK ms] [NOACK] STREAMS key... id...
+		key = nil
+		for i := 0; i < len(args)-1; i++ {
+			if strings.EqualFold(fmt.Sprint(args[i]), "STREAMS") {
+				key = args[i+1]
+				break
+			}
+		}
+		if key == nil {
+			return -1
+		}
+	case "XGROUP", "XINFO", "OBJECT", "MEMORY":
+		// subcommand key...
+		if len(args) < 2 {
+			return -1
+		}
+		key = args[1]
+	}
+
+	switch k := key.(type) {
+	case []byte:
+		return keySlot(string(k))
+	case string:
+		return keySlot(k)
+	default:
+		return keySlot(fmt.Sprint(k))
+	}
+}
+
+// SlotGroups groups the keys by their cluster slots, so every group can be used by one command.
+// All keys are in one group out of a cluster.
+func (p *Pool) SlotGroups(keys []string) [][]string {
+	return groupBySlot(p, keys, func(key string) string { return key })
+}
+
+// groupBySlot groups the items by the cluster slots of their keys keeping their order
+func groupBySlot[T any](p *Pool, items []T, key func(T) string) [][]T {
+	if p.cluster == nil {
+		return [][]T{items}
+	}
+
+	var groups [][]T
+	slots := make(map[int]int)
+	for _, item := range items {
+		slot := keySlot(key(item))
+		i, ok := slots[slot]
+		if !ok {
+			i = len(groups)
+			slots[slot] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], item)
+	}
+
+	return groups
+}
+
+// keySlot hashes the key or its {hash tag} by CRC16 as redis cluster does
+func keySlot(key string) int {
+	if tag := hashTag(key); len(tag) > 0 {
+		key = tag
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// hashTag returns the part of the key between the first { and the next }, the key is hashed by it if it's not empty
+func hashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return ""
+}
+
+// crc16 is CRC16-CCITT (XMODEM) used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// clusterConn is a redis.Conn routing every command by its key. Pipelined commands are run one by one
+// on Flush. A subscribing connection sticks to one node, as cluster nodes broadcast the published messages.
+type clusterConn struct {
+	cluster *cluster
+	pending []clusterCommand
+	replies []clusterReply
+	pinned  redis.Conn
+	err     error
+}
+
+type clusterCommand struct {
+	cmd  string
+	args []interface{}
+}
+
+type clusterReply struct {
+	reply interface{}
+	err   error
+}
+
+func (c *clusterConn) Close() error {
+	if c.pinned != nil {
+		return c.pinned.Close()
+	}
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	if c.pinned != nil {
+		return c.pinned.Err()
+	}
+	return c.err
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if c.pinned != nil {
+		return c.pinned.Do(cmd, args...)
+	}
+
+	// like redis.Conn the pending replies are received, the first error of them is returned
+	c.Flush()
+	var reply interface{}
+	var err error
+	for _, r := range c.replies {
+		reply = r.reply
+		if err == nil {
+			err = r.err
+		}
+	}
+	c.replies = nil
+
+	if len(cmd) == 0 {
+		return reply, err
+	}
+
+	reply, cmdErr := c.cluster.do(cmd, args...)
+	if err == nil {
+		err = cmdErr
+	}
+	return reply, err
+}
+
+func (c *clusterConn) Send(cmd string, args ...interface{}) error {
+	if c.pinned == nil {
+		switch strings.ToUpper(cmd) {
+		case "SUBSCRIBE", "PSUBSCRIBE":
+			addr, err := c.cluster.addr(-1)
+			if err != nil {
+				return err
+			}
+			if c.pinned, err = c.cluster.dialer.dial(addr); err != nil {
+				c.err = err
+				return err
+			}
+		}
+	}
+
+	if c.pinned != nil {
+		return c.pinned.Send(cmd, args...)
+	}
+
+	c.pending = append(c.pending, clusterCommand{cmd: cmd, args: args})
+	return nil
+}
+
+func (c *clusterConn) Flush() error {
+	if c.pinned != nil {
+		return c.pinned.Flush()
+	}
+
+	for _, command := range c.pending {
+		reply, err := c.cluster.do(command.cmd, command.args...)
+		c.replies = append(c.replies, clusterReply{reply: reply, err: err})
+	}
+	c.pending = nil
+
+	return nil
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	if c.pinned != nil {
+		return c.pinned.Receive()
+	}
+
+	if len(c.replies) == 0 {
+		c.Flush()
+	}
+	if len(c.replies) == 0 {
+		return nil, errors.New("redis cluster connection has no pending replies")
+	}
+
+	r := c.replies[0]
+	c.replies = c.replies[1:]
+	return r.reply, r.err
+}
+
+//NOTE: the commands run on the node pools don't support ctx and timeouts, only the subscribed connection does
+
+func (c *clusterConn) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	if c.pinned != nil {
+		return redis.DoContext(c.pinned, ctx, cmd, args...)
+	}
+	return c.Do(cmd, args...)
+}
+
+func (c *clusterConn) DoWithTimeout(timeout time.Duration, cmd string, args ...interface{}) (interface{}, error) {
+	if c.pinned != nil {
+		return redis.DoWithTimeout(c.pinned, timeout, cmd, args...)
+	}
+	return c.Do(cmd, args...)
+}
+
+func (c *clusterConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	if c.pinned != nil {
+		return redis.ReceiveContext(c.pinned, ctx)
+	}
+	return c.Receive()
+}
+
+func (c *clusterConn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	if c.pinned != nil {
+		return redis.ReceiveWithTimeout(c.pinned, timeout)
+	}
+	return c.Receive()
+}
@@ -0,0 +1,100 @@
+package rd
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"testing"
+)
+
+func TestCrc16(t *testing.T) {
+	//NOTE: the check value of CRC16-CCITT (XMODEM)
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("crc16 = %#x, want 0x31c3", got)
+	}
+	if got := crc16(""); got != 0 {
+		t.Errorf("crc16 of empty = %#x, want 0", got)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "{user1000}.following", want: keySlot("user1000")},
+		{key: "{user1000}.followers", want: keySlot("user1000")},
+		//NOTE: an empty tag doesn't count, the whole key is hashed
+		{key: "foo{}{bar}", want: int(crc16("foo{}{bar}") % clusterSlots)},
+		{key: "foo{{bar}}zap", want: keySlot("{bar")},
+		{key: "foo{bar}{zap}", want: keySlot("bar")},
+	}
+
+	for _, tt := range tests {
+		if got := keySlot(tt.key); got != tt.want {
+			t.Errorf("slot of %q = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCommandSlot(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  string
+		args []interface{}
+		want int
+	}{
+		{name: "key", cmd: "get", args: []interface{}{"foo"}, want: 12182},
+		{name: "bytes key", cmd: "SET", args: []interface{}{[]byte("foo"), 1}, want: 12182},
+		{name: "keyless", cmd: "PING", want: -1},
+		{name: "script key", cmd: "EVALSHA", args: []interface{}{"sha", 2, "foo", "bar"}, want: 12182},
+		{name: "script without keys", cmd: "EVAL", args: []interface{}{"return 1", 0}, want: -1},
+		{name: "stream group read", cmd: "XREADGROUP",
+			args: []interface{}{"GROUP", "g", "c", "COUNT", 10, "BLOCK", 100, "STREAMS", "foo", "bar", ">", ">"},
+			want: 12182},
+		{name: "stream read", cmd: "XREAD", args: []interface{}{"COUNT", 1, "streams", "foo", "0"}, want: 12182},
+		{name: "stream read without streams", cmd: "XREAD", args: []interface{}{"COUNT", 1}, want: -1},
+		{name: "stream group create", cmd: "XGROUP", args: []interface{}{"CREATE", "foo", "g", "$", "MKSTREAM"},
+			want: 12182},
+		{name: "stream info", cmd: "XINFO", args: []interface{}{"GROUPS", "foo"}, want: 12182},
+		{name: "stream autoclaim", cmd: "XAUTOCLAIM", args: []interface{}{"foo", "g", "c", 1000, "0-0"}, want: 12182},
+		{name: "stream pending", cmd: "XPENDING", args: []interface{}{"foo", "g", "-", "+", 10, "c"}, want: 12182},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commandSlot(tt.cmd, tt.args); got != tt.want {
+				t.Errorf("slot = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSlotGroups(t *testing.T) {
+	mr := miniredis.RunT(t)
+	spec := Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}
+	keys := []string{"mb:photos", "mb:adverts", "{mb}:photos", "{mb}:adverts", "mb:photos:dead"}
+
+	pool := OpenPool(spec, logr.Discard())
+	defer pool.Close()
+	if groups := pool.SlotGroups(keys); len(groups) != 1 || len(groups[0]) != len(keys) {
+		t.Errorf("groups out of a cluster = %v, want all keys in one", groups)
+	}
+
+	spec.Cluster = &ClusterSpec{Addrs: []string{mr.Addr()}}
+	cluster := OpenPool(spec, logr.Discard())
+	defer cluster.Close()
+
+	groups := cluster.SlotGroups(keys)
+	for _, group := range groups {
+		for _, key := range group[1:] {
+			if keySlot(key) != keySlot(group[0]) {
+				t.Errorf("group %v has keys of different slots", group)
+			}
+		}
+	}
+	if len(groups) != 4 || groups[0][0] != "mb:photos" || len(groups[2]) != 2 {
+		t.Errorf("groups in a cluster = %v, want the tagged keys grouped in the order of the keys", groups)
+	}
+}
@@ -1,9 +1,11 @@
 package rd
 
 import (
+	"context"
 	"fmt"
 	"github.com/go-logr/logr"
 	"github.com/gomodule/redigo/redis"
+	"time"
 )
 
 // Conn is a wrapper of redis origin connection for logging all operations
@@ -27,13 +29,28 @@ func (rd *Conn) Flush() error {
 }
 
 func (rd *Conn) Do(command string, args ...interface{}) (interface{}, error) {
+	rd.logDo(command, args)
+	return rd.origin.Do(command, args...)
+}
+
+func (rd *Conn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	rd.logDo(command, args)
+	return redis.DoContext(rd.origin, ctx, command, args...)
+}
+
+func (rd *Conn) DoWithTimeout(timeout time.Duration, command string, args ...interface{}) (interface{}, error) {
+	rd.logDo(command, args)
+	return redis.DoWithTimeout(rd.origin, timeout, command, args...)
+}
+
+func (rd *Conn) logDo(command string, args []interface{}) {
 	if rd.spec.LogLevel > 1 {
 		if len(command) != 0 {
 			var s string
 			for i := 0; i < len(args); i++ {
 				s += fmt.Sprintf("%v ", args[i])
 			}
-			rd.logger.WithCallDepth(2).V(1).Info(command + " " + s)
+			rd.logger.WithCallDepth(3).V(1).Info(command + " " + s)
 		}
 	} else if rd.spec.LogLevel > 0 {
 		//for this level not logging too verbose commands
@@ -45,10 +62,9 @@ func (rd *Conn) Do(command string, args ...interface{}) (interface{}, error) {
 			if len(args) > 5 {
 				s += " ..."
 			}
-			rd.logger.WithCallDepth(2).V(1).Info(command + " " + s)
+			rd.logger.WithCallDepth(3).V(1).Info(command + " " + s)
 		}
 	}
-	return rd.origin.Do(command, args...)
 }
 
 func (rd *Conn) Send(command string, args ...interface{}) error {
@@ -67,3 +83,12 @@ func (rd *Conn) Send(command string, args ...interface{}) error {
 func (rd *Conn) Receive() (interface{}, error) {
 	return rd.origin.Receive()
 }
+
+func (rd *Conn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return redis.ReceiveContext(rd.origin, ctx)
+}
+
+// ReceiveWithTimeout receives with the timeout instead of the read timeout of the spec, 0 waits forever
+func (rd *Conn) ReceiveWithTimeout(timeout time.Duration) (interface{}, error) {
+	return redis.ReceiveWithTimeout(rd.origin, timeout)
+}
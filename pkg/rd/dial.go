@@ -0,0 +1,165 @@
+package rd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+var ErrNoMaster = errors.New("no redis master found")
+
+// dialer dials the connections authenticated and over TLS if set by the spec
+type dialer struct {
+	spec    Spec
+	options []redis.DialOption
+}
+
+func newDialer(s Spec) (*dialer, error) {
+	options := []redis.DialOption{
+		redis.DialUsername(s.Username),
+		redis.DialPassword(s.Password),
+		// Сохраняем название клиента для диагностики соединений с помощью команды CLIENT LIST.
+		// https://redis.io/commands/client-list/
+		redis.DialClientName(s.ClientName),
+		redis.DialDatabase(s.Db),
+	}
+	options = append(options, timeoutOptions(s)...)
+
+	if s.Tls != nil {
+		tlsConfig, err := newTlsConfig(s.Tls)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig))
+	}
+
+	return &dialer{spec: s, options: options}, nil
+}
+
+func timeoutOptions(s Spec) []redis.DialOption {
+	return []redis.DialOption{
+		redis.DialConnectTimeout(time.Millisecond * time.Duration(s.DialTimeoutMs)),
+		redis.DialReadTimeout(time.Millisecond * time.Duration(s.ReadTimeoutMs)),
+		redis.DialWriteTimeout(time.Millisecond * time.Duration(s.WriteTimeoutMs)),
+	}
+}
+
+func newTlsConfig(s *TlsSpec) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         s.ServerName,
+		InsecureSkipVerify: s.InsecureSkipVerify,
+	}
+
+	if len(s.CaFile) > 0 {
+		pem, err := os.ReadFile(s.CaFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates in %s", s.CaFile)
+		}
+	}
+
+	if len(s.CertFile) > 0 || len(s.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// dial connects to the node of the address
+func (d *dialer) dial(addr string) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr, d.options...)
+	return conn, errors.WithStack(err)
+}
+
+// dialServer connects to the server of the spec, which is the master discovered by sentinels if set
+func (d *dialer) dialServer() (redis.Conn, error) {
+	if d.spec.Sentinel == nil {
+		return d.dial(d.spec.ConnStr())
+	}
+
+	addr, err := d.masterAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := d.dial(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	//NOTE: sentinels may report the old master for a while after a failover
+	if err := checkMaster(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// masterAddr asks the sentinels in turn for the master address
+func (d *dialer) masterAddr() (string, error) {
+	s := d.spec.Sentinel
+	options := []redis.DialOption{
+		redis.DialUsername(s.Username),
+		redis.DialPassword(s.Password),
+	}
+	options = append(options, timeoutOptions(d.spec)...)
+
+	lastErr := ErrNoMaster
+	for _, sentinelAddr := range s.Addrs {
+		conn, err := redis.Dial("tcp", sentinelAddr, options...)
+		if err != nil {
+			lastErr = errors.Wrapf(err, "sentinel %s", sentinelAddr)
+			continue
+		}
+
+		hostPort, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+		conn.Close()
+		if err != nil {
+			lastErr = errors.Wrapf(err, "sentinel %s", sentinelAddr)
+			continue
+		}
+		if len(hostPort) != 2 {
+			lastErr = errors.Wrapf(ErrNoMaster, "sentinel %s doesn't know master %s", sentinelAddr, s.MasterName)
+			continue
+		}
+
+		return net.JoinHostPort(hostPort[0], hostPort[1]), nil
+	}
+
+	return "", lastErr
+}
+
+// checkMaster fails if the connection is not to a master
+func checkMaster(conn redis.Conn) error {
+	role, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if len(role) == 0 {
+		return ErrNoMaster
+	}
+	if name, _ := redis.String(role[0], nil); name != "master" {
+		return errors.Wrapf(ErrNoMaster, "server role is %s", name)
+	}
+
+	return nil
+}
+
+// nodeAddr joins the host and port of a CLUSTER SLOTS node
+func nodeAddr(host string, port int64) string {
+	return net.JoinHostPort(host, strconv.FormatInt(port, 10))
+}
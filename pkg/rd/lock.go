@@ -0,0 +1,259 @@
+package rd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLockTtl        = RedisMutexExpireSec * time.Second
+	defaultLockRetryDelay = 100 * time.Millisecond
+)
+
+var (
+	ErrLockNotAcquired = errors.New("lock is held by another owner")
+	ErrLockLost        = errors.New("lock is lost")
+)
+
+type LockOptions struct {
+	// Ttl is how long the lock is held if the holder dies without releasing it, 60s if 0
+	Ttl time.Duration
+	// RenewInterval is the period of extending the lock to Ttl, Ttl/3 if 0
+	RenewInterval time.Duration
+	// RetryDelay is the delay between the attempts to acquire a held lock, 100ms if 0
+	RetryDelay time.Duration
+}
+
+// Lock is a lock held in redis and extended in background until it is released.
+// Every acquire of a name gets a greater fencing token, so the storages written by the holder
+// can reject the writes of a former holder which lost the lock while paused.
+type Lock struct {
+	pool  *Pool
+	name  string
+	owner string
+	token int64
+	opts  LockOptions
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// acquireScript sets the lock if it is free and increments the fencing counter, which never expires
+var acquireScript = redis.NewScript(2, `
+if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('INCR', KEYS[2])
+end
+return 0
+`)
+
+var renewScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var releaseScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLock waits for the lock of the name until ctx is done.
+// The lock is extended until it is released or ctx is done.
+func AcquireLock(ctx context.Context, pool *Pool, name string, opts LockOptions) (*Lock, error) {
+	l := newLock(pool, name, opts)
+
+	for {
+		ok, err := l.acquire()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			l.start(ctx)
+			return l, nil
+		}
+
+		select {
+		case <-time.After(l.opts.RetryDelay):
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ErrLockNotAcquired, "%s: %v", name, ctx.Err())
+		}
+	}
+}
+
+// TryLock acquires the lock of the name once, it fails with ErrLockNotAcquired if the lock is held
+func TryLock(ctx context.Context, pool *Pool, name string, opts LockOptions) (*Lock, error) {
+	l := newLock(pool, name, opts)
+
+	ok, err := l.acquire()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.Wrap(ErrLockNotAcquired, name)
+	}
+
+	l.start(ctx)
+	return l, nil
+}
+
+// LockHeld tells if anyone holds the lock of the name
+func LockHeld(pool *Pool, name string) (bool, error) {
+	held, err := redis.Bool(pool.Do("EXISTS", name))
+	return held, errors.WithStack(err)
+}
+
+func newLock(pool *Pool, name string, opts LockOptions) *Lock {
+	if opts.Ttl == 0 {
+		opts.Ttl = defaultLockTtl
+	}
+	if opts.RenewInterval == 0 {
+		opts.RenewInterval = opts.Ttl / 3
+	}
+	if opts.RetryDelay == 0 {
+		opts.RetryDelay = defaultLockRetryDelay
+	}
+
+	owner := make([]byte, 16)
+	rand.Read(owner)
+
+	return &Lock{
+		pool:  pool,
+		name:  name,
+		owner: hex.EncodeToString(owner),
+		opts:  opts,
+	}
+}
+
+func (l *Lock) acquire() (bool, error) {
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	fence, err := fenceKey(l.name)
+	if err != nil {
+		return false, err
+	}
+
+	token, err := redis.Int64(acquireScript.Do(conn, l.name, fence, l.owner, l.opts.Ttl.Milliseconds()))
+	if err != nil {
+		return false, errors.Wrapf(err, "can't acquire lock %s", l.name)
+	}
+
+	l.token = token
+	return token > 0, nil
+}
+
+func (l *Lock) start(ctx context.Context) {
+	l.ctx, l.cancel = context.WithCancel(ctx)
+	l.done = make(chan struct{})
+	go l.renew()
+}
+
+// renew extends the lock until the context is done. Failed extends are retried until the ttl
+// since the last extend is over, then the lock is lost.
+func (l *Lock) renew() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.opts.RenewInterval)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		conn := l.pool.Get()
+		ok, err := redis.Bool(renewScript.Do(conn, l.name, l.owner, l.opts.Ttl.Milliseconds()))
+		conn.Close()
+
+		switch {
+		case err == nil && ok:
+			renewed = time.Now()
+		case err == nil:
+			l.lose(ErrLockLost)
+			return
+		case time.Since(renewed) >= l.opts.Ttl:
+			l.lose(errors.Wrap(ErrLockLost, err.Error()))
+			return
+		}
+	}
+}
+
+func (l *Lock) lose(err error) {
+	l.mu.Lock()
+	l.err = errors.Wrap(err, l.name)
+	l.mu.Unlock()
+
+	l.cancel()
+}
+
+// Token is the fencing token of the lock, greater than the tokens of the former holders
+func (l *Lock) Token() int64 {
+	return l.token
+}
+
+// Context is done when the lock is lost or released, the holder stops its work then
+func (l *Lock) Context() context.Context {
+	return l.ctx
+}
+
+// Err returns ErrLockLost if the lock was lost before the release
+func (l *Lock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+// Release stops extending the lock and deletes it unless it was taken by another owner.
+// It returns ErrLockLost if the lock was lost, so the work of the holder may be unprotected.
+func (l *Lock) Release() error {
+	l.cancel()
+	<-l.done
+
+	if err := l.Err(); err != nil {
+		return err
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	deleted, err := redis.Bool(releaseScript.Do(conn, l.name, l.owner))
+	if err != nil {
+		return errors.Wrapf(err, "can't release lock %s", l.name)
+	}
+	if !deleted {
+		return errors.Wrap(ErrLockLost, l.name)
+	}
+
+	return nil
+}
+
+// fenceKey is in the slot of the lock key in a redis cluster
+func fenceKey(name string) (string, error) {
+	switch {
+	case len(hashTag(name)) > 0:
+		//NOTE: the name is hashed by its tag, a tag around the name would be another one
+		return name + ":fence", nil
+	case !strings.Contains(name, "}"):
+		return "{" + name + "}:fence", nil
+	}
+
+	//NOTE: the name is hashed whole, it can't be the tag of another key if it has }
+	return "", errors.Errorf("lock name \"%s\" has } without a {hash tag}", name)
+}
@@ -0,0 +1,177 @@
+package rd
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+const testLockName = "test:lock"
+
+func TestFenceKeySlot(t *testing.T) {
+	for _, name := range []string{"user_move:7", "{user:7}:move", "move:{user:7}", "foo{bar", "foo{{bar}}"} {
+		fence, err := fenceKey(name)
+		if err != nil {
+			t.Errorf("fence key of %q err = %v", name, err)
+			continue
+		}
+		if got, want := keySlot(fence), keySlot(name); got != want {
+			t.Errorf("slot of the fence key %q = %d, want the lock slot %d", fence, got, want)
+		}
+	}
+
+	for _, name := range []string{"foo{}{bar}", "foo}", "{}"} {
+		if fence, err := fenceKey(name); err == nil {
+			t.Errorf("fence key of %q = %q, want an error", name, fence)
+		}
+	}
+}
+
+func TestTryLock(t *testing.T) {
+	pool, _ := newTestPool(t)
+	ctx := context.Background()
+
+	lock, err := TryLock(ctx, pool, testLockName, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if held, err := LockHeld(pool, testLockName); !held || err != nil {
+		t.Errorf("held %v, err %v, want the lock held", held, err)
+	}
+	if _, err := TryLock(ctx, pool, testLockName, LockOptions{}); !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("lock of a held name err = %v, want %v", err, ErrLockNotAcquired)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if held, _ := LockHeld(pool, testLockName); held {
+		t.Error("released lock is held")
+	}
+	if lock.Context().Err() == nil {
+		t.Error("context of the released lock is not done")
+	}
+
+	next, err := TryLock(ctx, pool, testLockName, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Release()
+
+	if next.Token() <= lock.Token() {
+		t.Errorf("token %d, want greater than the token %d of the former holder", next.Token(), lock.Token())
+	}
+}
+
+func TestAcquireLockWaitsForRelease(t *testing.T) {
+	pool, _ := newTestPool(t)
+	ctx := context.Background()
+
+	held, err := TryLock(ctx, pool, testLockName, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = AcquireLock(timeoutCtx, pool, testLockName, LockOptions{RetryDelay: 10 * time.Millisecond})
+	if !errors.Is(err, ErrLockNotAcquired) {
+		t.Errorf("acquire of a held lock err = %v, want %v", err, ErrLockNotAcquired)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { held.Release() })
+
+	lock, err := AcquireLock(ctx, pool, testLockName, LockOptions{RetryDelay: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	if lock.Token() <= held.Token() {
+		t.Errorf("token %d, want greater than the token %d of the former holder", lock.Token(), held.Token())
+	}
+}
+
+func TestLockRenewed(t *testing.T) {
+	pool, mr := newTestPool(t)
+
+	lock, err := TryLock(context.Background(), pool, testLockName,
+		LockOptions{Ttl: time.Second, RenewInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Release()
+
+	//NOTE: the lock would expire without the renewal
+	for i := 0; i < 5; i++ {
+		mr.FastForward(900 * time.Millisecond)
+		time.Sleep(100 * time.Millisecond)
+		if ttl := mr.TTL(testLockName); ttl < 500*time.Millisecond {
+			t.Fatalf("ttl = %v, want the lock renewed", ttl)
+		}
+	}
+
+	if err := lock.Err(); err != nil {
+		t.Errorf("renewed lock err = %v", err)
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	pool, mr := newTestPool(t)
+
+	lock, err := TryLock(context.Background(), pool, testLockName,
+		LockOptions{Ttl: time.Second, RenewInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: the lock expired while the holder was paused and was taken by another owner
+	mr.Set(testLockName, "another")
+
+	select {
+	case <-lock.Context().Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("context of the lost lock is not done")
+	}
+	if err := lock.Err(); !errors.Is(err, ErrLockLost) {
+		t.Errorf("lost lock err = %v, want %v", err, ErrLockLost)
+	}
+
+	if err := lock.Release(); !errors.Is(err, ErrLockLost) {
+		t.Errorf("release of the lost lock err = %v, want %v", err, ErrLockLost)
+	}
+	if owner, _ := mr.Get(testLockName); owner != "another" {
+		t.Errorf("lock of another owner is %q after the release, want it kept", owner)
+	}
+}
+
+func TestReleaseTakenOverLock(t *testing.T) {
+	pool, mr := newTestPool(t)
+	ctx := context.Background()
+
+	lock, err := TryLock(ctx, pool, testLockName, LockOptions{Ttl: time.Second, RenewInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//NOTE: the lock expires before the renewal notices it, a new holder takes it
+	mr.FastForward(2 * time.Second)
+	next, err := TryLock(ctx, pool, testLockName, LockOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Release()
+
+	if next.Token() <= lock.Token() {
+		t.Errorf("token %d, want greater than the token %d of the expired holder", next.Token(), lock.Token())
+	}
+
+	if err := lock.Release(); !errors.Is(err, ErrLockLost) {
+		t.Errorf("release of the taken over lock err = %v, want %v", err, ErrLockLost)
+	}
+	if held, _ := LockHeld(pool, testLockName); !held {
+		t.Error("release of the former holder deleted the lock of the new one")
+	}
+}
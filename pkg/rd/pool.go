@@ -1,47 +1,157 @@
 package rd
 
 import (
+	"context"
 	"github.com/go-logr/logr"
 	"github.com/gomodule/redigo/redis"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
 	"time"
 )
 
+var (
+	poolConnections = &poolCollector{
+		desc: prometheus.NewDesc("rd_pool_connections",
+			"Connections of redis pools, active ones include the idle ones.", []string{"rd", "state"}, nil),
+		pools: make(map[string]*Pool),
+	}
+	borrowWait = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rd_pool_borrow_wait_seconds",
+		Help:    "Time of borrowing a connection from a redis pool.",
+		Buckets: prometheus.ExponentialBuckets(.0001, 4, 8),
+	}, []string{"rd"})
+	borrowErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rd_pool_borrow_errors_total",
+		Help: "Failed borrows of a connection from a redis pool, e.g. on the wait timeout.",
+	}, []string{"rd"})
+)
+
+func init() {
+	prometheus.MustRegister(poolConnections)
+}
+
+// poolCollector reads the connections of the open pools by prefix on every scrape
+type poolCollector struct {
+	desc  *prometheus.Desc
+	mu    sync.Mutex
+	pools map[string]*Pool
+}
+
+func (c *poolCollector) add(p *Pool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pools[p.spec.Prefix] = p
+}
+
+func (c *poolCollector) remove(p *Pool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	//NOTE: a newer pool of the prefix is kept
+	if c.pools[p.spec.Prefix] == p {
+		delete(c.pools, p.spec.Prefix)
+	}
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for prefix, p := range c.pools {
+		stats := p.rd.Stats()
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(stats.ActiveCount), prefix, "active")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(stats.IdleCount), prefix, "idle")
+	}
+}
+
 type Pool struct {
-	rd   *redis.Pool
-	spec Spec
+	rd      *redis.Pool
+	spec    Spec
+	limits  poolLimits
+	cluster *cluster
 }
 
-func OpenPool(spec Spec, logger logr.Logger) *Pool {
-	p := &Pool{spec: spec, rd: openPool(spec, logger)}
-	return p
+// poolLimits are the limits of the pool of the spec, the pools of cluster nodes have the same ones
+type poolLimits struct {
+	maxIdle     int
+	maxActive   int
+	wait        bool
+	waitTimeout time.Duration
+	idleTimeout time.Duration
+	maxLifetime time.Duration
 }
 
-func openPool(s Spec, logger logr.Logger) *redis.Pool {
-	maxIdle := s.MaxIdleCons
-	if maxIdle == 0 {
-		maxIdle = 16
+func newPoolLimits(s Spec) poolLimits {
+	l := poolLimits{
+		maxIdle:     s.MaxIdleCons,
+		maxActive:   s.MaxActiveCons,
+		wait:        s.Wait,
+		waitTimeout: time.Millisecond * time.Duration(s.WaitTimeoutMs),
+		idleTimeout: time.Second * time.Duration(s.ConnMaxIdleTimeSec),
+		maxLifetime: time.Second * time.Duration(s.ConnMaxLifetimeSec),
 	}
 
-	idleTimeoutSec := s.ConnMaxIdleTimeSec
-	if idleTimeoutSec == 0 {
-		idleTimeoutSec = 240
+	if l.maxIdle == 0 {
+		l.maxIdle = 16
+	}
+	if l.idleTimeout == 0 {
+		l.idleTimeout = 240 * time.Second
+	}
+	if l.waitTimeout == 0 {
+		l.waitTimeout = time.Second
+	}
+
+	return l
+}
+
+func (l poolLimits) apply(p *redis.Pool) *redis.Pool {
+	p.MaxIdle = l.maxIdle
+	p.MaxActive = l.maxActive
+	p.Wait = l.wait
+	p.IdleTimeout = l.idleTimeout
+	p.MaxConnLifetime = l.maxLifetime
+	return p
+}
+
+// OpenPool opens the pool of the server, sentinel master or cluster of the spec, it panics on invalid TLS files
+func OpenPool(spec Spec, logger logr.Logger) *Pool {
+	if len(spec.Prefix) > 0 {
+		logger = logger.WithValues("rd", spec.Prefix)
 	}
 
-	connStr := s.ConnStr()
+	d, err := newDialer(spec)
+	if err != nil {
+		panic("failed to configure redis tls: " + err.Error())
+	}
 
-	if len(s.Prefix) > 0 {
-		logger = logger.WithValues("rd", s.Prefix)
+	p := &Pool{spec: spec, limits: newPoolLimits(spec)}
+	if spec.Cluster != nil {
+		p.cluster = newCluster(d, logger, p.limits)
+		p.rd = openPool(spec, logger, p.limits, func() (redis.Conn, error) {
+			return &clusterConn{cluster: p.cluster}, nil
+		})
+	} else {
+		p.rd = openPool(spec, logger, p.limits, d.dialServer)
 	}
 
-	return &redis.Pool{
-		Wait:        false,
-		MaxIdle:     maxIdle,
-		IdleTimeout: time.Second * time.Duration(idleTimeoutSec),
+	poolConnections.add(p)
+
+	return p
+}
+
+func openPool(s Spec, logger logr.Logger, limits poolLimits, dial func() (redis.Conn, error)) *redis.Pool {
+	return limits.apply(&redis.Pool{
 		Dial: func() (redis.Conn, error) {
-			orig, err := redis.Dial("tcp", connStr)
+			orig, err := dial()
 			if err != nil {
-				return nil, errors.WithStack(err)
+				return nil, err
 			}
 			c := &Conn{
 				origin: orig,
@@ -50,27 +160,21 @@ func openPool(s Spec, logger logr.Logger) *redis.Pool {
 				spec:   s,
 			}
 
-			// Сохраняем название клиента для диагностики соединений с помощью команды CLIENT LIST.
-			// https://redis.io/commands/client-list/
-			if len(s.ClientName) > 0 {
-				_, err = c.Do("CLIENT", "SETNAME", s.ClientName)
-				if err != nil {
-					return nil, errors.WithStack(err)
-				}
-			}
-
-			_, err = c.Do("SELECT", s.Db)
-			if err != nil {
-				return nil, errors.WithStack(err)
-			}
-
-			return c, err
+			return c, nil
 		},
 		TestOnBorrow: func(c redis.Conn, _ time.Time) error {
+			switch {
+			case s.Cluster != nil:
+				//NOTE: the node connections are tested by their pools
+				return nil
+			case s.Sentinel != nil:
+				// the old master becomes a replica after a failover
+				return checkMaster(c)
+			}
 			_, err := c.Do("PING")
 			return err
 		},
-	}
+	})
 }
 
 func (p *Pool) Origin() *redis.Pool {
@@ -78,16 +182,62 @@ func (p *Pool) Origin() *redis.Pool {
 }
 
 func (p *Pool) Close() {
+	poolConnections.remove(p)
 	p.rd.Close()
+	if p.cluster != nil {
+		p.cluster.close()
+	}
 }
 
+// Get borrows a connection waiting for a free one up to the wait timeout of the spec in the wait mode.
+// Like redis.Pool.Get a failed borrow returns a connection failing all commands.
 func (p *Pool) Get() redis.Conn {
-	conn := p.rd.Get()
+	ctx, cancel := context.WithTimeout(context.Background(), p.limits.waitTimeout)
+	defer cancel()
+
+	conn, err := p.GetContext(ctx)
+	if err != nil {
+		return errorConn{err: err}
+	}
 	return conn
 }
 
+// GetContext borrows a connection waiting for a free one until ctx is done in the wait mode
+func (p *Pool) GetContext(ctx context.Context) (redis.Conn, error) {
+	start := time.Now()
+	conn, err := p.rd.GetContext(ctx)
+	borrowWait.WithLabelValues(p.spec.Prefix).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		borrowErrors.WithLabelValues(p.spec.Prefix).Inc()
+		return nil, errors.WithStack(err)
+	}
+	return conn, nil
+}
+
 func (p *Pool) Do(cmd string, args ...interface{}) (interface{}, error) {
 	rc := p.Get()
 	defer rc.Close()
 	return rc.Do(cmd, args...)
 }
+
+func (p *Pool) DoContext(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	rc, err := p.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return redis.DoContext(rc, ctx, cmd, args...)
+}
+
+// errorConn is returned by Get when no connection is borrowed
+type errorConn struct {
+	err error
+}
+
+func (c errorConn) Close() error                                   { return nil }
+func (c errorConn) Err() error                                     { return c.err }
+func (c errorConn) Do(string, ...interface{}) (interface{}, error) { return nil, c.err }
+func (c errorConn) Send(string, ...interface{}) error              { return c.err }
+func (c errorConn) Flush() error                                   { return c.err }
+func (c errorConn) Receive() (interface{}, error)                  { return nil, c.err }
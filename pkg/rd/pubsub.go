@@ -0,0 +1,123 @@
+package rd
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const subscriptionRetryDelay = time.Second
+
+// Subscription receives messages of redis channels on a dedicated connection, reconnecting on failures
+type Subscription struct {
+	pool      *Pool
+	logger    logr.Logger
+	channels  []interface{}
+	onMessage func(channel string, data []byte)
+	onConnect func()
+
+	mu     sync.Mutex
+	conn   redis.Conn
+	closed bool
+	done   chan struct{}
+}
+
+// Subscribe starts receiving messages of the channels. Messages published while the subscription
+// is reconnecting are lost, so onConnect is called on every (re)connect to let the caller resync.
+func Subscribe(pool *Pool, logger logr.Logger, onMessage func(channel string, data []byte), onConnect func(),
+	channels ...string) *Subscription {
+
+	s := &Subscription{
+		pool:      pool,
+		logger:    logger,
+		onMessage: onMessage,
+		onConnect: onConnect,
+		done:      make(chan struct{}),
+	}
+	for _, channel := range channels {
+		s.channels = append(s.channels, channel)
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *Subscription) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	if s.conn != nil {
+		//NOTE: unblocks the receiving
+		s.conn.Close()
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+func (s *Subscription) run() {
+	defer close(s.done)
+
+	for {
+		err := s.receive()
+
+		s.mu.Lock()
+		closed := s.closed
+		s.mu.Unlock()
+		if closed {
+			return
+		}
+
+		s.logger.Error(err, "Redis subscription failed, reconnecting", "channels", s.channels)
+		time.Sleep(subscriptionRetryDelay)
+	}
+}
+
+func (s *Subscription) receive() error {
+	//NOTE: subscribed connection can't be returned to the pool, so it is dialed separately
+	conn, err := s.pool.Origin().Dial()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return nil
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.conn = nil
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(s.channels...); err != nil {
+		return errors.WithStack(err)
+	}
+
+	for {
+		//NOTE: waiting for messages without the read timeout of the spec
+		switch v := psc.ReceiveWithTimeout(0).(type) {
+		case redis.Message:
+			s.onMessage(v.Channel, v.Data)
+		case redis.Subscription:
+			if v.Kind == "subscribe" && v.Count == len(s.channels) && s.onConnect != nil {
+				s.onConnect()
+			}
+		case error:
+			return errors.WithStack(v)
+		}
+	}
+}
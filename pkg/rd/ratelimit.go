@@ -0,0 +1,197 @@
+package rd
+
+import (
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+// Limit is a sliding window quota: at most Max units per Window for Key.
+// Cost is the amount of units consumed by one call, 1 if not set.
+type Limit struct {
+	Key    string
+	Max    int
+	Window time.Duration
+	Cost   int
+}
+
+type LimitResult struct {
+	Allowed bool
+	// Key of the first exhausted limit, empty if allowed
+	Key string
+	// Remaining units of the tightest limit after this call
+	Remaining  int
+	RetryAfter time.Duration
+
+	// member and limits of the units consumed by the allowed call, so the call can be refunded
+	member string
+	limits []Limit
+}
+
+// KEYS: limit keys, all in one slot in a cluster
+// ARGV: now_ms, member, then window_ms, max, cost for every key
+// Every key is a sorted set of consumed units scored by their time, so the window slides with each call.
+// All limits are checked before any of them is consumed, so a rejected call costs nothing.
+var slidingWindowScript = redis.NewScript(-1, `
+local now = tonumber(ARGV[1])
+local member = ARGV[2]
+local remaining = -1
+
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[3 + (i - 1) * 3])
+	local max = tonumber(ARGV[4 + (i - 1) * 3])
+	local cost = tonumber(ARGV[5 + (i - 1) * 3])
+
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+	local count = redis.call('ZCARD', key)
+
+	if count + cost > max then
+		local retry = window
+		local over = count + cost - max
+		if cost <= max then
+			local oldest = redis.call('ZRANGE', key, over - 1, over - 1, 'WITHSCORES')
+			if #oldest > 0 then
+				retry = tonumber(oldest[2]) + window - now
+			end
+		end
+		return {0, i, max - count, retry}
+	end
+
+	local left = max - count - cost
+	if remaining < 0 or left < remaining then
+		remaining = left
+	end
+end
+
+for i, key in ipairs(KEYS) do
+	local window = tonumber(ARGV[3 + (i - 1) * 3])
+	local cost = tonumber(ARGV[5 + (i - 1) * 3])
+	for n = 1, cost do
+		redis.call('ZADD', key, now, member .. ':' .. n)
+	end
+	redis.call('PEXPIRE', key, window)
+end
+
+return {1, 0, remaining, 0}
+`)
+
+var limitMemberSeq uint64
+
+// RateLimiter is a Redis backed sliding window rate limiter
+type RateLimiter struct {
+	pool   *Pool
+	prefix string
+}
+
+func NewRateLimiter(pool *Pool, prefix string) *RateLimiter {
+	return &RateLimiter{pool: pool, prefix: prefix}
+}
+
+// Allow checks all limits and consumes them only if none is exhausted. The limits are checked atomically
+// by one script, in a cluster by one script per slot of their keys: a call rejected by a later slot
+// gives back the units consumed by the earlier ones.
+func (l *RateLimiter) Allow(limits ...Limit) (*LimitResult, error) {
+	if len(limits) == 0 {
+		return &LimitResult{Allowed: true}, nil
+	}
+
+	now := time.Now()
+	member := fmt.Sprintf("%d-%d", now.UnixNano(), atomic.AddUint64(&limitMemberSeq, 1))
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	groups := l.slotGroups(limits)
+	result := &LimitResult{Allowed: true, Remaining: -1, member: member, limits: limits}
+
+	for i, group := range groups {
+		reply, err := l.allowGroup(conn, now, member, group)
+		if err != nil || reply[0] != 1 {
+			l.refund(conn, member, groups[:i])
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if reply[0] != 1 {
+			return &LimitResult{
+				Key:        group[reply[1]-1].Key,
+				Remaining:  int(reply[2]),
+				RetryAfter: time.Duration(reply[3]) * time.Millisecond,
+			}, nil
+		}
+
+		if result.Remaining < 0 || int(reply[2]) < result.Remaining {
+			result.Remaining = int(reply[2])
+		}
+	}
+
+	return result, nil
+}
+
+// slotGroups groups the limits by the cluster slots of their keys, all limits are in one group out of a cluster
+func (l *RateLimiter) slotGroups(limits []Limit) [][]Limit {
+	return groupBySlot(l.pool, limits, func(limit Limit) string { return l.prefix + limit.Key })
+}
+
+// allowGroup runs the script on the limits of one slot
+func (l *RateLimiter) allowGroup(conn redis.Conn, now time.Time, member string, limits []Limit) ([]int64, error) {
+	args := make([]interface{}, 0, 1+len(limits)*4+2)
+	args = append(args, len(limits))
+	for _, limit := range limits {
+		args = append(args, l.prefix+limit.Key)
+	}
+	args = append(args, now.UnixMilli(), member)
+	for _, limit := range limits {
+		args = append(args, limit.Window.Milliseconds(), limit.Max, limitCost(limit))
+	}
+
+	reply, err := redis.Int64s(slidingWindowScript.Do(conn, args...))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(reply) != 4 {
+		return nil, errors.Errorf("unexpected rate limit reply %v", reply)
+	}
+
+	return reply, nil
+}
+
+// Refund gives back the units consumed by the allowed call, e.g. if the request failed after all
+func (l *RateLimiter) Refund(result *LimitResult) error {
+	if !result.Allowed || len(result.limits) == 0 {
+		return nil
+	}
+
+	conn := l.pool.Get()
+	defer conn.Close()
+
+	return l.refund(conn, result.member, [][]Limit{result.limits})
+}
+
+// refund removes the units of the call consumed by the groups.
+// A failed refund only tightens the limit till the units slide out of the window.
+func (l *RateLimiter) refund(conn redis.Conn, member string, groups [][]Limit) error {
+	var refundErr error
+	for _, group := range groups {
+		for _, limit := range group {
+			args := []interface{}{l.prefix + limit.Key}
+			for n := 1; n <= limitCost(limit); n++ {
+				args = append(args, fmt.Sprintf("%s:%d", member, n))
+			}
+			if _, err := conn.Do("ZREM", args...); err != nil {
+				refundErr = errors.Wrapf(err, "can't refund rate limit %s", limit.Key)
+			}
+		}
+	}
+	return refundErr
+}
+
+func limitCost(limit Limit) int {
+	if limit.Cost <= 0 {
+		return 1
+	}
+	return limit.Cost
+}
@@ -0,0 +1,127 @@
+package rd
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-logr/logr"
+	"testing"
+	"time"
+)
+
+const testLimitPrefix = "rl:"
+
+func newTestRateLimiter(t *testing.T, cluster bool) (*RateLimiter, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	spec := Spec{Host: mr.Host(), Port: mr.Server().Addr().Port}
+	if cluster {
+		spec.Cluster = &ClusterSpec{Addrs: []string{mr.Addr()}}
+	}
+
+	pool := OpenPool(spec, logr.Discard())
+	t.Cleanup(pool.Close)
+
+	return NewRateLimiter(pool, testLimitPrefix), mr
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l, mr := newTestRateLimiter(t, false)
+	limits := []Limit{
+		{Key: "owner:1", Max: 3, Window: time.Minute, Cost: 2},
+		{Key: "client:a", Max: 10, Window: time.Minute},
+	}
+
+	res, err := l.Allow(limits...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Allowed || res.Remaining != 1 {
+		t.Fatalf("result = %+v, want allowed with 1 remaining", res)
+	}
+
+	res, err = l.Allow(limits...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Key != "owner:1" || res.RetryAfter <= 0 {
+		t.Fatalf("result = %+v, want rejected by owner:1", res)
+	}
+
+	//NOTE: the rejected call consumed nothing
+	members, _ := mr.ZMembers(testLimitPrefix + "client:a")
+	if len(members) != 1 {
+		t.Errorf("client units = %d, want 1", len(members))
+	}
+
+	//NOTE: the keys expire with the window
+	mr.FastForward(time.Minute)
+	if res, err := l.Allow(limits...); err != nil || !res.Allowed {
+		t.Errorf("result after the window = %+v, %v, want allowed", res, err)
+	}
+}
+
+func TestRateLimiterRefundsEarlierSlots(t *testing.T) {
+	l, mr := newTestRateLimiter(t, true)
+
+	limits := []Limit{
+		{Key: "client:a", Max: 10, Window: time.Minute, Cost: 2},
+		{Key: "owner:1", Max: 1, Window: time.Minute},
+	}
+	if groups := l.slotGroups(limits); len(groups) != 2 {
+		t.Fatalf("groups = %d, want a group for every slot", len(groups))
+	}
+	if groups := l.slotGroups([]Limit{{Key: "{owner:1}:adverts"}, {Key: "{owner:1}:photos"}}); len(groups) != 1 {
+		t.Errorf("groups of one hash tag = %d, want 1", len(groups))
+	}
+
+	if res, err := l.Allow(limits...); err != nil || !res.Allowed {
+		t.Fatalf("result = %+v, %v, want allowed", res, err)
+	}
+
+	res, err := l.Allow(limits...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed || res.Key != "owner:1" {
+		t.Fatalf("result = %+v, want rejected by owner:1", res)
+	}
+
+	members, _ := mr.ZMembers(testLimitPrefix + "client:a")
+	if len(members) != 2 {
+		t.Errorf("client units = %d, want 2 as the rejected call is refunded", len(members))
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	l, mr := newTestRateLimiter(t, false)
+	limits := []Limit{
+		{Key: "owner:1", Max: 3, Window: time.Minute, Cost: 2},
+		{Key: "client:a", Max: 10, Window: time.Minute},
+	}
+
+	kept, err := l.Allow(limits...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunded, err := l.Allow(limits[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Refund(refunded); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := mr.ZMembers(testLimitPrefix + "client:a"); len(members) != 1 {
+		t.Errorf("client units = %d, want 1 after the refund", len(members))
+	}
+	if members, _ := mr.ZMembers(testLimitPrefix + "owner:1"); len(members) != 2 {
+		t.Errorf("owner units = %d, want the units of another call kept", len(members))
+	}
+
+	if err := l.Refund(kept); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists(testLimitPrefix+"owner:1") || mr.Exists(testLimitPrefix+"client:a") {
+		t.Error("refunded units are left")
+	}
+}
@@ -15,6 +15,46 @@ type Spec struct {
 	MaxIdleCons        int    `json:"max_idle_cons"`
 	ConnMaxIdleTimeSec int    `json:"conn_max_idle_time_sec"`
 	LogLevel           int    `json:"log_level"`
+	// MaxActiveCons limits the connections of the pool, no limit if 0
+	MaxActiveCons int `json:"max_active_cons"`
+	// Wait makes borrowing wait for a free connection when all MaxActiveCons are in use instead of failing,
+	// Get waits up to WaitTimeoutMs, 1000 if 0
+	Wait               bool `json:"wait"`
+	WaitTimeoutMs      int  `json:"wait_timeout_ms"`
+	ConnMaxLifetimeSec int  `json:"conn_max_lifetime_sec"`
+	// DialTimeoutMs, ReadTimeoutMs and WriteTimeoutMs bound the network operations, no timeout if 0
+	DialTimeoutMs  int `json:"dial_timeout_ms"`
+	ReadTimeoutMs  int `json:"read_timeout_ms"`
+	WriteTimeoutMs int `json:"write_timeout_ms"`
+	// Username is the ACL user authenticated with Password, the default user if empty
+	Username string        `json:"username"`
+	Tls      *TlsSpec      `json:"tls"`
+	Sentinel *SentinelSpec `json:"sentinel"`
+	Cluster  *ClusterSpec  `json:"cluster"`
+}
+
+// TlsSpec turns on TLS, the files are PEM encoded, CaFile verifies the server instead of the system roots
+// and CertFile with KeyFile are the client certificate
+type TlsSpec struct {
+	CaFile             string `json:"ca_file"`
+	CertFile           string `json:"cert_file"`
+	KeyFile            string `json:"key_file"`
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// SentinelSpec discovers the master by its name on the sentinels instead of Host and Port
+type SentinelSpec struct {
+	MasterName string   `json:"master_name"`
+	Addrs      []string `json:"addrs"`
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+}
+
+// ClusterSpec routes commands to the cluster nodes by the slots of their keys, Addrs are the seed nodes.
+// Commands with several keys need the keys in one slot, e.g. by a {hash tag}.
+type ClusterSpec struct {
+	Addrs []string `json:"addrs"`
 }
 
 type Settings map[string]Spec